@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/devops-simba/helpers"
+)
+
+const (
+	ACLNeedsPacketsMode = helpers.StringError("ACL is only supported in `packets` proxy mode")
+	MissingACLFile      = helpers.StringError("`file` is required for ACL")
+)
+
+type ACLAccess int
+
+const (
+	// ACLRead client may subscribe to the topic
+	ACLRead ACLAccess = 1 << iota
+	// ACLWrite client may publish to the topic
+	ACLWrite
+	// ACLDeny client may neither subscribe nor publish to the topic, even if another rule allow it
+	ACLDeny
+
+	ACLReadWrite = ACLRead | ACLWrite
+)
+
+func parseACLAccess(s string) (ACLAccess, bool) {
+	switch s {
+	case "read":
+		return ACLRead, true
+	case "write":
+		return ACLWrite, true
+	case "readwrite":
+		return ACLReadWrite, true
+	case "deny":
+		return ACLDeny, true
+	default:
+		return 0, false
+	}
+}
+
+//region topic matching
+func isWildcardLevel(level string) bool { return level == "+" || level == "#" }
+
+// topicMatches check whether a topic name matches a topic filter, wildcards in the first level of the filter do
+// not match topics that start with `$`
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && isWildcardLevel(f[0]) {
+		return false
+	}
+	for i := 0; i < len(f); i++ {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// filterCovers check whether every topic that match `filter` also match `pattern`
+func filterCovers(pattern, filter string) bool {
+	p := strings.Split(pattern, "/")
+	f := strings.Split(filter, "/")
+	if strings.HasPrefix(filter, "$") && isWildcardLevel(p[0]) {
+		return false
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] == "#" {
+			return true
+		}
+		if i >= len(f) || f[i] == "#" {
+			return false
+		}
+		if p[i] != "+" && p[i] != f[i] {
+			return false
+		}
+	}
+	return len(p) == len(f)
+}
+
+// filtersOverlap check whether there is a topic that match both filters
+func filtersOverlap(a, b string) bool {
+	x := strings.Split(a, "/")
+	y := strings.Split(b, "/")
+	if (strings.HasPrefix(a, "$") && isWildcardLevel(y[0])) || (strings.HasPrefix(b, "$") && isWildcardLevel(x[0])) {
+		return false
+	}
+	for i := 0; i < len(x) || i < len(y); i++ {
+		if (i < len(x) && x[i] == "#") || (i < len(y) && y[i] == "#") {
+			return true
+		}
+		if i >= len(x) || i >= len(y) {
+			return false
+		}
+		if x[i] != "+" && y[i] != "+" && x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//endregion
+
+// aclRule is a `topic` or `pattern` line of the ACL file
+type aclRule struct {
+	Access ACLAccess
+	Topic  string
+	// Pattern topic of the rule may contain `%u` and `%c`
+	Pattern bool
+}
+
+// topic return topic of the rule for a client, or false if the rule does not apply to the client
+func (this aclRule) topic(username, clientID string) (string, bool) {
+	if !this.Pattern {
+		return this.Topic, true
+	}
+	return substituteClientInfo(this.Topic, username, clientID)
+}
+
+// ACL is a mosquitto style access control list. `topic` lines before the first `user` line apply to anonymous
+// clients, `topic` lines after a `user` line apply to that user and `pattern` lines apply to everyone. A client is
+// allowed if at least one rule allow it and no `deny` rule match it
+type ACL struct {
+	Anonymous []aclRule
+	Users     map[string][]aclRule
+	Patterns  []aclRule
+}
+
+// parseACL parse content of a mosquitto style ACL file
+func parseACL(content []byte) (interface{}, error) {
+	acl := &ACL{Users: make(map[string][]aclRule)}
+	user := ""
+	hasUser := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, rest := line, ""
+		if i := strings.IndexAny(line, " \t"); i != -1 {
+			keyword, rest = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if rest == "" {
+			return nil, fmt.Errorf("Invalid ACL line %d: `%s` needs an argument", lineNumber, keyword)
+		}
+
+		switch keyword {
+		case "user":
+			user = rest
+			hasUser = true
+
+		case "topic", "pattern":
+			rule := aclRule{Access: ACLReadWrite, Topic: rest, Pattern: keyword == "pattern"}
+			if i := strings.IndexAny(rest, " \t"); i != -1 {
+				if access, ok := parseACLAccess(rest[:i]); ok {
+					rule.Access = access
+					rule.Topic = strings.TrimSpace(rest[i+1:])
+				}
+			}
+
+			if rule.Pattern {
+				acl.Patterns = append(acl.Patterns, rule)
+			} else if hasUser {
+				acl.Users[user] = append(acl.Users[user], rule)
+			} else {
+				acl.Anonymous = append(acl.Anonymous, rule)
+			}
+
+		default:
+			return nil, fmt.Errorf("Invalid ACL line %d: unknown keyword `%s`", lineNumber, keyword)
+		}
+	}
+	return acl, scanner.Err()
+}
+
+func (this *ACL) check(
+	username, clientID string,
+	access ACLAccess,
+	allows, denies func(rule string) bool,
+) bool {
+	rules := this.Anonymous
+	if username != "" {
+		rules = this.Users[username]
+	}
+
+	allowed := false
+	for _, list := range [][]aclRule{rules, this.Patterns} {
+		for i := 0; i < len(list); i++ {
+			topic, ok := list[i].topic(username, clientID)
+			if !ok {
+				continue
+			}
+			if list[i].Access == ACLDeny {
+				if denies(topic) {
+					return false
+				}
+			} else if list[i].Access&access != 0 && !allowed {
+				allowed = allows(topic)
+			}
+		}
+	}
+	return allowed
+}
+
+// CanPublish check whether a client may publish to a topic
+func (this *ACL) CanPublish(username, clientID, topic string) bool {
+	matches := func(rule string) bool { return topicMatches(rule, topic) }
+	return this.check(username, clientID, ACLWrite, matches, matches)
+}
+
+// CanSubscribe check whether a client may subscribe to a topic filter. Every topic of the filter must be allowed
+// and no topic of the filter may be denied, so `#` is rejected if there is a `deny` rule
+func (this *ACL) CanSubscribe(username, clientID, filter string) bool {
+	return this.check(username, clientID, ACLRead,
+		func(rule string) bool { return filterCovers(rule, filter) },
+		func(rule string) bool { return filtersOverlap(rule, filter) })
+}
+
+type ACLConfig struct {
+	// File path of a mosquitto style ACL file, it is reloaded when it changes
+	File string `yaml:"file"`
+}
+
+// CreateACL load the ACL file of the config and return a function that return its current content, or return `nil`
+// if config is `nil`
+func CreateACL(config *ACLConfig) (func() *ACL, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if config.File == "" {
+		return nil, MissingACLFile
+	}
+	file, err := newWatchedFile(config.File, CreateLogger("acl"), parseACL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load ACL file: %w", err)
+	}
+	return func() *ACL { return file.Get().(*ACL) }, nil
+}
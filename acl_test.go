@@ -0,0 +1,253 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func mustParseACL(t *testing.T, content string) *ACL {
+	acl, err := parseACL([]byte(content))
+	if err != nil {
+		t.Fatalf("Failed to parse ACL: %v", err)
+	}
+	return acl.(*ACL)
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{filter: "a/b", topic: "a/b", matches: true},
+		{filter: "a/b", topic: "a/c", matches: false},
+		{filter: "a/b", topic: "a/b/c", matches: false},
+		{filter: "a/+", topic: "a/b", matches: true},
+		{filter: "a/+", topic: "a/b/c", matches: false},
+		{filter: "a/+/c", topic: "a/b/c", matches: true},
+		{filter: "a/#", topic: "a", matches: true},
+		{filter: "a/#", topic: "a/b/c", matches: true},
+		{filter: "#", topic: "a/b", matches: true},
+		{filter: "#", topic: "$SYS/uptime", matches: false},
+		{filter: "+/uptime", topic: "$SYS/uptime", matches: false},
+		{filter: "$SYS/#", topic: "$SYS/uptime", matches: true},
+	}
+	for _, test := range tests {
+		if topicMatches(test.filter, test.topic) != test.matches {
+			t.Errorf("Expected topicMatches(`%s`, `%s`) to be %v", test.filter, test.topic, test.matches)
+		}
+	}
+}
+
+func TestFilterCovers(t *testing.T) {
+	tests := []struct {
+		pattern string
+		filter  string
+		covers  bool
+	}{
+		{pattern: "a/b", filter: "a/b", covers: true},
+		{pattern: "a/+", filter: "a/b", covers: true},
+		{pattern: "a/+", filter: "a/+", covers: true},
+		{pattern: "a/b", filter: "a/+", covers: false},
+		{pattern: "a/+", filter: "a/#", covers: false},
+		{pattern: "a/#", filter: "a/+/c", covers: true},
+		{pattern: "a/#", filter: "a/#", covers: true},
+		{pattern: "a/+/c", filter: "a/b", covers: false},
+		{pattern: "#", filter: "$SYS/#", covers: false},
+		{pattern: "$SYS/#", filter: "$SYS/+", covers: true},
+	}
+	for _, test := range tests {
+		if filterCovers(test.pattern, test.filter) != test.covers {
+			t.Errorf("Expected filterCovers(`%s`, `%s`) to be %v", test.pattern, test.filter, test.covers)
+		}
+	}
+}
+
+func TestFiltersOverlap(t *testing.T) {
+	tests := []struct {
+		a       string
+		b       string
+		overlap bool
+	}{
+		{a: "a/b", b: "a/b", overlap: true},
+		{a: "a/b", b: "a/c", overlap: false},
+		{a: "a/+", b: "+/b", overlap: true},
+		{a: "a/+", b: "a/b/c", overlap: false},
+		{a: "a/#", b: "a", overlap: true},
+		{a: "#", b: "a/b/c", overlap: true},
+		{a: "a/b", b: "a/b/c", overlap: false},
+		{a: "#", b: "$SYS/uptime", overlap: false},
+		{a: "$SYS/#", b: "$SYS/uptime", overlap: true},
+	}
+	for _, test := range tests {
+		if filtersOverlap(test.a, test.b) != test.overlap || filtersOverlap(test.b, test.a) != test.overlap {
+			t.Errorf("Expected filtersOverlap(`%s`, `%s`) to be %v", test.a, test.b, test.overlap)
+		}
+	}
+}
+
+func TestParseACL(t *testing.T) {
+	acl := mustParseACL(t, `
+# comment
+topic read public/#
+
+user alice
+topic write alice/out
+topic   alice/both
+topic deny alice/secret
+
+pattern read devices/%c/in
+`)
+	if len(acl.Anonymous) != 1 || acl.Anonymous[0] != (aclRule{Access: ACLRead, Topic: "public/#"}) {
+		t.Errorf("Unexpected anonymous rules: %+v", acl.Anonymous)
+	}
+	expected := []aclRule{
+		{Access: ACLWrite, Topic: "alice/out"},
+		{Access: ACLReadWrite, Topic: "alice/both"},
+		{Access: ACLDeny, Topic: "alice/secret"},
+	}
+	if len(acl.Users["alice"]) != len(expected) {
+		t.Fatalf("Unexpected rules of `alice`: %+v", acl.Users["alice"])
+	}
+	for i := 0; i < len(expected); i++ {
+		if acl.Users["alice"][i] != expected[i] {
+			t.Errorf("Expected rule %d of `alice` to be %+v, got %+v", i, expected[i], acl.Users["alice"][i])
+		}
+	}
+	if len(acl.Patterns) != 1 || acl.Patterns[0] != (aclRule{Access: ACLRead, Topic: "devices/%c/in", Pattern: true}) {
+		t.Errorf("Unexpected patterns: %+v", acl.Patterns)
+	}
+
+	for _, invalid := range []string{"topic", "user", "group admins"} {
+		if _, err := parseACL([]byte(invalid)); err == nil {
+			t.Errorf("Expected `%s` to be rejected", invalid)
+		}
+	}
+}
+
+func TestACLChecks(t *testing.T) {
+	acl := mustParseACL(t, `
+topic read public/#
+
+user alice
+topic write alice/out
+topic alice/#
+topic deny alice/secret
+
+pattern read devices/%c/in
+pattern write users/%u/#
+`)
+
+	tests := []struct {
+		name      string
+		username  string
+		clientID  string
+		subscribe bool
+		topic     string
+		allowed   bool
+	}{
+		{name: "anonymous subscribe", clientID: "c1", subscribe: true, topic: "public/news", allowed: true},
+		{name: "anonymous publish", clientID: "c1", topic: "public/news", allowed: false},
+		{name: "anonymous rules are not for users", username: "alice", clientID: "c1", subscribe: true,
+			topic: "public/news", allowed: false},
+		{name: "user write", username: "alice", clientID: "c1", topic: "alice/out", allowed: true},
+		{name: "user readwrite", username: "alice", clientID: "c1", subscribe: true, topic: "alice/in",
+			allowed: true},
+		{name: "deny publish", username: "alice", clientID: "c1", topic: "alice/secret", allowed: false},
+		{name: "deny subscribe", username: "alice", clientID: "c1", subscribe: true, topic: "alice/secret",
+			allowed: false},
+		{name: "deny wildcard subscribe", username: "alice", clientID: "c1", subscribe: true, topic: "alice/#",
+			allowed: false},
+		{name: "unknown user", username: "bob", clientID: "c1", topic: "alice/out", allowed: false},
+		{name: "%c pattern", clientID: "c1", subscribe: true, topic: "devices/c1/in", allowed: true},
+		{name: "%c pattern of another client", clientID: "c1", subscribe: true, topic: "devices/c2/in",
+			allowed: false},
+		{name: "%c with wildcard", clientID: "+", subscribe: true, topic: "devices/+/in", allowed: false},
+		{name: "%u pattern", username: "bob", clientID: "c1", topic: "users/bob/status", allowed: true},
+		{name: "%u pattern of another user", username: "bob", clientID: "c1", topic: "users/alice/status",
+			allowed: false},
+		{name: "%u without username", clientID: "c1", topic: "users//status", allowed: false},
+		{name: "%u with slash", username: "bob/x", clientID: "c1", topic: "users/bob/x/status", allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var allowed bool
+			if test.subscribe {
+				allowed = acl.CanSubscribe(test.username, test.clientID, test.topic)
+			} else {
+				allowed = acl.CanPublish(test.username, test.clientID, test.topic)
+			}
+			if allowed != test.allowed {
+				t.Errorf("Expected access to `%s` to be %v", test.topic, test.allowed)
+			}
+		})
+	}
+}
+
+func TestACLTopicAlias(t *testing.T) {
+	acl := mustParseACL(t, "pattern write allowed/#")
+	state := newProxyState("service", &ConnectPacket{ClientID: "c1", ProtocolVersion: MQTT5},
+		func() *ACL { return acl }, nil)
+	logger := CreateLogger("test")
+
+	publish := func(topic string, alias uint32) MQTTPacket {
+		pkt := &PublishPacket{TopicName: topic}
+		pkt.Properties.Set(Property{ID: PropTopicAlias, Int: alias})
+		result, err := state.intercept(logger, FrontendToBackend, nil, pkt)
+		if err != nil {
+			t.Fatalf("Failed to intercept PUBLISH: %v", err)
+		}
+		return result
+	}
+
+	if publish("allowed/a", 1) == nil {
+		t.Fatal("Expected PUBLISH that set alias 1 to be forwarded")
+	}
+	if publish("denied/a", 2) != nil {
+		t.Fatal("Expected PUBLISH that set alias 2 to be dropped")
+	}
+	if publish("", 1) == nil {
+		t.Error("Expected PUBLISH to the topic of alias 1 to be forwarded")
+	}
+	if publish("", 2) != nil {
+		t.Error("Expected PUBLISH to the topic of a dropped alias to be dropped")
+	}
+	if publish("", 3) != nil {
+		t.Error("Expected PUBLISH to an unknown alias to be dropped")
+	}
+	if publish("denied/b", 1) != nil || publish("", 1) == nil {
+		t.Error("Expected alias 1 to keep its topic after a dropped PUBLISH")
+	}
+}
+
+func TestACLDroppedPublishReuse(t *testing.T) {
+	acl := mustParseACL(t, "pattern write allowed/#")
+	state := newProxyState("service", &ConnectPacket{ClientID: "c1", ProtocolVersion: MQTT311},
+		func() *ACL { return acl }, nil)
+	logger := CreateLogger("test")
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+
+	intercept := func(packet MQTTPacket) MQTTPacket {
+		result, err := state.intercept(logger, FrontendToBackend, client, packet)
+		if err != nil {
+			t.Fatalf("Failed to intercept packet: %v", err)
+		}
+		return result
+	}
+
+	if intercept(&PublishPacket{TopicName: "denied/a", QoS: 2, PacketID: 7}) != nil {
+		t.Fatal("Expected QoS 2 PUBLISH to be dropped")
+	}
+	// client gave up the dropped PUBLISH and reused its packet ID
+	if intercept(&PublishPacket{TopicName: "allowed/a", QoS: 2, PacketID: 7}) == nil {
+		t.Fatal("Expected allowed PUBLISH to be forwarded")
+	}
+	if intercept(&AckPacket{PacketType: PacketPubrel, PacketID: 7}) == nil {
+		t.Error("Expected PUBREL of the forwarded PUBLISH to be forwarded")
+	}
+}
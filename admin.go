@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+var (
+	adminServer  *http.Server   = nil
+	adminLogger  helpers.Logger = nil
+	adminManager *ProxyManager  = nil
+	adminToken   string
+	adminPrefix  string
+)
+
+type AdminConfig struct {
+	// Address address of the admin API, for example `http://127.0.0.1:8081/api`
+	Address     string                  `yaml:"address"`
+	Enabled     *bool                   `yaml:"enabled,omitempty"`
+	Certificate *CertificateInformation `yaml:"certificate,omitempty"`
+	// Token if it is not empty, every request must have an `Authorization: Bearer <token>` header
+	Token string `yaml:"token,omitempty"`
+	// TokenFile a file that contains the token, it is used if `Token` is empty
+	TokenFile string `yaml:"tokenFile,omitempty"`
+}
+
+type adminAvailabilityInfo struct {
+	Status  string     `json:"status"`
+	Counter int        `json:"counter"`
+	NextTry *time.Time `json:"nextTry,omitempty"`
+}
+type adminBackendInfo struct {
+	Name              string                `json:"name"`
+	Address           string                `json:"address"`
+	Weight            int                   `json:"weight"`
+	State             string                `json:"state"`
+	Health            string                `json:"health"`
+	Availability      adminAvailabilityInfo `json:"availability"`
+	ActiveConnections int64                 `json:"activeConnections"`
+	Drained           bool                  `json:"drained"`
+	Latency           float64               `json:"latencySeconds"`
+}
+type adminFrontendInfo struct {
+	Name             string `json:"name"`
+	Address          string `json:"address"`
+	Protocol         string `json:"protocol"`
+	ConnectedClients int    `json:"connectedClients"`
+}
+type adminServiceInfo struct {
+	Name      string              `json:"name"`
+	ProxyMode ServiceProxyMode    `json:"proxyMode"`
+	Balancing BalancingMode       `json:"balancing"`
+	Frontends []adminFrontendInfo `json:"frontends"`
+	Backends  []adminBackendInfo  `json:"backends"`
+}
+type adminClientInfo struct {
+	Frontend      string    `json:"frontend"`
+	RemoteAddress string    `json:"remoteAddress"`
+	ClientID      string    `json:"clientId"`
+	Backend       string    `json:"backend,omitempty"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	Uptime        string    `json:"uptime"`
+}
+
+func newAdminBackendInfo(backend *MQTTBackend) adminBackendInfo {
+	counter := backend.loadAvailabilityCounter()
+	result := adminBackendInfo{
+		Name:              backend.Name,
+		Address:           backend.Endpoint.GetAddress(),
+		Weight:            backend.GetWeight(),
+		State:             backend.AdminState().String(),
+		Health:            backend.HealthState().String(),
+		ActiveConnections: backend.ActiveConnections(),
+		Drained:           backend.IsDrained(),
+		Latency:           backend.Latency(),
+		Availability: adminAvailabilityInfo{
+			Status:  counter.Status.String(),
+			Counter: counter.Counter,
+		},
+	}
+	if !counter.NextTry.IsZero() {
+		nextTry := counter.NextTry
+		result.Availability.NextTry = &nextTry
+	}
+	return result
+}
+func newAdminServiceInfo(service *MQTTService) adminServiceInfo {
+	service.guard.RLock()
+	defer service.guard.RUnlock()
+
+	result := adminServiceInfo{
+		Name:      service.Name,
+		ProxyMode: service.ProxyMode,
+		Balancing: service.balancingMode,
+		Frontends: make([]adminFrontendInfo, 0, len(service.Frontends)),
+		Backends:  make([]adminBackendInfo, 0, len(service.Backends)),
+	}
+	for i := 0; i < len(service.Frontends); i++ {
+		frontend := service.Frontends[i]
+		result.Frontends = append(result.Frontends, adminFrontendInfo{
+			Name:             frontend.Name,
+			Address:          frontend.Endpoint.GetAddress(),
+			Protocol:         frontend.Endpoint.GetProtocol(),
+			ConnectedClients: len(frontend.GetConnectedClients()),
+		})
+	}
+	for i := 0; i < len(service.Backends); i++ {
+		result.Backends = append(result.Backends, newAdminBackendInfo(service.Backends[i]))
+	}
+	return result
+}
+func getAdminClients(service *MQTTService) []adminClientInfo {
+	result := make([]adminClientInfo, 0)
+	frontends := service.GetFrontends()
+	for i := 0; i < len(frontends); i++ {
+		clients := frontends[i].GetConnectedClients()
+		for j := 0; j < len(clients); j++ {
+			client := clients[j]
+			info := adminClientInfo{
+				Frontend:      frontends[i].Name,
+				RemoteAddress: client.RemoteAddr().String(),
+				ClientID:      client.ClientID(),
+				ConnectedAt:   client.ConnectedAt,
+				Uptime:        client.Uptime().Truncate(time.Second).String(),
+			}
+			if backend := client.Backend(); backend != nil {
+				info.Backend = backend.Name
+			}
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// isClientAddress return `true` if `address` is `ip:port` of the client or only its IP
+func isClientAddress(client *ClientSession, address string) bool {
+	remoteAddress := client.RemoteAddr().String()
+	if remoteAddress == address {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddress)
+	return err == nil && host == address
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminResponse(w, status, map[string]string{"error": message})
+}
+
+func isAdminRequestAuthorized(r *http.Request) bool {
+	if adminToken == "" {
+		return true
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func handleAdminBackendRequest(w http.ResponseWriter, r *http.Request, service *MQTTService, parts []string) {
+	// parts: <backend> [<action>]
+	if len(parts) == 0 || len(parts) > 2 {
+		writeAdminError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	backend := service.GetBackend(parts[0])
+	if backend == nil {
+		writeAdminError(w, http.StatusNotFound, "Backend not found")
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, newAdminBackendInfo(backend))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	switch parts[1] {
+	case "enable":
+		backend.SetAdminState(BackendEnabled)
+	case "drain":
+		service.DrainBackend(backend)
+	case "disable":
+		backend.SetAdminState(BackendDisabled)
+		disconnected := service.DisconnectBackendClients(backend)
+		adminLogger.Infof("Disconnected %d clients of disabled backend `%s`", disconnected, backend.Name)
+	case "weight":
+		weight, err := strconv.Atoi(r.URL.Query().Get("value"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "Invalid weight")
+			return
+		}
+		if err = service.SetBackendWeight(backend, weight); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	default:
+		writeAdminError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	adminLogger.Infof("%s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+	writeAdminResponse(w, http.StatusOK, newAdminBackendInfo(backend))
+}
+func handleAdminClientsRequest(w http.ResponseWriter, r *http.Request, service *MQTTService, parts []string) {
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, getAdminClients(service))
+		return
+	}
+
+	if len(parts) != 1 || parts[0] != "disconnect" {
+		writeAdminError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	clientID := r.URL.Query().Get("clientId")
+	address := r.URL.Query().Get("address")
+	if clientID == "" && address == "" {
+		writeAdminError(w, http.StatusBadRequest, "`clientId` or `address` is required")
+		return
+	}
+
+	clients := service.GetConnectedClients()
+	disconnected := 0
+	for i := 0; i < len(clients); i++ {
+		if (clientID != "" && clients[i].ClientID() == clientID) ||
+			(address != "" && isClientAddress(clients[i], address)) {
+			clients[i].Disconnect()
+			disconnected++
+		}
+	}
+
+	adminLogger.Infof("%s: disconnected %d clients(clientId: `%s`, address: `%s`)",
+		r.RemoteAddr, disconnected, clientID, address)
+	writeAdminResponse(w, http.StatusOK, map[string]int{"disconnected": disconnected})
+}
+func handleAdminRequest(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequestAuthorized(r) {
+		adminLogger.Warnf("%s: unauthorized request to %s", r.RemoteAddr, r.URL.Path)
+		writeAdminError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// services[/<service>[/clients[/disconnect]]|[/backends/<backend>/<action>]]
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "services" {
+		writeAdminError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if len(parts) == 1 {
+		services := adminManager.GetServices()
+		result := make([]adminServiceInfo, 0, len(services))
+		for i := 0; i < len(services); i++ {
+			result = append(result, newAdminServiceInfo(services[i]))
+		}
+		writeAdminResponse(w, http.StatusOK, result)
+		return
+	}
+
+	service := adminManager.GetService(parts[1])
+	if service == nil {
+		writeAdminError(w, http.StatusNotFound, "Service not found")
+		return
+	}
+	if len(parts) == 2 {
+		writeAdminResponse(w, http.StatusOK, newAdminServiceInfo(service))
+		return
+	}
+
+	switch parts[2] {
+	case "clients":
+		handleAdminClientsRequest(w, r, service, parts[3:])
+	case "backends":
+		handleAdminBackendRequest(w, r, service, parts[3:])
+	default:
+		writeAdminError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func InitializeAdmin(config *AdminConfig, manager *ProxyManager) error {
+	if config == nil || !GetOptionalBool(config.Enabled, true) {
+		// admin API is disabled by default
+		return nil
+	}
+
+	adminLogger = CreateLogger("admin")
+	adminManager = manager
+
+	adminToken = config.Token
+	if adminToken == "" && config.TokenFile != "" {
+		content, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			adminLogger.Errorf("Failed to read admin token file: %v", err)
+			return err
+		}
+		adminToken = strings.TrimSpace(string(content))
+	}
+
+	address := config.Address
+	if address == "" {
+		address = "http://127.0.0.1:8081/api/"
+	}
+	u, err := ParseUrl(address, "http")
+	if err != nil {
+		adminLogger.Errorf("%s is not a valid listen address: %v", address, err)
+		return err
+	}
+	adminPrefix = GetUrlDirPath(u)
+
+	mux := &http.ServeMux{}
+	mux.HandleFunc(adminPrefix, handleAdminRequest)
+	adminServer = &http.Server{
+		Addr:    net.JoinHostPort(GetUrlHostname(u), GetUrlPort(u)),
+		Handler: mux,
+	}
+
+	adminLogger.Debug("Listening for admin requests")
+	switch u.Scheme {
+	case "http":
+		if config.Certificate != nil {
+			return helpers.StringError("Certificate is not allowed for http protocol(admin)")
+		}
+		go func() {
+			err := adminServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				adminLogger.Errorf("Admin server stopped: %v", err)
+			}
+		}()
+
+	case "https":
+		if config.Certificate == nil {
+			return helpers.StringError("Certificate is required for https protocol(admin)")
+		}
+
+		go func() {
+			err := adminServer.ListenAndServeTLS(config.Certificate.CertificateFile, config.Certificate.PrivateKeyFile)
+			if err != http.ErrServerClosed {
+				adminLogger.Errorf("Admin server stopped: %v", err)
+			}
+		}()
+
+	default:
+		return helpers.StringError("Invalid admin protocol")
+	}
+
+	return nil
+}
+func StopAdmin() {
+	if adminServer != nil {
+		adminLogger.Verbose(10, "Stopping admin server")
+		adminServer.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+type AuthResult int
+
+const (
+	// AuthAllowed client may connect to a backend
+	AuthAllowed AuthResult = iota
+	// AuthBadCredentials username or password of the client is not valid
+	AuthBadCredentials
+	// AuthNotAuthorized client is known, but it is not allowed to connect, or it has no credential
+	AuthNotAuthorized
+)
+
+func (this AuthResult) String() string {
+	switch this {
+	case AuthAllowed:
+		return "allowed"
+	case AuthBadCredentials:
+		return "bad_credentials"
+	case AuthNotAuthorized:
+		return "not_authorized"
+	default:
+		return fmt.Sprintf("AuthResult(%d)", int(this))
+	}
+}
+
+// ReasonCode reason code of the CONNACK that is sent to a client with this result
+func (this AuthResult) ReasonCode() ReasonCode {
+	switch this {
+	case AuthAllowed:
+		return ReasonSuccess
+	case AuthBadCredentials:
+		return ReasonBadUsernameOrPassword
+	default:
+		return ReasonNotAuthorized
+	}
+}
+
+// AuthRequest information of a client that should be authenticated
+type AuthRequest struct {
+	ServiceName string
+	Frontend    string
+	RemoteAddr  net.Addr
+	Connect     *ConnectPacket
+	// ClientCertificate verified certificate of the client, it is `nil` if client did not present a certificate or
+	// the frontend does not verify certificates
+	ClientCertificate *x509.Certificate
+
+	// Claims authenticators may set claims of the client here, they are kept in the session of the client
+	Claims map[string]interface{}
+}
+
+func (this *AuthRequest) ClientID() string { return this.Connect.ClientID }
+func (this *AuthRequest) Username() string { return this.Connect.Username }
+func (this *AuthRequest) Password() []byte { return this.Connect.Password }
+
+// Authenticator validate credentials of the clients before they are proxied to a backend
+type Authenticator interface {
+	// Authenticate return result of the authentication, error is only returned when authenticator failed to do its
+	// job(for example it could not read its database)
+	Authenticate(request *AuthRequest) (AuthResult, error)
+}
+
+type AuthConfig struct {
+	// Type type of the authenticator, `htpasswd`, `static`, `jwt` or `http`
+	Type string `yaml:"type"`
+	// AllowAnonymous accept clients that have no username and no certificate
+	AllowAnonymous bool `yaml:"allowAnonymous,omitempty"`
+	// CertificateAuth accept clients that have no username, but have a verified certificate whose common name is
+	// one of the users
+	CertificateAuth bool `yaml:"certificateAuth,omitempty"`
+	// File path of the htpasswd file, only bcrypt hashes are supported
+	File string `yaml:"file,omitempty"`
+	// Users list of the users of the `static` authenticator, passwords may be plain text or bcrypt hashes
+	Users map[string]string `yaml:"users,omitempty"`
+
+	// Secret HMAC secret of the `jwt` authenticator
+	Secret string `yaml:"secret,omitempty"`
+	// KeyFile PEM file that contains public keys or certificates of the `jwt` authenticator
+	KeyFile string `yaml:"keyFile,omitempty"`
+	// JwksFile JSON Web Key Set of the `jwt` authenticator
+	JwksFile string `yaml:"jwksFile,omitempty"`
+	// JwksRefreshInterval interval of checking the JWKS file for changes, default is 1m
+	JwksRefreshInterval *time.Duration `yaml:"jwksRefreshInterval,omitempty"`
+	// Algorithms accepted signature algorithms, default is HS256, RS256 and ES256
+	Algorithms []string `yaml:"algorithms,omitempty"`
+	// Audience if it is not empty, `aud` claim of the tokens must contain it
+	Audience string `yaml:"audience,omitempty"`
+	// Issuer if it is not empty, `iss` claim of the tokens must be equal to it
+	Issuer string `yaml:"issuer,omitempty"`
+	// SubjectMatch `username` or `clientId`, `sub` claim of the token must be equal to this field of CONNECT
+	SubjectMatch string `yaml:"subjectMatch,omitempty"`
+	// Leeway accepted clock skew in checking `exp` and `nbf`
+	Leeway *time.Duration `yaml:"leeway,omitempty"`
+
+	// URL address of the auth service of the `http` authenticator, client information is POSTed to it as JSON
+	URL string `yaml:"url,omitempty"`
+	// Headers extra headers of the requests that are sent to the auth service
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Timeout timeout of the requests that are sent to the auth service, default is 5s
+	Timeout *time.Duration `yaml:"timeout,omitempty"`
+	// CacheTTL how long an accepted client is remembered, default is 0 that disable caching
+	CacheTTL *time.Duration `yaml:"cacheTTL,omitempty"`
+	// NegativeCacheTTL how long a rejected client is remembered, default is 0 that disable caching
+	NegativeCacheTTL *time.Duration `yaml:"negativeCacheTTL,omitempty"`
+	// FailOpen accept clients when the auth service is not available, by default they are rejected
+	FailOpen bool `yaml:"failOpen,omitempty"`
+}
+
+type AuthenticatorFactory interface {
+	// CreateAuthenticator create an authenticator from the config, or return `nil` if type of the config is not
+	// supported by this factory
+	CreateAuthenticator(config *AuthConfig) (Authenticator, error)
+}
+
+var (
+	authenticatorFactories = make([]AuthenticatorFactory, 0)
+)
+
+const (
+	AuthTypeNotSupported = helpers.StringError("Authenticator type is not supported")
+)
+
+func RegisterAuthenticatorFactory(factory AuthenticatorFactory) {
+	authenticatorFactories = append(authenticatorFactories, factory)
+}
+
+// CreateAuthenticator create an authenticator from the config, or return `nil` if config is `nil`
+func CreateAuthenticator(config *AuthConfig) (Authenticator, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	for i := 0; i < len(authenticatorFactories); i++ {
+		authenticator, err := authenticatorFactories[i].CreateAuthenticator(config)
+		if err != nil {
+			return nil, err
+		}
+		if authenticator != nil {
+			return authenticator, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", AuthTypeNotSupported, config.Type)
+}
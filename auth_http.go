@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+//region GLOBALS
+func init() {
+	RegisterAuthenticatorFactory(http_AuthenticatorFactory(true))
+}
+
+const (
+	// default timeout of the requests of the http authenticator
+	defaultHttpAuthTimeout = 5 * time.Second
+	// maximum size of the response body that is read from the auth service
+	maxHttpAuthResponseSize = 64 * 1024
+
+	MissingAuthURL          = helpers.StringError("`url` is required for http authenticator")
+	InvalidAuthResponse     = helpers.StringError("Invalid response from the auth service")
+	UnexpectedAuthStatus    = helpers.StringError("Unexpected status code from the auth service")
+	InvalidAuthResultString = helpers.StringError("Invalid auth result")
+)
+
+//endregion
+
+func parseAuthResult(s string) (AuthResult, error) {
+	switch s {
+	case "allowed":
+		return AuthAllowed, nil
+	case "bad_credentials":
+		return AuthBadCredentials, nil
+	case "not_authorized":
+		return AuthNotAuthorized, nil
+	default:
+		return AuthNotAuthorized, fmt.Errorf("%w: %s", InvalidAuthResultString, s)
+	}
+}
+
+// httpAuthRequest body of the request that is sent to the auth service
+type httpAuthRequest struct {
+	Service    string `json:"service"`
+	Frontend   string `json:"frontend"`
+	RemoteAddr string `json:"remoteAddr"`
+	ClientID   string `json:"clientId"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	CommonName string `json:"commonName,omitempty"`
+}
+
+// httpAuthResponse optional body of the response of the auth service
+type httpAuthResponse struct {
+	Result string                 `json:"result"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+//region authCache
+type authCacheEntry struct {
+	Result  AuthResult
+	Claims  map[string]interface{}
+	Expires time.Time
+}
+
+// authCache keep results of an authenticator for a while, expired entries are removed lazily
+type authCache struct {
+	guard     sync.Mutex
+	entries   map[[sha256.Size]byte]authCacheEntry
+	lastPrune time.Time
+}
+
+func newAuthCache() *authCache {
+	return &authCache{
+		entries:   make(map[[sha256.Size]byte]authCacheEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (this *authCache) Get(key [sha256.Size]byte) (authCacheEntry, bool) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok {
+		return entry, false
+	}
+	if time.Now().After(entry.Expires) {
+		delete(this.entries, key)
+		return entry, false
+	}
+	return entry, true
+}
+
+func (this *authCache) Set(key [sha256.Size]byte, entry authCacheEntry, pruneInterval time.Duration) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	now := time.Now()
+	if now.Sub(this.lastPrune) >= pruneInterval {
+		for k, v := range this.entries {
+			if now.After(v.Expires) {
+				delete(this.entries, k)
+			}
+		}
+		this.lastPrune = now
+	}
+	this.entries[key] = entry
+}
+
+//endregion
+
+//region httpAuthenticator
+// httpAuthenticator ask an HTTP service whether a client may connect
+type httpAuthenticator struct {
+	URL              string
+	Headers          map[string]string
+	Timeout          time.Duration
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+	FailOpen         bool
+	Logger           helpers.Logger
+
+	client *http.Client
+	cache  *authCache
+}
+
+// cacheKey hash everything that is sent to the auth service except port of the client, so password of the client
+// is not kept in memory
+func (this *httpAuthenticator) cacheKey(body *httpAuthRequest) [sha256.Size]byte {
+	host, _, err := net.SplitHostPort(body.RemoteAddr)
+	if err != nil {
+		host = body.RemoteAddr
+	}
+	h := sha256.New()
+	for _, s := range []string{body.Service, body.Frontend, host, body.ClientID, body.Username, body.Password,
+		body.CommonName} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// call send the request to the auth service and return its answer
+func (this *httpAuthenticator) call(body *httpAuthRequest) (AuthResult, map[string]interface{}, error) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return AuthNotAuthorized, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.URL, bytes.NewReader(content))
+	if err != nil {
+		return AuthNotAuthorized, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range this.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return AuthNotAuthorized, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHttpAuthResponseSize))
+	if err != nil {
+		return AuthNotAuthorized, nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return AuthBadCredentials, nil, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return AuthNotAuthorized, nil, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// body is optional, an empty body means that the client is allowed
+		if len(bytes.TrimSpace(respBody)) == 0 {
+			return AuthAllowed, nil, nil
+		}
+		var answer httpAuthResponse
+		if err = json.Unmarshal(respBody, &answer); err != nil {
+			return AuthNotAuthorized, nil, fmt.Errorf("%w: %v", InvalidAuthResponse, err)
+		}
+		if answer.Result == "" {
+			return AuthAllowed, answer.Claims, nil
+		}
+		result, err := parseAuthResult(answer.Result)
+		if err != nil {
+			return AuthNotAuthorized, nil, fmt.Errorf("%w: %v", InvalidAuthResponse, err)
+		}
+		return result, answer.Claims, nil
+	default:
+		return AuthNotAuthorized, nil, fmt.Errorf("%w: %d", UnexpectedAuthStatus, resp.StatusCode)
+	}
+}
+
+func (this *httpAuthenticator) Authenticate(request *AuthRequest) (AuthResult, error) {
+	body := &httpAuthRequest{
+		Service:  request.ServiceName,
+		Frontend: request.Frontend,
+		ClientID: request.ClientID(),
+		Username: request.Username(),
+		Password: string(request.Password()),
+	}
+	if request.RemoteAddr != nil {
+		body.RemoteAddr = request.RemoteAddr.String()
+	}
+	if request.ClientCertificate != nil {
+		body.CommonName = request.ClientCertificate.Subject.CommonName
+	}
+
+	var key [sha256.Size]byte
+	if this.cache != nil {
+		key = this.cacheKey(body)
+		if entry, ok := this.cache.Get(key); ok {
+			request.Claims = entry.Claims
+			return entry.Result, nil
+		}
+	}
+
+	result, claims, err := this.call(body)
+	if err != nil {
+		if this.FailOpen {
+			this.Logger.Warnf("Auth service failed, allowing client `%s`: %v", request.ClientID(), err)
+			return AuthAllowed, nil
+		}
+		return AuthNotAuthorized, err
+	}
+
+	if this.cache != nil {
+		ttl := this.CacheTTL
+		if result != AuthAllowed {
+			ttl = this.NegativeCacheTTL
+		}
+		if ttl > 0 {
+			this.cache.Set(key, authCacheEntry{Result: result, Claims: claims, Expires: time.Now().Add(ttl)}, ttl)
+		}
+	}
+	request.Claims = claims
+	return result, nil
+}
+
+//endregion
+
+//region http_AuthenticatorFactory
+type http_AuthenticatorFactory bool
+
+func (this http_AuthenticatorFactory) CreateAuthenticator(config *AuthConfig) (Authenticator, error) {
+	if config.Type != "http" {
+		return nil, nil
+	}
+	if config.URL == "" {
+		return nil, MissingAuthURL
+	}
+
+	result := &httpAuthenticator{
+		URL:      config.URL,
+		Headers:  config.Headers,
+		Timeout:  defaultHttpAuthTimeout,
+		FailOpen: config.FailOpen,
+		Logger:   CreateLogger("auth/http"),
+		client:   &http.Client{},
+	}
+	if config.Timeout != nil {
+		result.Timeout = *config.Timeout
+	}
+	if config.CacheTTL != nil {
+		result.CacheTTL = *config.CacheTTL
+	}
+	if config.NegativeCacheTTL != nil {
+		result.NegativeCacheTTL = *config.NegativeCacheTTL
+	}
+	if result.CacheTTL > 0 || result.NegativeCacheTTL > 0 {
+		result.cache = newAuthCache()
+	}
+	return result, nil
+}
+
+//endregion
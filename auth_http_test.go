@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// authServer is an auth service that answer with `handler` and count its requests
+type authServer struct {
+	*httptest.Server
+	calls   int32
+	handler func(w http.ResponseWriter, body *httpAuthRequest)
+}
+
+func newAuthServer(t *testing.T, handler func(w http.ResponseWriter, body *httpAuthRequest)) *authServer {
+	result := &authServer{handler: handler}
+	result.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&result.calls, 1)
+		var body httpAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid request body: %v", err)
+		}
+		result.handler(w, &body)
+	}))
+	t.Cleanup(result.Close)
+	return result
+}
+
+func (this *authServer) Calls() int { return int(atomic.LoadInt32(&this.calls)) }
+
+func newHttpAuthenticator(t *testing.T, config AuthConfig) *httpAuthenticator {
+	config.Type = "http"
+	auth, err := http_AuthenticatorFactory(true).CreateAuthenticator(&config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	return auth.(*httpAuthenticator)
+}
+
+func newHttpAuthRequest(username, password string) *AuthRequest {
+	return &AuthRequest{
+		ServiceName: "service",
+		Frontend:    "frontend",
+		RemoteAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883},
+		Connect: &ConnectPacket{
+			ClientID:     "client",
+			UsernameFlag: username != "",
+			Username:     username,
+			PasswordFlag: password != "",
+			Password:     []byte(password),
+		},
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration { return &d }
+
+func TestHttpAuthenticatorResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		result  AuthResult
+		claims  map[string]interface{}
+		failure bool
+	}{
+		{name: "empty 200", status: http.StatusOK, result: AuthAllowed},
+		{name: "empty 204", status: http.StatusNoContent, result: AuthAllowed},
+		{name: "401", status: http.StatusUnauthorized, result: AuthBadCredentials},
+		{name: "403", status: http.StatusForbidden, result: AuthNotAuthorized},
+		{name: "500", status: http.StatusInternalServerError, result: AuthNotAuthorized, failure: true},
+		{name: "allowed body", status: http.StatusOK, body: `{"result":"allowed","claims":{"role":"admin"}}`,
+			result: AuthAllowed, claims: map[string]interface{}{"role": "admin"}},
+		{name: "body without result", status: http.StatusOK, body: `{"claims":{"role":"user"}}`,
+			result: AuthAllowed, claims: map[string]interface{}{"role": "user"}},
+		{name: "bad credentials body", status: http.StatusOK, body: `{"result":"bad_credentials"}`,
+			result: AuthBadCredentials},
+		{name: "not authorized body", status: http.StatusOK, body: `{"result":"not_authorized"}`,
+			result: AuthNotAuthorized},
+		{name: "unknown result", status: http.StatusOK, body: `{"result":"maybe"}`, result: AuthNotAuthorized,
+			failure: true},
+		{name: "invalid json", status: http.StatusOK, body: `allowed`, result: AuthNotAuthorized, failure: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newAuthServer(t, func(w http.ResponseWriter, body *httpAuthRequest) {
+				if body.Username != "user" || body.Password != "pass" || body.ClientID != "client" ||
+					body.Service != "service" || body.Frontend != "frontend" || body.RemoteAddr != "127.0.0.1:1883" {
+					t.Errorf("Unexpected request: %+v", body)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			})
+			auth := newHttpAuthenticator(t, AuthConfig{URL: server.URL})
+
+			request := newHttpAuthRequest("user", "pass")
+			result, err := auth.Authenticate(request)
+			if result != test.result {
+				t.Errorf("Expected `%v`, got `%v`", test.result, result)
+			}
+			if test.failure != (err != nil) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if len(request.Claims) != len(test.claims) {
+				t.Errorf("Expected claims %v, got %v", test.claims, request.Claims)
+			}
+			for name, value := range test.claims {
+				if request.Claims[name] != value {
+					t.Errorf("Expected claim `%s` to be %v, got %v", name, value, request.Claims[name])
+				}
+			}
+		})
+	}
+}
+
+func TestHttpAuthenticatorHeaders(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Api-Key")
+	}))
+	defer server.Close()
+
+	auth := newHttpAuthenticator(t, AuthConfig{URL: server.URL, Headers: map[string]string{"X-Api-Key": "key"}})
+	if result, err := auth.Authenticate(newHttpAuthRequest("user", "pass")); result != AuthAllowed || err != nil {
+		t.Fatalf("Expected client to be allowed, got `%v`: %v", result, err)
+	}
+	if header != "key" {
+		t.Errorf("Expected `X-Api-Key` header to be sent, got `%s`", header)
+	}
+}
+
+func TestHttpAuthenticatorCache(t *testing.T) {
+	server := newAuthServer(t, func(w http.ResponseWriter, body *httpAuthRequest) {
+		if body.Password != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	tests := []struct {
+		name             string
+		cacheTTL         time.Duration
+		negativeCacheTTL time.Duration
+		password         string
+		result           AuthResult
+		// calls number of calls of the auth service for 2 requests, then for a request after expiry of the cache
+		calls [2]int
+	}{
+		{name: "no cache", password: "good", result: AuthAllowed, calls: [2]int{2, 3}},
+		{name: "positive", cacheTTL: 100 * time.Millisecond, password: "good", result: AuthAllowed,
+			calls: [2]int{1, 2}},
+		{name: "positive ignore rejects", cacheTTL: time.Minute, password: "bad", result: AuthBadCredentials,
+			calls: [2]int{2, 3}},
+		{name: "negative", negativeCacheTTL: 100 * time.Millisecond, password: "bad", result: AuthBadCredentials,
+			calls: [2]int{1, 2}},
+		{name: "negative ignore accepts", negativeCacheTTL: time.Minute, password: "good", result: AuthAllowed,
+			calls: [2]int{2, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&server.calls, 0)
+			config := AuthConfig{URL: server.URL}
+			if test.cacheTTL != 0 {
+				config.CacheTTL = durationPtr(test.cacheTTL)
+			}
+			if test.negativeCacheTTL != 0 {
+				config.NegativeCacheTTL = durationPtr(test.negativeCacheTTL)
+			}
+			auth := newHttpAuthenticator(t, config)
+
+			authenticate := func() {
+				if result, err := auth.Authenticate(newHttpAuthRequest("user", test.password)); result != test.result ||
+					err != nil {
+					t.Fatalf("Expected `%v`, got `%v`: %v", test.result, result, err)
+				}
+			}
+			authenticate()
+			authenticate()
+			if server.Calls() != test.calls[0] {
+				t.Errorf("Expected %d calls of the auth service, got %d", test.calls[0], server.Calls())
+			}
+
+			time.Sleep(150 * time.Millisecond)
+			authenticate()
+			if server.Calls() != test.calls[1] {
+				t.Errorf("Expected %d calls after expiry, got %d", test.calls[1], server.Calls())
+			}
+		})
+	}
+}
+
+func TestHttpAuthenticatorCacheKey(t *testing.T) {
+	server := newAuthServer(t, func(w http.ResponseWriter, body *httpAuthRequest) {
+		if body.Password != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	auth := newHttpAuthenticator(t, AuthConfig{URL: server.URL, CacheTTL: durationPtr(time.Minute)})
+
+	if result, _ := auth.Authenticate(newHttpAuthRequest("user", "good")); result != AuthAllowed {
+		t.Fatalf("Expected client to be allowed, got `%v`", result)
+	}
+	// accepted password must not be reused for another password
+	if result, _ := auth.Authenticate(newHttpAuthRequest("user", "bad")); result != AuthBadCredentials {
+		t.Errorf("Expected a different password to be rejected, got `%v`", result)
+	}
+	// port of the client is not part of the key
+	request := newHttpAuthRequest("user", "good")
+	request.RemoteAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2883}
+	if result, _ := auth.Authenticate(request); result != AuthAllowed {
+		t.Errorf("Expected client to be allowed, got `%v`", result)
+	}
+	if server.Calls() != 2 {
+		t.Errorf("Expected 2 calls of the auth service, got %d", server.Calls())
+	}
+}
+
+func TestHttpAuthenticatorFailures(t *testing.T) {
+	slow := newAuthServer(t, func(w http.ResponseWriter, body *httpAuthRequest) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	failing := newAuthServer(t, func(w http.ResponseWriter, body *httpAuthRequest) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	// nothing listens on address of a closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		failOpen bool
+		result   AuthResult
+	}{
+		{name: "timeout", url: slow.URL, result: AuthNotAuthorized},
+		{name: "timeout fail open", url: slow.URL, failOpen: true, result: AuthAllowed},
+		{name: "bad status", url: failing.URL, result: AuthNotAuthorized},
+		{name: "bad status fail open", url: failing.URL, failOpen: true, result: AuthAllowed},
+		{name: "unreachable", url: closed.URL, result: AuthNotAuthorized},
+		{name: "unreachable fail open", url: closed.URL, failOpen: true, result: AuthAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := newHttpAuthenticator(t, AuthConfig{
+				URL:      test.url,
+				Timeout:  durationPtr(50 * time.Millisecond),
+				FailOpen: test.failOpen,
+			})
+
+			start := time.Now()
+			result, err := auth.Authenticate(newHttpAuthRequest("user", "pass"))
+			if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+				t.Errorf("Authenticate did not respect the timeout, it took %v", elapsed)
+			}
+			if result != test.result {
+				t.Errorf("Expected `%v`, got `%v`", test.result, result)
+			}
+			// failures are only reported when the client is rejected
+			if test.failOpen != (err == nil) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHttpAuthenticatorConfig(t *testing.T) {
+	if auth, err := http_AuthenticatorFactory(true).CreateAuthenticator(&AuthConfig{Type: "jwt"}); auth != nil ||
+		err != nil {
+		t.Errorf("Expected other types to be ignored, got %v: %v", auth, err)
+	}
+	if _, err := http_AuthenticatorFactory(true).CreateAuthenticator(&AuthConfig{Type: "http"}); !errors.Is(err,
+		MissingAuthURL) {
+		t.Errorf("Expected `%v`, got %v", MissingAuthURL, err)
+	}
+
+	auth := newHttpAuthenticator(t, AuthConfig{URL: "http://127.0.0.1"})
+	if auth.Timeout != defaultHttpAuthTimeout || auth.cache != nil {
+		t.Errorf("Unexpected defaults: timeout %v, cache %v", auth.Timeout, auth.cache)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+//region GLOBALS
+func init() {
+	RegisterAuthenticatorFactory(jwt_AuthenticatorFactory(true))
+}
+
+const (
+	// default interval of checking the JWKS file for changes
+	defaultJwksRefreshInterval = time.Minute
+
+	SubjectMatchUsername = "username"
+	SubjectMatchClientID = "clientId"
+
+	InvalidToken         = helpers.StringError("Token is not a valid JWT")
+	UnsupportedAlgorithm = helpers.StringError("Token algorithm is not allowed")
+	InvalidSignature     = helpers.StringError("Token signature is not valid")
+	TokenExpired         = helpers.StringError("Token is expired")
+	TokenNotValidYet     = helpers.StringError("Token is not valid yet")
+	InvalidTokenAudience = helpers.StringError("Token audience is not valid")
+	InvalidTokenIssuer   = helpers.StringError("Token issuer is not valid")
+	MissingJwtKey        = helpers.StringError("JWT authenticator needs `secret`, `keyFile` or `jwksFile`")
+	InvalidSubjectMatch  = helpers.StringError("`subjectMatch` must be `username` or `clientId`")
+	NoKeyForToken        = helpers.StringError("There is no key for the token")
+)
+
+var defaultJwtAlgorithms = []string{"HS256", "RS256", "ES256"}
+
+//endregion
+
+// jwtKey is a key that may verify tokens, `Key` is a `[]byte` for HS256, a `*rsa.PublicKey` for RS256 or
+// a `*ecdsa.PublicKey` for ES256
+type jwtKey struct {
+	ID  string
+	Key interface{}
+}
+
+// algorithm return the only algorithm that this key may verify, so a public key is never used as a HMAC secret
+func (this jwtKey) algorithm() string {
+	switch key := this.Key.(type) {
+	case []byte:
+		return "HS256"
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return "ES256"
+		}
+	}
+	return ""
+}
+
+func (this jwtKey) verify(signingInput, signature []byte) bool {
+	hash := sha256.Sum256(signingInput)
+	switch key := this.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signingInput)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+	default:
+		return false
+	}
+}
+
+//region key files
+// parsePemKeys parse public keys and certificates of a PEM file
+func parsePemKeys(content []byte) (interface{}, error) {
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported PEM block: %s", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwtKey{Key: key})
+	}
+	if len(keys) == 0 {
+		return nil, helpers.StringError("File does not contain any key")
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (this *jsonWebKey) publicKey() (interface{}, error) {
+	switch this.Kty {
+	case "RSA":
+		n, err := decodeBigInt(this.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(this.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if this.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve: %s", this.Crv)
+		}
+		x, err := decodeBigInt(this.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(this.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(this.K)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", this.Kty)
+	}
+}
+
+// parseJwks parse a JSON Web Key Set, keys that are not used for signatures are ignored
+func parseJwks(content []byte) (interface{}, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make([]jwtKey, 0, len(jwks.Keys))
+	for i := 0; i < len(jwks.Keys); i++ {
+		if jwks.Keys[i].Use != "" && jwks.Keys[i].Use != "sig" {
+			continue
+		}
+		key, err := jwks.Keys[i].publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key(kid: %s): %w", jwks.Keys[i].Kid, err)
+		}
+		keys = append(keys, jwtKey{ID: jwks.Keys[i].Kid, Key: key})
+	}
+	return keys, nil
+}
+
+//endregion
+
+//region jwtAuthenticator
+// jwtAuthenticator accept clients that send a valid JWT as their password
+type jwtAuthenticator struct {
+	AllowAnonymous bool
+	Algorithms     map[string]bool
+	Audience       string
+	Issuer         string
+	SubjectMatch   string
+	Leeway         time.Duration
+	Logger         helpers.Logger
+
+	secret   []byte
+	keyFile  *watchedFile
+	jwksFile *watchedFile
+}
+
+func (this *jwtAuthenticator) getKeys() []jwtKey {
+	var keys []jwtKey
+	if this.secret != nil {
+		keys = append(keys, jwtKey{Key: this.secret})
+	}
+	if this.keyFile != nil {
+		keys = append(keys, this.keyFile.Get().([]jwtKey)...)
+	}
+	if this.jwksFile != nil {
+		keys = append(keys, this.jwksFile.Get().([]jwtKey)...)
+	}
+	return keys
+}
+
+// hasAudience check `aud` claim, that may be a string or a list of strings
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for i := 0; i < len(aud); i++ {
+			if s, ok := aud[i].(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateToken verify signature and standard claims of the token and return its claims
+func (this *jwtAuthenticator) validateToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJson, &header) != nil {
+		return nil, InvalidToken
+	}
+	if !this.Algorithms[header.Alg] {
+		return nil, fmt.Errorf("%w: %s", UnsupportedAlgorithm, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, InvalidToken
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	keys := this.getKeys()
+	verified, found := false, false
+	for i := 0; i < len(keys) && !verified; i++ {
+		if keys[i].algorithm() != header.Alg || (header.Kid != "" && keys[i].ID != "" && keys[i].ID != header.Kid) {
+			continue
+		}
+		found = true
+		verified = keys[i].verify(signingInput, signature)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w(alg: %s, kid: %s)", NoKeyForToken, header.Alg, header.Kid)
+	}
+	if !verified {
+		return nil, InvalidSignature
+	}
+
+	var claims map[string]interface{}
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsJson, &claims) != nil {
+		return nil, InvalidToken
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(this.Leeway)) {
+		return nil, TokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(this.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, TokenNotValidYet
+	}
+	if this.Audience != "" && !hasAudience(claims, this.Audience) {
+		return nil, InvalidTokenAudience
+	}
+	if this.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != this.Issuer {
+			return nil, InvalidTokenIssuer
+		}
+	}
+	return claims, nil
+}
+
+func (this *jwtAuthenticator) Authenticate(request *AuthRequest) (AuthResult, error) {
+	if !request.Connect.PasswordFlag {
+		if this.AllowAnonymous && !request.Connect.UsernameFlag {
+			return AuthAllowed, nil
+		}
+		return AuthNotAuthorized, nil
+	}
+
+	claims, err := this.validateToken(string(request.Password()))
+	if err != nil {
+		this.Logger.Debugf("Rejected token of client `%s`: %v", request.ClientID(), err)
+		return AuthBadCredentials, nil
+	}
+
+	subject, _ := claims["sub"].(string)
+	switch this.SubjectMatch {
+	case SubjectMatchUsername:
+		if subject != request.Username() {
+			this.Logger.Debugf("Subject of the token(%s) is not the username(%s)", subject, request.Username())
+			return AuthNotAuthorized, nil
+		}
+	case SubjectMatchClientID:
+		if subject != request.ClientID() {
+			this.Logger.Debugf("Subject of the token(%s) is not the client ID(%s)", subject, request.ClientID())
+			return AuthNotAuthorized, nil
+		}
+	}
+
+	request.Claims = claims
+	return AuthAllowed, nil
+}
+
+//endregion
+
+//region jwt_AuthenticatorFactory
+type jwt_AuthenticatorFactory bool
+
+func (this jwt_AuthenticatorFactory) CreateAuthenticator(config *AuthConfig) (Authenticator, error) {
+	if config.Type != "jwt" {
+		return nil, nil
+	}
+
+	logger := CreateLogger("auth/jwt")
+	result := &jwtAuthenticator{
+		AllowAnonymous: config.AllowAnonymous,
+		Algorithms:     make(map[string]bool),
+		Audience:       config.Audience,
+		Issuer:         config.Issuer,
+		SubjectMatch:   config.SubjectMatch,
+		Logger:         logger,
+	}
+	if config.Leeway != nil {
+		result.Leeway = *config.Leeway
+	}
+
+	algorithms := config.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = defaultJwtAlgorithms
+	}
+	for i := 0; i < len(algorithms); i++ {
+		switch algorithms[i] {
+		case "HS256", "RS256", "ES256":
+			result.Algorithms[algorithms[i]] = true
+		default:
+			return nil, fmt.Errorf("%w: %s", UnsupportedAlgorithm, algorithms[i])
+		}
+	}
+
+	switch config.SubjectMatch {
+	case "", SubjectMatchUsername, SubjectMatchClientID:
+	default:
+		return nil, InvalidSubjectMatch
+	}
+
+	if config.Secret != "" {
+		result.secret = []byte(config.Secret)
+	}
+	var err error
+	if config.KeyFile != "" {
+		result.keyFile, err = newWatchedFile(config.KeyFile, logger, parsePemKeys)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load JWT key file: %w", err)
+		}
+	}
+	if config.JwksFile != "" {
+		result.jwksFile, err = newWatchedFile(config.JwksFile, logger, parseJwks)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load JWKS file: %w", err)
+		}
+		result.jwksFile.CheckInterval = defaultJwksRefreshInterval
+		if config.JwksRefreshInterval != nil {
+			result.jwksFile.CheckInterval = *config.JwksRefreshInterval
+		}
+	}
+	if result.secret == nil && result.keyFile == nil && result.jwksFile == nil {
+		return nil, MissingJwtKey
+	}
+	return result, nil
+}
+
+//endregion
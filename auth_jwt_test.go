@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// jwtKeys keys that sign the tokens of the tests, `rsa` is in the PEM file and the others are in the JWKS file
+type jwtKeys struct {
+	secret   []byte
+	rsa      *rsa.PrivateKey
+	jwksRSA  *rsa.PrivateKey
+	jwksEC   *ecdsa.PrivateKey
+	otherEC  *ecdsa.PrivateKey
+	keyFile  string
+	jwksFile string
+}
+
+func base64Int(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+
+func newJwtKeys(t *testing.T) *jwtKeys {
+	var err error
+	result := &jwtKeys{secret: []byte("secret")}
+	if result.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	if result.jwksRSA, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	if result.jwksEC, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	if result.otherEC, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+
+	dir := t.TempDir()
+	der, err := x509.MarshalPKIXPublicKey(&result.rsa.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal RSA key: %v", err)
+	}
+	result.keyFile = filepath.Join(dir, "keys.pem")
+	if err = ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": base64Int(result.jwksRSA.N),
+			"e": base64Int(big.NewInt(int64(result.jwksRSA.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": base64Int(result.jwksEC.X), "y": base64Int(result.jwksEC.Y)},
+		{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": base64Int(result.otherEC.X),
+			"y": base64Int(result.otherEC.Y)},
+	}})
+	result.jwksFile = filepath.Join(dir, "jwks.json")
+	if err = ioutil.WriteFile(result.jwksFile, jwks, 0600); err != nil {
+		t.Fatalf("Failed to write JWKS file: %v", err)
+	}
+	return result
+}
+
+// signJwt create a token with the header and claims, `key` is a `[]byte` for HS256, a `*rsa.PrivateKey` for
+// RS256 or a `*ecdsa.PrivateKey` for ES256. Any other key create a token without signature
+func signJwt(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	encode := func(value map[string]interface{}) string {
+		b, _ := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingInput := encode(header) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:]); err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newJwtAuthenticator(t *testing.T, config AuthConfig) *jwtAuthenticator {
+	config.Type = "jwt"
+	auth, err := jwt_AuthenticatorFactory(true).CreateAuthenticator(&config)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	return auth.(*jwtAuthenticator)
+}
+
+func TestJwtValidateToken(t *testing.T) {
+	keys := newJwtKeys(t)
+	auth := newJwtAuthenticator(t, AuthConfig{
+		Secret:   string(keys.secret),
+		KeyFile:  keys.keyFile,
+		JwksFile: keys.jwksFile,
+		Audience: "mqtt",
+		Issuer:   "issuer",
+		Leeway:   durationPtr(30 * time.Second),
+	})
+	rsaOnly := newJwtAuthenticator(t, AuthConfig{KeyFile: keys.keyFile})
+	publicPem, _ := ioutil.ReadFile(keys.keyFile)
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		// claims are merged with valid claims, a `nil` value remove the claim
+		claims  map[string]interface{}
+		key     interface{}
+		rsaOnly bool
+		err     error
+	}{
+		{name: "HS256", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret},
+		{name: "RS256", header: map[string]interface{}{"alg": "RS256"}, key: keys.rsa},
+		{name: "ES256", header: map[string]interface{}{"alg": "ES256", "kid": "ec"}, key: keys.jwksEC},
+		{name: "wrong secret", header: map[string]interface{}{"alg": "HS256"}, key: []byte("guess"),
+			err: InvalidSignature},
+		{name: "public key as HMAC secret", header: map[string]interface{}{"alg": "HS256"}, key: publicPem,
+			rsaOnly: true, err: NoKeyForToken},
+		{name: "alg none", header: map[string]interface{}{"alg": "none"}, err: UnsupportedAlgorithm},
+		{name: "kid of JWKS key", header: map[string]interface{}{"alg": "RS256", "kid": "rsa"}, key: keys.jwksRSA},
+		{name: "kid of another key", header: map[string]interface{}{"alg": "ES256", "kid": "ec"}, key: keys.otherEC,
+			err: InvalidSignature},
+		{name: "unknown kid", header: map[string]interface{}{"alg": "ES256", "kid": "missing"}, key: keys.jwksEC,
+			err: NoKeyForToken},
+		{name: "encryption key", header: map[string]interface{}{"alg": "ES256", "kid": "enc"}, key: keys.otherEC,
+			err: NoKeyForToken},
+		{name: "expired in leeway", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"exp": now - 10}},
+		{name: "expired", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"exp": now - 60}, err: TokenExpired},
+		{name: "missing exp", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"exp": nil}, err: TokenExpired},
+		{name: "not before in leeway", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"nbf": now + 10}},
+		{name: "not valid yet", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"nbf": now + 60}, err: TokenNotValidYet},
+		{name: "audience list", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"aud": []string{"web", "mqtt"}}},
+		{name: "wrong audience", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"aud": []string{"web"}}, err: InvalidTokenAudience},
+		{name: "missing audience", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"aud": nil}, err: InvalidTokenAudience},
+		{name: "wrong issuer", header: map[string]interface{}{"alg": "HS256"}, key: keys.secret,
+			claims: map[string]interface{}{"iss": "other"}, err: InvalidTokenIssuer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := map[string]interface{}{"sub": "user", "aud": "mqtt", "iss": "issuer", "exp": now + 3600}
+			for name, value := range test.claims {
+				if value == nil {
+					delete(claims, name)
+				} else {
+					claims[name] = value
+				}
+			}
+			authenticator := auth
+			if test.rsaOnly {
+				authenticator = rsaOnly
+			}
+
+			_, err := authenticator.validateToken(signJwt(t, test.header, claims, test.key))
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Errorf("Expected error `%v`, got `%v`", test.err, err)
+			}
+		})
+	}
+
+	if _, err := auth.validateToken("not.a-token"); !errors.Is(err, InvalidToken) {
+		t.Errorf("Expected malformed token to be invalid, got `%v`", err)
+	}
+}
+
+func TestJwtAuthenticate(t *testing.T) {
+	secret := []byte("secret")
+	token := signJwt(t, map[string]interface{}{"alg": "HS256"},
+		map[string]interface{}{"sub": "user", "role": "admin", "exp": time.Now().Unix() + 3600}, secret)
+
+	tests := []struct {
+		name           string
+		subjectMatch   string
+		allowAnonymous bool
+		username       string
+		password       string
+		result         AuthResult
+	}{
+		{name: "any subject", username: "other", password: token, result: AuthAllowed},
+		{name: "subject is username", subjectMatch: SubjectMatchUsername, username: "user", password: token,
+			result: AuthAllowed},
+		{name: "subject is not username", subjectMatch: SubjectMatchUsername, username: "other", password: token,
+			result: AuthNotAuthorized},
+		// client ID of the request is `client`
+		{name: "subject is not client ID", subjectMatch: SubjectMatchClientID, username: "user", password: token,
+			result: AuthNotAuthorized},
+		{name: "invalid token", username: "user", password: token + "x", result: AuthBadCredentials},
+		{name: "anonymous", allowAnonymous: true, result: AuthAllowed},
+		{name: "anonymous not allowed", result: AuthNotAuthorized},
+		{name: "username without token", allowAnonymous: true, username: "user", result: AuthNotAuthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := newJwtAuthenticator(t, AuthConfig{Secret: string(secret), SubjectMatch: test.subjectMatch,
+				AllowAnonymous: test.allowAnonymous})
+			request := newHttpAuthRequest(test.username, test.password)
+			result, err := auth.Authenticate(request)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != test.result {
+				t.Errorf("Expected `%v`, got `%v`", test.result, result)
+			}
+			if result == AuthAllowed && test.password != "" && request.Claims["role"] != "admin" {
+				t.Errorf("Expected claims of the token, got %v", request.Claims)
+			}
+		})
+	}
+
+	clientToken := signJwt(t, map[string]interface{}{"alg": "HS256"},
+		map[string]interface{}{"sub": "client", "exp": time.Now().Unix() + 3600}, secret)
+	auth := newJwtAuthenticator(t, AuthConfig{Secret: string(secret), SubjectMatch: SubjectMatchClientID})
+	if result, _ := auth.Authenticate(newHttpAuthRequest("user", clientToken)); result != AuthAllowed {
+		t.Errorf("Expected token of the client ID to be allowed, got `%v`", result)
+	}
+}
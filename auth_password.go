@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//region GLOBALS
+func init() {
+	RegisterAuthenticatorFactory(password_AuthenticatorFactory(true))
+}
+
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+//endregion
+
+func isBcryptHash(hash string) bool { return strings.HasPrefix(hash, "$2") }
+
+// checkPassword compare a password with a bcrypt hash or a plain text password
+func checkPassword(hash string, password []byte) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), password) == 1
+}
+
+// rejectUnknownUser spend the same time as checking a bcrypt hash, so unknown users can not be detected by timing
+func rejectUnknownUser(password []byte) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("mqproxy"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyPasswordHash, password)
+}
+
+// parseHtpasswd parse content of a htpasswd file, only bcrypt hashes are supported
+func parseHtpasswd(content []byte) (interface{}, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid htpasswd line %d", lineNumber)
+		}
+		if !isBcryptHash(parts[1]) {
+			return nil, fmt.Errorf("Password of `%s` is not a bcrypt hash(line %d)", parts[0], lineNumber)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, scanner.Err()
+}
+
+//region passwordAuthenticator
+// passwordAuthenticator check username and password of the clients against a list of users
+type passwordAuthenticator struct {
+	AllowAnonymous  bool
+	CertificateAuth bool
+	GetUsers        func() map[string]string
+}
+
+func (this *passwordAuthenticator) Authenticate(request *AuthRequest) (AuthResult, error) {
+	users := this.GetUsers()
+	if !request.Connect.UsernameFlag {
+		if this.CertificateAuth && request.ClientCertificate != nil {
+			if _, ok := users[request.ClientCertificate.Subject.CommonName]; ok {
+				return AuthAllowed, nil
+			}
+			return AuthNotAuthorized, nil
+		}
+		if this.AllowAnonymous {
+			return AuthAllowed, nil
+		}
+		return AuthNotAuthorized, nil
+	}
+
+	hash, ok := users[request.Username()]
+	if !ok {
+		rejectUnknownUser(request.Password())
+		return AuthBadCredentials, nil
+	}
+	if !request.Connect.PasswordFlag || !checkPassword(hash, request.Password()) {
+		return AuthBadCredentials, nil
+	}
+	return AuthAllowed, nil
+}
+
+//endregion
+
+//region password_AuthenticatorFactory
+type password_AuthenticatorFactory bool
+
+func (this password_AuthenticatorFactory) CreateAuthenticator(config *AuthConfig) (Authenticator, error) {
+	result := &passwordAuthenticator{
+		AllowAnonymous:  config.AllowAnonymous,
+		CertificateAuth: config.CertificateAuth,
+	}
+
+	switch config.Type {
+	case "static":
+		users := config.Users
+		result.GetUsers = func() map[string]string { return users }
+
+	case "htpasswd":
+		if config.File == "" {
+			return nil, fmt.Errorf("`file` is required for htpasswd authenticator")
+		}
+		file, err := newWatchedFile(config.File, CreateLogger("auth/htpasswd"), parseHtpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load htpasswd file: %w", err)
+		}
+		result.GetUsers = func() map[string]string { return file.Get().(map[string]string) }
+
+	default:
+		return nil, nil
+	}
+	return result, nil
+}
+
+//endregion
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func mustBcrypt(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	return string(hash)
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	hash := mustBcrypt(t, "pass")
+	tests := []struct {
+		name    string
+		content string
+		users   map[string]string
+		failure bool
+	}{
+		{name: "bcrypt", content: "# users\n\nuser:" + hash + "\n  admin:" + hash + "  \n",
+			users: map[string]string{"user": hash, "admin": hash}},
+		{name: "empty", content: "", users: map[string]string{}},
+		{name: "sha", content: "user:{SHA}nU4eI71bcnBGqeO0t9tXvY1u5oQ=", failure: true},
+		{name: "apr1", content: "user:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", failure: true},
+		{name: "plain text", content: "user:pass", failure: true},
+		{name: "missing colon", content: "user", failure: true},
+		{name: "missing username", content: ":" + hash, failure: true},
+		{name: "malformed line after valid ones", content: "user:" + hash + "\nadmin", failure: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := parseHtpasswd([]byte(test.content))
+			if test.failure {
+				if err == nil {
+					t.Errorf("Expected content to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			users := result.(map[string]string)
+			if len(users) != len(test.users) {
+				t.Fatalf("Expected users %v, got %v", test.users, users)
+			}
+			for name, hash := range test.users {
+				if users[name] != hash {
+					t.Errorf("Expected hash of `%s` to be `%s`, got `%s`", name, hash, users[name])
+				}
+			}
+		})
+	}
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	users := map[string]string{"plain": "pass", "hashed": mustBcrypt(t, "secret"), "device": "x"}
+	tests := []struct {
+		name            string
+		allowAnonymous  bool
+		certificateAuth bool
+		username        string
+		password        string
+		commonName      string
+		result          AuthResult
+	}{
+		{name: "plain password", username: "plain", password: "pass", result: AuthAllowed},
+		{name: "wrong plain password", username: "plain", password: "pas", result: AuthBadCredentials},
+		{name: "bcrypt password", username: "hashed", password: "secret", result: AuthAllowed},
+		{name: "wrong bcrypt password", username: "hashed", password: "pass", result: AuthBadCredentials},
+		{name: "missing password", username: "plain", result: AuthBadCredentials},
+		{name: "unknown user", username: "other", password: "pass", result: AuthBadCredentials},
+		{name: "anonymous", result: AuthNotAuthorized},
+		{name: "allowed anonymous", allowAnonymous: true, result: AuthAllowed},
+		{name: "certificate of a user", certificateAuth: true, commonName: "device", result: AuthAllowed},
+		{name: "certificate of an unknown user", certificateAuth: true, allowAnonymous: true, commonName: "other",
+			result: AuthNotAuthorized},
+		{name: "certificate without certificate auth", commonName: "device", result: AuthNotAuthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth, err := password_AuthenticatorFactory(true).CreateAuthenticator(&AuthConfig{
+				Type:            "static",
+				Users:           users,
+				AllowAnonymous:  test.allowAnonymous,
+				CertificateAuth: test.certificateAuth,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create authenticator: %v", err)
+			}
+			request := newHttpAuthRequest(test.username, test.password)
+			if test.commonName != "" {
+				request.ClientCertificate = &x509.Certificate{Subject: pkix.Name{CommonName: test.commonName}}
+			}
+			if result, err := auth.Authenticate(request); result != test.result || err != nil {
+				t.Errorf("Expected `%v`, got `%v`: %v", test.result, result, err)
+			}
+		})
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write htpasswd file: %v", err)
+		}
+		// modification time of the file must change, even if it is written in the same tick of the clock
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(path, modTime, modTime)
+	}
+	write("user:" + mustBcrypt(t, "old") + "\n")
+
+	if _, err := password_AuthenticatorFactory(true).CreateAuthenticator(&AuthConfig{Type: "htpasswd"}); err == nil {
+		t.Error("Expected htpasswd authenticator without file to be rejected")
+	}
+	if _, err := password_AuthenticatorFactory(true).CreateAuthenticator(&AuthConfig{Type: "htpasswd",
+		File: path}); err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	// factory check the file at most once per second, so the test use a file that is checked on every use
+	file, err := newWatchedFile(path, CreateLogger("test"), parseHtpasswd)
+	if err != nil {
+		t.Fatalf("Failed to load htpasswd file: %v", err)
+	}
+	file.CheckInterval = 0
+	auth := &passwordAuthenticator{GetUsers: func() map[string]string { return file.Get().(map[string]string) }}
+
+	authenticate := func(password string) AuthResult {
+		result, _ := auth.Authenticate(newHttpAuthRequest("user", password))
+		return result
+	}
+	if authenticate("old") != AuthAllowed {
+		t.Fatal("Expected old password to be allowed")
+	}
+
+	write("user:" + mustBcrypt(t, "new") + "\n")
+	if authenticate("new") != AuthAllowed || authenticate("old") != AuthBadCredentials {
+		t.Fatal("Expected only the new password to be allowed after reload")
+	}
+
+	// invalid content is ignored and previous users are kept
+	write("user:new\n")
+	if authenticate("new") != AuthAllowed {
+		t.Error("Expected previous users to be kept when the file is not valid")
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"time"
 )
 
@@ -10,62 +13,104 @@ const (
 	PossiblyAvailable AvailabilityStatus = iota
 	UnknownAvailablityStatus
 	NotAvailable
+	// HalfOpen backend was not available, but its back-off is passed and we are probing it
+	HalfOpen
 )
 
+func (this AvailabilityStatus) String() string {
+	switch this {
+	case PossiblyAvailable:
+		return "available"
+	case UnknownAvailablityStatus:
+		return "unknown"
+	case NotAvailable:
+		return "unavailable"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("AvailabilityStatus(%d)", int(this))
+	}
+}
+
+// AvailabilityCounter is an immutable snapshot of what we know about availability of a backend. Each event create a
+// new snapshot, so it can be replaced atomically.
 type AvailabilityCounter struct {
 	Counter int
 	NextTry time.Time
 	Status  AvailabilityStatus
+	// Backoff last back-off that is used for opening the circuit
+	Backoff time.Duration
 }
 
 var unknownAvailablityCounter = &AvailabilityCounter{Status: UnknownAvailablityStatus}
 
 func NewAvailabilityCounter() *AvailabilityCounter { return unknownAvailablityCounter }
 
-func (this *AvailabilityCounter) IsAvailableToTry() bool {
-	switch this.Status {
-	case PossiblyAvailable, UnknownAvailablityStatus:
+// AvailabilityPolicy decide how passive connection results change availability of a backend
+type AvailabilityPolicy interface {
+	// IsAvailableToTry return `true` if a new connection may be sent to the backend, `pendingAttempts` is number of
+	// connection attempts to the backend that have not finished yet
+	IsAvailableToTry(counter *AvailabilityCounter, pendingAttempts int) bool
+	// ShouldProbe return a half-open counter, if back-off of the counter is passed. Otherwise it returns `nil`
+	ShouldProbe(counter *AvailabilityCounter) *AvailabilityCounter
+	OnConnectionSucceeded(counter *AvailabilityCounter) *AvailabilityCounter
+	OnConnectionFailed(counter *AvailabilityCounter) *AvailabilityCounter
+}
+
+//region defaultAvailabilityPolicy
+// defaultAvailabilityPolicy is the original behavior of mqproxy, each failure or success move a counter and
+// failures are retried after 100ms, 1s, 5s or 10s depending on the counter.
+type defaultAvailabilityPolicy bool
+
+func (this defaultAvailabilityPolicy) IsAvailableToTry(counter *AvailabilityCounter, pendingAttempts int) bool {
+	switch counter.Status {
+	case PossiblyAvailable, UnknownAvailablityStatus, HalfOpen:
 		return true
 	default:
-		return time.Now().Before(this.NextTry)
+		// failed backends are only retried after their back-off
+		return !time.Now().Before(counter.NextTry)
 	}
 }
-func (this *AvailabilityCounter) OnConnectionSucceeded() *AvailabilityCounter {
-	switch this.Status {
+func (this defaultAvailabilityPolicy) ShouldProbe(counter *AvailabilityCounter) *AvailabilityCounter {
+	// this policy never change the status of the counter as a result of passing the time
+	return nil
+}
+func (this defaultAvailabilityPolicy) OnConnectionSucceeded(counter *AvailabilityCounter) *AvailabilityCounter {
+	switch counter.Status {
 	case PossiblyAvailable:
-		if this.Counter >= 50 {
-			return this
+		if counter.Counter >= 50 {
+			return counter
 		}
-		return &AvailabilityCounter{Counter: this.Counter + 1, Status: PossiblyAvailable}
+		return &AvailabilityCounter{Counter: counter.Counter + 1, Status: PossiblyAvailable}
 	case UnknownAvailablityStatus:
 		return &AvailabilityCounter{Counter: 1, Status: PossiblyAvailable}
 	default:
-		if this.Counter <= 1 {
+		if counter.Counter <= 1 {
 			return unknownAvailablityCounter
 		}
 
 		result := &AvailabilityCounter{NextTry: time.Now(), Status: NotAvailable}
-		if this.Counter < 5 {
-			result.Counter = this.Counter - 1
-		} else if this.Counter < 10 {
-			result.Counter = this.Counter - 2
+		if counter.Counter < 5 {
+			result.Counter = counter.Counter - 1
+		} else if counter.Counter < 10 {
+			result.Counter = counter.Counter - 2
 		} else {
-			result.Counter = this.Counter - 4
+			result.Counter = counter.Counter - 4
 		}
 		return result
 	}
 }
-func (this AvailabilityCounter) OnConnectionFailed() *AvailabilityCounter {
-	switch this.Status {
+func (this defaultAvailabilityPolicy) OnConnectionFailed(counter *AvailabilityCounter) *AvailabilityCounter {
+	switch counter.Status {
 	case PossiblyAvailable:
-		if this.Counter <= 10 {
+		if counter.Counter <= 10 {
 			return unknownAvailablityCounter
 		}
-		return &AvailabilityCounter{Counter: this.Counter - 10, Status: PossiblyAvailable}
+		return &AvailabilityCounter{Counter: counter.Counter - 10, Status: PossiblyAvailable}
 	case UnknownAvailablityStatus:
 		return &AvailabilityCounter{Counter: 1, Status: NotAvailable, NextTry: time.Now()}
 	default:
-		if this.Counter >= 20 {
+		if counter.Counter >= 20 {
 			// too many failure, retry again in 10 seconds
 			return &AvailabilityCounter{
 				Counter: 20,
@@ -73,27 +118,211 @@ func (this AvailabilityCounter) OnConnectionFailed() *AvailabilityCounter {
 				NextTry: time.Now().Add(time.Second * 10),
 			}
 		}
-		if this.Counter >= 10 {
+		if counter.Counter >= 10 {
 			// we are really failing, wait a bit before retry
 			return &AvailabilityCounter{
-				Counter: this.Counter + 1,
+				Counter: counter.Counter + 1,
 				Status:  NotAvailable,
 				NextTry: time.Now().Add(time.Second * 5),
 			}
 		}
-		if this.Counter >= 3 {
+		if counter.Counter >= 3 {
 			// we are failing a bit, wait a bit before retry
 			return &AvailabilityCounter{
-				Counter: this.Counter + 1,
+				Counter: counter.Counter + 1,
 				Status:  NotAvailable,
 				NextTry: time.Now().Add(time.Second),
 			}
 		}
 		// we are failing a bit, wait a bit before retry
 		return &AvailabilityCounter{
-			Counter: this.Counter + 1,
+			Counter: counter.Counter + 1,
 			Status:  NotAvailable,
 			NextTry: time.Now().Add(time.Millisecond * 100),
 		}
 	}
 }
+
+//endregion
+
+//region circuitBreakerPolicy
+// circuitBreakerPolicy open the circuit after a number of consecutive failures, wait for an exponential back-off and
+// then let a limited number of probes reach the backend, until enough of them succeed.
+//
+// Counter of the availability counter is number of consecutive failures while the circuit is closed, and number of
+// succeeded probes while it is half-open.
+type circuitBreakerPolicy struct {
+	FailureThreshold  int
+	BaseBackoff       time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	Jitter            float64
+	HalfOpenProbes    int
+	SuccessThreshold  int
+}
+
+func (this *circuitBreakerPolicy) open(backoff time.Duration) *AvailabilityCounter {
+	if backoff > this.MaxBackoff {
+		backoff = this.MaxBackoff
+	}
+
+	delay := backoff
+	if this.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * this.Jitter * float64(backoff))
+	}
+	return &AvailabilityCounter{Status: NotAvailable, NextTry: time.Now().Add(delay), Backoff: backoff}
+}
+
+func (this *circuitBreakerPolicy) IsAvailableToTry(counter *AvailabilityCounter, pendingAttempts int) bool {
+	switch counter.Status {
+	case PossiblyAvailable, UnknownAvailablityStatus:
+		return true
+	case HalfOpen:
+		return pendingAttempts < this.HalfOpenProbes
+	default:
+		return false
+	}
+}
+func (this *circuitBreakerPolicy) ShouldProbe(counter *AvailabilityCounter) *AvailabilityCounter {
+	if counter.Status != NotAvailable || time.Now().Before(counter.NextTry) {
+		return nil
+	}
+	return &AvailabilityCounter{Status: HalfOpen, Backoff: counter.Backoff}
+}
+func (this *circuitBreakerPolicy) OnConnectionSucceeded(counter *AvailabilityCounter) *AvailabilityCounter {
+	switch counter.Status {
+	case PossiblyAvailable:
+		if counter.Counter == 0 {
+			return counter
+		}
+		return &AvailabilityCounter{Status: PossiblyAvailable}
+	case HalfOpen:
+		if counter.Counter+1 >= this.SuccessThreshold {
+			return &AvailabilityCounter{Status: PossiblyAvailable}
+		}
+		return &AvailabilityCounter{Status: HalfOpen, Counter: counter.Counter + 1, Backoff: counter.Backoff}
+	case NotAvailable:
+		// a last resort connection succeeded, wait for the back-off to probe it properly
+		return counter
+	default:
+		return &AvailabilityCounter{Status: PossiblyAvailable}
+	}
+}
+func (this *circuitBreakerPolicy) OnConnectionFailed(counter *AvailabilityCounter) *AvailabilityCounter {
+	switch counter.Status {
+	case HalfOpen:
+		// probe failed, open the circuit again with a longer back-off
+		return this.open(time.Duration(float64(counter.Backoff) * this.BackoffMultiplier))
+	case NotAvailable:
+		return this.open(counter.Backoff)
+	default:
+		if counter.Counter+1 >= this.FailureThreshold {
+			return this.open(this.BaseBackoff)
+		}
+		return &AvailabilityCounter{Status: PossiblyAvailable, Counter: counter.Counter + 1}
+	}
+}
+
+//endregion
+
+const (
+	DefaultHealthPolicy        = "default"
+	CircuitBreakerHealthPolicy = "circuitBreaker"
+
+	defaultFailureThreshold  = 3
+	defaultBaseBackoff       = 100 * time.Millisecond
+	defaultMaxBackoff        = 10 * time.Second
+	defaultBackoffMultiplier = 2
+	defaultBackoffJitter     = 0.2
+	defaultHalfOpenProbes    = 1
+	defaultSuccessThreshold  = 2
+)
+
+type HealthPolicyConfig struct {
+	// Preset `default` that use fixed counters and back-offs, or `circuitBreaker` that may be tuned using other
+	// fields of this config
+	Preset string `yaml:"preset,omitempty"`
+	// FailureThreshold number of consecutive failures that open the circuit
+	FailureThreshold *int `yaml:"failureThreshold,omitempty"`
+	// BaseBackoff back-off after the circuit opened for the first time
+	BaseBackoff *time.Duration `yaml:"baseBackoff,omitempty"`
+	// MaxBackoff maximum back-off of the circuit
+	MaxBackoff *time.Duration `yaml:"maxBackoff,omitempty"`
+	// BackoffMultiplier back-off is multiplied by this value each time that a probe fails
+	BackoffMultiplier *float64 `yaml:"backoffMultiplier,omitempty"`
+	// Jitter a random fraction of back-off, in range [0, 1], that is added to or removed from each back-off
+	Jitter *float64 `yaml:"jitter,omitempty"`
+	// HalfOpenProbes maximum number of concurrent connections to a half-open backend
+	HalfOpenProbes *int `yaml:"halfOpenProbes,omitempty"`
+	// SuccessThreshold number of succeeded probes that close the circuit
+	SuccessThreshold *int `yaml:"successThreshold,omitempty"`
+}
+
+func (this *HealthPolicyConfig) hasCircuitBreakerSettings() bool {
+	return this.FailureThreshold != nil || this.BaseBackoff != nil || this.MaxBackoff != nil ||
+		this.BackoffMultiplier != nil || this.Jitter != nil || this.HalfOpenProbes != nil ||
+		this.SuccessThreshold != nil
+}
+
+func CreateAvailabilityPolicy(config *HealthPolicyConfig) (AvailabilityPolicy, error) {
+	if config == nil {
+		return defaultAvailabilityPolicy(true), nil
+	}
+
+	switch config.Preset {
+	case "", DefaultHealthPolicy:
+		if config.hasCircuitBreakerSettings() {
+			return nil, fmt.Errorf("Health policy settings are only valid for `%s` preset", CircuitBreakerHealthPolicy)
+		}
+		return defaultAvailabilityPolicy(true), nil
+
+	case CircuitBreakerHealthPolicy:
+		policy := &circuitBreakerPolicy{
+			FailureThreshold:  defaultFailureThreshold,
+			BaseBackoff:       defaultBaseBackoff,
+			MaxBackoff:        defaultMaxBackoff,
+			BackoffMultiplier: defaultBackoffMultiplier,
+			Jitter:            defaultBackoffJitter,
+			HalfOpenProbes:    defaultHalfOpenProbes,
+			SuccessThreshold:  defaultSuccessThreshold,
+		}
+		if config.FailureThreshold != nil {
+			policy.FailureThreshold = *config.FailureThreshold
+		}
+		if config.BaseBackoff != nil {
+			policy.BaseBackoff = *config.BaseBackoff
+		}
+		if config.MaxBackoff != nil {
+			policy.MaxBackoff = *config.MaxBackoff
+		}
+		if config.BackoffMultiplier != nil {
+			policy.BackoffMultiplier = *config.BackoffMultiplier
+		}
+		if config.Jitter != nil {
+			policy.Jitter = *config.Jitter
+		}
+		if config.HalfOpenProbes != nil {
+			policy.HalfOpenProbes = *config.HalfOpenProbes
+		}
+		if config.SuccessThreshold != nil {
+			policy.SuccessThreshold = *config.SuccessThreshold
+		}
+
+		if policy.FailureThreshold < 1 || policy.HalfOpenProbes < 1 || policy.SuccessThreshold < 1 {
+			return nil, fmt.Errorf("Health policy thresholds and probe count must be positive")
+		}
+		if policy.BaseBackoff <= 0 || policy.MaxBackoff < policy.BaseBackoff {
+			return nil, fmt.Errorf("Health policy back-off must be positive and smaller than its cap")
+		}
+		if policy.BackoffMultiplier < 1 || math.IsNaN(policy.BackoffMultiplier) {
+			return nil, fmt.Errorf("Health policy back-off multiplier must be at least 1")
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return nil, fmt.Errorf("Health policy jitter must be in range [0, 1]")
+		}
+		return policy, nil
+
+	default:
+		return nil, fmt.Errorf("Invalid health policy preset: %s", config.Preset)
+	}
+}
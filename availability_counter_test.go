@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDefaultPolicyBackoff(t *testing.T) {
+	policy := defaultAvailabilityPolicy(true)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		counter   *AvailabilityCounter
+		available bool
+	}{
+		{name: "unknown", counter: unknownAvailablityCounter, available: true},
+		{name: "available", counter: &AvailabilityCounter{Counter: 5, Status: PossiblyAvailable}, available: true},
+		{name: "in back-off", counter: &AvailabilityCounter{Counter: 3, Status: NotAvailable,
+			NextTry: now.Add(time.Second)}, available: false},
+		{name: "back-off passed", counter: &AvailabilityCounter{Counter: 3, Status: NotAvailable,
+			NextTry: now.Add(-time.Millisecond)}, available: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if policy.IsAvailableToTry(test.counter, 0) != test.available {
+				t.Errorf("Expected availability to be %v", test.available)
+			}
+		})
+	}
+
+	// second failure wait 100ms before the next try
+	counter := policy.OnConnectionFailed(policy.OnConnectionFailed(NewAvailabilityCounter()))
+	if policy.IsAvailableToTry(counter, 0) {
+		t.Errorf("Expected a failed backend to wait for its back-off")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !policy.IsAvailableToTry(counter, 0) {
+		t.Errorf("Expected a failed backend to be tried after its back-off")
+	}
+}
+
+func float64Ptr(value float64) *float64 { return &value }
+
+func TestCircuitBreakerPolicy(t *testing.T) {
+	policy, err := CreateAvailabilityPolicy(&HealthPolicyConfig{
+		Preset:           CircuitBreakerHealthPolicy,
+		FailureThreshold: intPtr(2),
+		BaseBackoff:      durationPtr(time.Second),
+		MaxBackoff:       durationPtr(3 * time.Second),
+		Jitter:           float64Ptr(0),
+		HalfOpenProbes:   intPtr(1),
+		SuccessThreshold: intPtr(2),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+	// passed back-off is simulated by moving `NextTry` to the past
+	expire := func(counter *AvailabilityCounter) *AvailabilityCounter {
+		result := *counter
+		result.NextTry = time.Now().Add(-time.Millisecond)
+		return &result
+	}
+	expectStatus := func(step string, counter *AvailabilityCounter, status AvailabilityStatus, backoff time.Duration) {
+		if counter.Status != status || counter.Backoff != backoff {
+			t.Fatalf("%s: expected `%v` with back-off %v, got `%v` with back-off %v",
+				step, status, backoff, counter.Status, counter.Backoff)
+		}
+	}
+
+	counter := policy.OnConnectionFailed(NewAvailabilityCounter())
+	expectStatus("first failure", counter, PossiblyAvailable, 0)
+	counter = policy.OnConnectionFailed(policy.OnConnectionSucceeded(counter))
+	expectStatus("failures that are not consecutive", counter, PossiblyAvailable, 0)
+
+	counter = policy.OnConnectionFailed(counter)
+	expectStatus("consecutive failures", counter, NotAvailable, time.Second)
+	if policy.IsAvailableToTry(counter, 0) || policy.ShouldProbe(counter) != nil {
+		t.Fatal("Expected open circuit to wait for its back-off")
+	}
+	if next := counter.NextTry.Sub(time.Now()); next < 900*time.Millisecond || next > time.Second {
+		t.Fatalf("Expected next try after the base back-off, got %v", next)
+	}
+	if policy.OnConnectionSucceeded(counter) != counter {
+		t.Fatal("Expected a last resort success to keep the circuit open")
+	}
+
+	counter = policy.ShouldProbe(expire(counter))
+	expectStatus("passed back-off", counter, HalfOpen, time.Second)
+	if !policy.IsAvailableToTry(counter, 0) || policy.IsAvailableToTry(counter, 1) {
+		t.Fatal("Expected half-open circuit to allow exactly one probe")
+	}
+
+	// failed probes double the back-off until it reach its cap
+	counter = policy.OnConnectionFailed(counter)
+	expectStatus("failed probe", counter, NotAvailable, 2*time.Second)
+	counter = policy.OnConnectionFailed(policy.ShouldProbe(expire(counter)))
+	expectStatus("second failed probe", counter, NotAvailable, 3*time.Second)
+
+	counter = policy.OnConnectionSucceeded(policy.ShouldProbe(expire(counter)))
+	expectStatus("succeeded probe", counter, HalfOpen, 3*time.Second)
+	counter = policy.OnConnectionSucceeded(counter)
+	expectStatus("enough succeeded probes", counter, PossiblyAvailable, 0)
+	if counter.Counter != 0 {
+		t.Fatalf("Expected closed circuit to forget its failures, got %d", counter.Counter)
+	}
+}
+
+func TestCreateAvailabilityPolicy(t *testing.T) {
+	circuitBreaker := func(config HealthPolicyConfig) *HealthPolicyConfig {
+		config.Preset = CircuitBreakerHealthPolicy
+		return &config
+	}
+	tests := []struct {
+		name    string
+		config  *HealthPolicyConfig
+		breaker bool
+		failure bool
+	}{
+		{name: "missing config"},
+		{name: "default preset", config: &HealthPolicyConfig{Preset: DefaultHealthPolicy}},
+		{name: "settings of default preset", config: &HealthPolicyConfig{FailureThreshold: intPtr(3)},
+			failure: true},
+		{name: "unknown preset", config: &HealthPolicyConfig{Preset: "aggressive"}, failure: true},
+		{name: "circuit breaker", config: circuitBreaker(HealthPolicyConfig{}), breaker: true},
+		{name: "zero failure threshold", config: circuitBreaker(HealthPolicyConfig{FailureThreshold: intPtr(0)}),
+			failure: true},
+		{name: "zero probes", config: circuitBreaker(HealthPolicyConfig{HalfOpenProbes: intPtr(0)}),
+			failure: true},
+		{name: "zero success threshold", config: circuitBreaker(HealthPolicyConfig{SuccessThreshold: intPtr(0)}),
+			failure: true},
+		{name: "zero back-off", config: circuitBreaker(HealthPolicyConfig{BaseBackoff: durationPtr(0)}),
+			failure: true},
+		{name: "cap below back-off", config: circuitBreaker(HealthPolicyConfig{BaseBackoff: durationPtr(time.Second),
+			MaxBackoff: durationPtr(time.Millisecond)}), failure: true},
+		{name: "shrinking back-off", config: circuitBreaker(HealthPolicyConfig{BackoffMultiplier: float64Ptr(0.5)}),
+			failure: true},
+		{name: "NaN multiplier", config: circuitBreaker(HealthPolicyConfig{BackoffMultiplier: float64Ptr(math.NaN())}),
+			failure: true},
+		{name: "negative jitter", config: circuitBreaker(HealthPolicyConfig{Jitter: float64Ptr(-0.1)}), failure: true},
+		{name: "jitter above 1", config: circuitBreaker(HealthPolicyConfig{Jitter: float64Ptr(1.5)}), failure: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := CreateAvailabilityPolicy(test.config)
+			if test.failure {
+				if err == nil {
+					t.Error("Expected config to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, ok := policy.(*circuitBreakerPolicy); ok != test.breaker {
+				t.Errorf("Expected circuit breaker to be %v, got %T", test.breaker, policy)
+			}
+		})
+	}
+}
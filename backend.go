@@ -1,46 +1,212 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
+	"reflect"
 	"sync/atomic"
+	"time"
 	"unsafe"
+
+	"github.com/devops-simba/helpers"
+)
+
+type BackendAdminState int32
+
+const (
+	// BackendEnabled backend accept new clients
+	BackendEnabled BackendAdminState = iota
+	// BackendDisabled backend does not accept new clients and its clients are disconnected
+	BackendDisabled
+	// BackendDraining backend does not accept new clients and its clients are gradually disconnected
+	BackendDraining
+)
+
+func (this BackendAdminState) String() string {
+	switch this {
+	case BackendEnabled:
+		return "enabled"
+	case BackendDisabled:
+		return "disabled"
+	case BackendDraining:
+		return "draining"
+	default:
+		return fmt.Sprintf("BackendAdminState(%d)", int32(this))
+	}
+}
+
+const (
+	// weight of the newest sample in exponentially weighted moving average of the latency
+	latencyEwmaAlpha = 0.3
+	// latency that is recorded for a failed connection, so failing backends do not look fast
+	failedConnectionLatency = 10 * time.Second
 )
 
 type MQTTBackend struct {
 	Name     string
-	Weight   int
 	Endpoint MQTTClientEndpoint
+	// ConnectRewrite rewrite CONNECT of the clients before it is sent to this backend, it may be `nil`
+	ConnectRewrite *connectRewriter
+
+	// weight is accessed atomically, so it can be changed by a configuration reload
+	weight int32
+	config MQTTBackendConfig
 
 	availabilityCounter unsafe.Pointer
+	policy              AvailabilityPolicy
+	pendingAttempts     int32
+	logger              helpers.Logger
+	activeConnections   int64
+	latency             uint64 // bits of a float64
+	healthState         int32
+	adminState          int32
+	healthCheck         *HealthCheckConfig
 }
 
-func (this *MQTTBackend) IsAvailable() bool {
-	availabilityCounter := (*AvailabilityCounter)(atomic.LoadPointer(&this.availabilityCounter))
-	return availabilityCounter.IsAvailableToTry()
+// AdminState state of the backend that is set by an operator
+func (this *MQTTBackend) AdminState() BackendAdminState {
+	return BackendAdminState(atomic.LoadInt32(&this.adminState))
 }
-func (this *MQTTBackend) OnConnectionSucceeded() {
-	OnBackendConnectionSucceded(this.Name)
+func (this *MQTTBackend) SetAdminState(state BackendAdminState) {
+	old := BackendAdminState(atomic.SwapInt32(&this.adminState, int32(state)))
+	if old != state {
+		this.logger.Infof("Backend is %v now", state)
+	}
+}
+
+// AcceptsNewClients return `false` if an operator disabled or drained this backend
+func (this *MQTTBackend) AcceptsNewClients() bool { return this.AdminState() == BackendEnabled }
+
+// IsDrained return `true` if the backend is draining and it has no connection left
+func (this *MQTTBackend) IsDrained() bool {
+	return this.AdminState() == BackendDraining && this.ActiveConnections() == 0
+}
+
+func (this *MQTTBackend) GetWeight() int       { return int(atomic.LoadInt32(&this.weight)) }
+func (this *MQTTBackend) SetWeight(weight int) { atomic.StoreInt32(&this.weight, int32(weight)) }
+
+// EffectiveWeight weight of this backend between backends of its own tier(active or passive)
+func (this *MQTTBackend) EffectiveWeight(active bool) int {
+	if active {
+		return this.GetWeight()
+	} else {
+		return 1 - this.GetWeight()
+	}
+}
+
+// IsSameBackend return `true` if other backend is created from the same configuration, except for the weight.
+// A reloaded configuration will keep such backends along with their state and only change their weight.
+func (this *MQTTBackend) IsSameBackend(other *MQTTBackend) bool {
+	lhs, rhs := this.config, other.config
+	lhs.Weight, rhs.Weight = nil, nil
+	return this.Name == other.Name && reflect.DeepEqual(lhs, rhs)
+}
+
+// ActiveConnections number of clients that are currently proxied to this backend
+func (this *MQTTBackend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&this.activeConnections)
+}
+func (this *MQTTBackend) OnClientAttached() { atomic.AddInt64(&this.activeConnections, 1) }
+func (this *MQTTBackend) OnClientDetached() { atomic.AddInt64(&this.activeConnections, -1) }
+
+// Latency moving average of the time that this backend need to accept a connection and answer its CONNECT, in
+// seconds. Failed connections are counted as `failedConnectionLatency`. It is 0 if we have no sample yet.
+func (this *MQTTBackend) Latency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&this.latency))
+}
+func (this *MQTTBackend) RecordLatency(latency time.Duration) {
 	for {
-		oldPointer := atomic.LoadPointer(&this.availabilityCounter)
-		availabilityCounter := (*AvailabilityCounter)(oldPointer)
-		newAvailabilityCounter := unsafe.Pointer(availabilityCounter.OnConnectionSucceeded())
-		if atomic.CompareAndSwapPointer(&this.availabilityCounter, oldPointer, newAvailabilityCounter) {
+		oldBits := atomic.LoadUint64(&this.latency)
+		average := math.Float64frombits(oldBits)
+		if average == 0 {
+			average = latency.Seconds()
+		} else {
+			average = latencyEwmaAlpha*latency.Seconds() + (1-latencyEwmaAlpha)*average
+		}
+		if atomic.CompareAndSwapUint64(&this.latency, oldBits, math.Float64bits(average)) {
 			break
 		}
 	}
 }
-func (this *MQTTBackend) OnConnectionFailed() {
-	OnBackendConnectionFailed(this.Name)
+
+func (this *MQTTBackend) loadAvailabilityCounter() *AvailabilityCounter {
+	return (*AvailabilityCounter)(atomic.LoadPointer(&this.availabilityCounter))
+}
+
+// updateAvailabilityCounter atomically replace availability counter of this backend with the result of `update`, if
+// `update` return `nil` counter will not be changed
+func (this *MQTTBackend) updateAvailabilityCounter(update func(*AvailabilityCounter) *AvailabilityCounter) {
 	for {
 		oldPointer := atomic.LoadPointer(&this.availabilityCounter)
 		availabilityCounter := (*AvailabilityCounter)(oldPointer)
-		newAvailabilityCounter := unsafe.Pointer(availabilityCounter.OnConnectionFailed())
-		if atomic.CompareAndSwapPointer(&this.availabilityCounter, oldPointer, newAvailabilityCounter) {
+		newAvailabilityCounter := update(availabilityCounter)
+		if newAvailabilityCounter == nil {
+			return
+		}
+		if atomic.CompareAndSwapPointer(&this.availabilityCounter, oldPointer, unsafe.Pointer(newAvailabilityCounter)) {
+			if availabilityCounter.Status != newAvailabilityCounter.Status {
+				this.logger.Infof("Availability of backend changed from `%v` to `%v`",
+					availabilityCounter.Status, newAvailabilityCounter.Status)
+				OnBackendAvailabilityChanged(this.Name, availabilityCounter.Status, newAvailabilityCounter.Status)
+			}
 			break
 		}
 	}
 }
 
+func (this *MQTTBackend) IsAvailable() bool {
+	if this.HealthState() == Unhealthy {
+		return false
+	}
+
+	this.updateAvailabilityCounter(this.policy.ShouldProbe)
+	pendingAttempts := int(atomic.LoadInt32(&this.pendingAttempts))
+	return this.policy.IsAvailableToTry(this.loadAvailabilityCounter(), pendingAttempts)
+}
+
+// OnConnectionStarted must be called before each attempt to connect a client to this backend and
+// `OnConnectionFinished` must be called after the result of the attempt is known. Health checks are not counted
+func (this *MQTTBackend) OnConnectionStarted()  { atomic.AddInt32(&this.pendingAttempts, 1) }
+func (this *MQTTBackend) OnConnectionFinished() { atomic.AddInt32(&this.pendingAttempts, -1) }
+func (this *MQTTBackend) OnConnectionSucceeded() {
+	OnBackendConnectionSucceded(this.Name)
+	this.updateAvailabilityCounter(this.policy.OnConnectionSucceeded)
+}
+func (this *MQTTBackend) OnConnectionFailed() {
+	OnBackendConnectionFailed(this.Name)
+	this.RecordLatency(failedConnectionLatency)
+	this.updateAvailabilityCounter(this.policy.OnConnectionFailed)
+}
+
+// HealthState last known result of active health checks of this backend
+func (this *MQTTBackend) HealthState() HealthState {
+	return HealthState(atomic.LoadInt32(&this.healthState))
+}
+func (this *MQTTBackend) SetHealthState(state HealthState) {
+	old := HealthState(atomic.SwapInt32(&this.healthState, int32(state)))
+	if old == state {
+		return
+	}
+
+	OnBackendHealthChanged(this.Name, state)
+	if state == Healthy {
+		// forget about passive failures, backend is healthy again
+		this.updateAvailabilityCounter(func(*AvailabilityCounter) *AvailabilityCounter {
+			return NewAvailabilityCounter()
+		})
+	}
+}
+
+// CreateHealthChecker create a service that actively check health of this backend, it returns `nil` if active
+// health checks are not enabled for this backend
+func (this *MQTTBackend) CreateHealthChecker(serviceName string) (helpers.Service, error) {
+	if this.healthCheck == nil || !GetOptionalBool(this.healthCheck.Enabled, true) {
+		return nil, nil
+	}
+	return newHealthChecker(serviceName, this, this.healthCheck)
+}
+
 type MQTTBackendList []*MQTTBackend
 
 func (this MQTTBackendList) Contains(backend *MQTTBackend) bool {
@@ -62,32 +228,20 @@ func (this MQTTBackendList) RandomSelect(active bool) *MQTTBackend {
 		return this[0]
 	}
 
+	// weights may change concurrently, so we read them once
 	weightSum := 0
-	if active {
-		for i := 0; i < len(this); i++ {
-			weightSum += this[i].Weight
-		}
-
-		selection := rand.Intn(weightSum)
-		for i := 0; i < len(this); i++ {
-			if selection < this[i].Weight {
-				return this[i]
-			}
-			selection -= this[i].Weight
-		}
-	} else {
-		for i := 0; i < len(this); i++ {
-			weightSum += 1 - this[i].Weight
-		}
+	weights := make([]int, len(this))
+	for i := 0; i < len(this); i++ {
+		weights[i] = this[i].EffectiveWeight(active)
+		weightSum += weights[i]
+	}
 
-		selection := rand.Intn(weightSum)
-		for i := 0; i < len(this); i++ {
-			weight := 1 - this[i].Weight
-			if selection < weight {
-				return this[i]
-			}
-			selection -= weight
+	selection := rand.Intn(weightSum)
+	for i := 0; i < len(this); i++ {
+		if selection < weights[i] {
+			return this[i]
 		}
+		selection -= weights[i]
 	}
 
 	panic("Must never reach here")
@@ -113,9 +267,16 @@ type MQTTBackendConfig struct {
 	Name                     string `yaml:"name"`
 	Weight                   *int   `yaml:"weight"`
 	Enabled                  *bool  `yaml:"enabled,omitempty"`
+	// HealthCheck configuration of active health checks of this backend
+	HealthCheck *HealthCheckConfig `yaml:"healthCheck,omitempty"`
+	// HealthPolicy how failures of the clients that connect through this backend affect its availability,
+	// if it is missing health policy of the service will be used
+	HealthPolicy *HealthPolicyConfig `yaml:"healthPolicy,omitempty"`
+	// Connect rewrite CONNECT of the clients before it is sent to this backend
+	Connect *ConnectRewriteConfig `yaml:"connect,omitempty"`
 }
 
-func CreateBackend(config MQTTBackendConfig) (*MQTTBackend, bool, error) {
+func CreateBackend(config MQTTBackendConfig, defaultHealthPolicy *HealthPolicyConfig) (*MQTTBackend, bool, error) {
 	client, err := CreateClientEndpoint(config.MQTTClientEndpointConfig)
 	if err != nil {
 		return nil, false, err
@@ -125,14 +286,38 @@ func CreateBackend(config MQTTBackendConfig) (*MQTTBackend, bool, error) {
 		config.Name = "backend_" + client.GetAddress()
 	}
 
+	if config.HealthPolicy == nil {
+		config.HealthPolicy = defaultHealthPolicy
+	}
+	policy, err := CreateAvailabilityPolicy(config.HealthPolicy)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid health policy of backend `%s`: %w", config.Name, err)
+	}
+
+	connectRewrite, err := createConnectRewriter(config.Connect, config.Name)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid connect rewrite of backend `%s`: %w", config.Name, err)
+	}
+
 	backend := &MQTTBackend{
 		Name:                config.Name,
 		Endpoint:            client,
-		Weight:              1,
+		ConnectRewrite:      connectRewrite,
+		weight:              1,
+		config:              config,
 		availabilityCounter: unsafe.Pointer(NewAvailabilityCounter()),
+		policy:              policy,
+		logger:              CreateLogger("backend/" + config.Name),
+		healthCheck:         config.HealthCheck,
 	}
 	if config.Weight != nil {
-		backend.Weight = *config.Weight
+		backend.weight = int32(*config.Weight)
+	}
+	if config.HealthCheck != nil {
+		// validate health check configuration now, instead of when we start the service
+		if _, err = newHealthChecker("", backend, config.HealthCheck); err != nil {
+			return nil, false, fmt.Errorf("Invalid health check of backend `%s`: %w", backend.Name, err)
+		}
 	}
 	return backend, GetOptionalBool(config.Enabled, true), nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+type BalancingMode string
+
+const (
+	// RandomBalancing select a random backend for each client with respect to weight of the backends
+	RandomBalancing BalancingMode = "random"
+	// RoundRobinBalancing select backends in turn with respect to their weight
+	RoundRobinBalancing BalancingMode = "roundRobin"
+	// LeastConnectionsBalancing select the backend that has least number of active clients relative to its weight
+	LeastConnectionsBalancing BalancingMode = "leastConnections"
+	// LatencyBalancing select the backend that has the lowest average time for connecting and answering CONNECT
+	LatencyBalancing BalancingMode = "latency"
+	// ClientIdBalancing map client identifier of each client to a backend using consistent hashing, so a client
+	// that reconnects will land on the same backend as long as that backend is available
+	ClientIdBalancing BalancingMode = "clientId"
+)
+
+// BalancingStrategy select a backend for a new client. Service call it with backends of one tier at a time(first
+// active backends and then passive backends), so strategy must only compare candidates with each other.
+type BalancingStrategy interface {
+	// Select select one of the candidates for the client, `active` indicate tier of the candidates
+	Select(candidates MQTTBackendList, active bool, clientID string) *MQTTBackend
+}
+
+func NewBalancingStrategy(mode BalancingMode, backends MQTTBackendList, loadFactor float64) (BalancingStrategy, error) {
+	switch mode {
+	case RandomBalancing:
+		return randomStrategy(true), nil
+	case RoundRobinBalancing:
+		return &roundRobinStrategy{currentWeights: make(map[*MQTTBackend]int)}, nil
+	case LeastConnectionsBalancing:
+		return leastConnectionsStrategy(true), nil
+	case LatencyBalancing:
+		return latencyStrategy(true), nil
+	case ClientIdBalancing:
+		return &clientIdStrategy{ring: newConsistentHashRing(backends, loadFactor)}, nil
+	default:
+		return nil, fmt.Errorf("Invalid balancing mode: %s", mode)
+	}
+}
+
+//region randomStrategy
+type randomStrategy bool
+
+func (this randomStrategy) Select(candidates MQTTBackendList, active bool, clientID string) *MQTTBackend {
+	return candidates.RandomSelect(active)
+}
+
+//endregion
+
+//region roundRobinStrategy
+// roundRobinStrategy implement smooth weighted round robin, so a backend with weight 3 is selected 3 times
+// in every 4 selections of a 3:1 pair, but not consecutively
+type roundRobinStrategy struct {
+	guard          sync.Mutex
+	currentWeights map[*MQTTBackend]int
+}
+
+func (this *roundRobinStrategy) Select(candidates MQTTBackendList, active bool, clientID string) *MQTTBackend {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	var result *MQTTBackend
+	totalWeight := 0
+	for i := 0; i < len(candidates); i++ {
+		backend := candidates[i]
+		weight := backend.EffectiveWeight(active)
+		totalWeight += weight
+		this.currentWeights[backend] += weight
+		if result == nil || this.currentWeights[backend] > this.currentWeights[result] {
+			result = backend
+		}
+	}
+	this.currentWeights[result] -= totalWeight
+	return result
+}
+
+//endregion
+
+//region leastConnectionsStrategy
+type leastConnectionsStrategy bool
+
+func (this leastConnectionsStrategy) Select(candidates MQTTBackendList, active bool, clientID string) *MQTTBackend {
+	var best MQTTBackendList
+	for i := 0; i < len(candidates); i++ {
+		if len(best) == 0 {
+			best = MQTTBackendList{candidates[i]}
+			continue
+		}
+
+		// compare connections/weight of two backends without division
+		lhs := candidates[i].ActiveConnections() * int64(best[0].EffectiveWeight(active))
+		rhs := best[0].ActiveConnections() * int64(candidates[i].EffectiveWeight(active))
+		if lhs < rhs {
+			best = MQTTBackendList{candidates[i]}
+		} else if lhs == rhs {
+			best = best.Append(candidates[i])
+		}
+	}
+	return best.RandomSelect(active)
+}
+
+//endregion
+
+//region latencyStrategy
+type latencyStrategy bool
+
+func (this latencyStrategy) Select(candidates MQTTBackendList, active bool, clientID string) *MQTTBackend {
+	// backends that have no latency sample yet are preferred, so we learn about them
+	var best MQTTBackendList
+	var bestLatency float64
+	for i := 0; i < len(candidates); i++ {
+		latency := candidates[i].Latency()
+		if len(best) == 0 || latency < bestLatency {
+			best = MQTTBackendList{candidates[i]}
+			bestLatency = latency
+		} else if latency == bestLatency {
+			best = best.Append(candidates[i])
+		}
+	}
+	if len(best) == 0 {
+		return nil
+	}
+	return best[rand.Intn(len(best))]
+}
+
+//endregion
+
+//region clientIdStrategy
+type clientIdStrategy struct {
+	ring *consistentHashRing
+}
+
+func (this *clientIdStrategy) Select(candidates MQTTBackendList, active bool, clientID string) *MQTTBackend {
+	if clientID == "" {
+		// client asked the server to assign an identifier to it, so there is nothing to stick to
+		return candidates.RandomSelect(active)
+	}
+	return this.ring.Select(clientID, candidates, active)
+}
+
+//endregion
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRoundRobinStrategy(t *testing.T) {
+	a, b, c := newTestBackend("a", 5), newTestBackend("b", 1), newTestBackend("c", 1)
+	strategy, err := NewBalancingStrategy(RoundRobinBalancing, MQTTBackendList{a, b, c}, defaultHashLoadFactor)
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %v", err)
+	}
+
+	// smooth weighted round robin spread selections of the heavy backend between the others
+	expected := "aabacaa"
+	for round := 0; round < 3; round++ {
+		selected := ""
+		for i := 0; i < len(expected); i++ {
+			selected += strategy.Select(MQTTBackendList{a, b, c}, true, "").Name
+		}
+		if selected != expected {
+			t.Fatalf("Expected round %d to be `%s`, got `%s`", round, expected, selected)
+		}
+	}
+
+	// weight changes are used by the next selection
+	b.SetWeight(5)
+	counts := make(map[string]int)
+	for i := 0; i < 110; i++ {
+		counts[strategy.Select(MQTTBackendList{a, b, c}, true, "").Name]++
+	}
+	if counts["a"] < 45 || counts["b"] < 45 || counts["c"] < 5 {
+		t.Errorf("Expected selections to follow new weights, got %v", counts)
+	}
+
+	if strategy.Select(nil, true, "") != nil {
+		t.Error("Expected no backend without candidates")
+	}
+}
+
+func TestLeastConnectionsStrategy(t *testing.T) {
+	a, b := newTestBackend("a", 1), newTestBackend("b", 2)
+	strategy, _ := NewBalancingStrategy(LeastConnectionsBalancing, MQTTBackendList{a, b}, defaultHashLoadFactor)
+
+	tests := []struct {
+		name     string
+		a        int64
+		b        int64
+		expected string
+	}{
+		{name: "idle backend", a: 0, b: 3, expected: "a"},
+		{name: "connections relative to weight", a: 2, b: 3, expected: "b"},
+		{name: "heavier backend", a: 2, b: 5, expected: "a"},
+		{name: "tie", a: 1, b: 2, expected: "ab"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a.activeConnections, b.activeConnections = test.a, test.b
+			selected := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				selected[strategy.Select(MQTTBackendList{a, b}, true, "").Name] = true
+			}
+			if len(selected) != len(test.expected) {
+				t.Fatalf("Expected `%s` to be selected, got %v", test.expected, selected)
+			}
+			for _, name := range test.expected {
+				if !selected[string(name)] {
+					t.Errorf("Expected `%c` to be selected, got %v", name, selected)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	a, b, c := newTestBackend("a", 1), newTestBackend("b", 1), newTestBackend("c", 1)
+	strategy, _ := NewBalancingStrategy(LatencyBalancing, MQTTBackendList{a, b, c}, defaultHashLoadFactor)
+
+	// first sample is the average, later samples are added with weight `latencyEwmaAlpha`
+	a.RecordLatency(100 * time.Millisecond)
+	if math.Abs(a.Latency()-0.1) > 1e-9 {
+		t.Fatalf("Expected first sample to be the average, got %v", a.Latency())
+	}
+	a.RecordLatency(200 * time.Millisecond)
+	if expected := latencyEwmaAlpha*0.2 + (1-latencyEwmaAlpha)*0.1; math.Abs(a.Latency()-expected) > 1e-9 {
+		t.Fatalf("Expected average to be %v, got %v", expected, a.Latency())
+	}
+	b.RecordLatency(50 * time.Millisecond)
+
+	// backends without sample are tried first
+	if selected := strategy.Select(MQTTBackendList{a, b, c}, true, ""); selected != c {
+		t.Fatalf("Expected backend without sample to be selected, got `%s`", selected.Name)
+	}
+	if selected := strategy.Select(MQTTBackendList{a, b}, true, ""); selected != b {
+		t.Fatalf("Expected fastest backend to be selected, got `%s`", selected.Name)
+	}
+
+	// failures count as slow connections
+	b.OnConnectionFailed()
+	if selected := strategy.Select(MQTTBackendList{a, b}, true, ""); selected != a {
+		t.Errorf("Expected a failing backend to be avoided, got `%s`", selected.Name)
+	}
+}
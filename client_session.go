@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"time"
+)
+
+// how long we wait to send DISCONNECT to a client that is being disconnected
+const disconnectWriteTimeout = time.Second
+
+// sessionConn serialize writes to the client, proxy only write complete packets to the client, so a packet that
+// is written by the proxy itself(like DISCONNECT) never land in the middle of another packet
+type sessionConn struct {
+	net.Conn
+	guard *sync.Mutex
+}
+
+func (this *sessionConn) Write(b []byte) (int, error) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.Conn.Write(b)
+}
+
+// ClientSession is a client that is connected to one of the frontends
+type ClientSession struct {
+	Conn        net.Conn
+	ConnectedAt time.Time
+
+	guard           sync.Mutex
+	writeGuard      sync.Mutex
+	rawConn         net.Conn
+	clientID        string
+	username        string
+	claims          map[string]interface{}
+	protocolVersion byte
+	backend         *MQTTBackend
+}
+
+func newClientSession(conn net.Conn) *ClientSession {
+	result := &ClientSession{ConnectedAt: time.Now(), rawConn: conn}
+	result.Conn = &sessionConn{Conn: conn, guard: &result.writeGuard}
+	return result
+}
+
+func (this *ClientSession) RemoteAddr() net.Addr  { return this.Conn.RemoteAddr() }
+func (this *ClientSession) Uptime() time.Duration { return time.Since(this.ConnectedAt) }
+
+// ClientID client identifier from CONNECT of the client, it is empty until client send its CONNECT
+func (this *ClientSession) ClientID() string {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.clientID
+}
+func (this *ClientSession) SetClientID(clientID string) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.clientID = clientID
+}
+
+// Username username of the client that is accepted by the authenticator of the service
+func (this *ClientSession) Username() string {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.username
+}
+func (this *ClientSession) SetUsername(username string) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.username = username
+}
+
+// Claims claims of the client that are set by the authenticator(for example claims of its JWT), it is `nil` if
+// authenticator has no claim for the client
+func (this *ClientSession) Claims() map[string]interface{} {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.claims
+}
+func (this *ClientSession) SetClaims(claims map[string]interface{}) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.claims = claims
+}
+
+// ClientCertificate return verified TLS certificate of the client, or `nil` if client has no verified certificate.
+// TLS handshake is completed on first read, so it must be called after reading CONNECT
+func (this *ClientSession) ClientCertificate() *x509.Certificate {
+	conn, ok := this.rawConn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// ProtocolVersion protocol level from CONNECT of the client, it is 0 until client send its CONNECT
+func (this *ClientSession) ProtocolVersion() byte {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.protocolVersion
+}
+func (this *ClientSession) SetProtocolVersion(protocolVersion byte) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.protocolVersion = protocolVersion
+}
+
+// Backend backend that is selected for this client, it is `nil` until a backend accept the client
+func (this *ClientSession) Backend() *MQTTBackend {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.backend
+}
+func (this *ClientSession) SetBackend(backend *MQTTBackend) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.backend = backend
+}
+
+// Disconnect close connection of the client, proxy will also close its connection to the backend
+func (this *ClientSession) Disconnect() error { return this.Conn.Close() }
+
+// DisconnectWithReason send a DISCONNECT with the reason code to MQTT 5 clients and then close the connection,
+// older clients have no way to know the reason, so their connection is simply closed
+func (this *ClientSession) DisconnectWithReason(reasonCode ReasonCode) error {
+	if this.ProtocolVersion() < MQTT5 {
+		return this.Disconnect()
+	}
+
+	this.writeGuard.Lock()
+	defer this.writeGuard.Unlock()
+
+	this.rawConn.SetWriteDeadline(time.Now().Add(disconnectWriteTimeout))
+	WritePacket(this.rawConn, &DisconnectPacket{ReasonCode: reasonCode}, MQTT5)
+	return this.rawConn.Close()
+}
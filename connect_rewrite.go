@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ConnectRewriteConfig struct {
+	// StripCredentials remove username and password of the clients
+	StripCredentials bool `yaml:"stripCredentials,omitempty"`
+	// Username if it is not empty, replace username of the clients
+	Username string `yaml:"username,omitempty"`
+	// Password if it is not empty, replace password of the clients
+	Password string `yaml:"password,omitempty"`
+	// PasswordFile a file that contains the password, it is used if `Password` is empty and it is reloaded when
+	// it changes
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	// ClientIDPrefix added to client ID of the clients, it may contain `%u`(username), `%f`(frontend name) and
+	// `%s`(service name). Empty client IDs are not changed, so backend can assign one
+	ClientIDPrefix string `yaml:"clientIdPrefix,omitempty"`
+	// ClientIDSuffix added to the end of client ID of the clients, it may contain same variables as `ClientIDPrefix`
+	ClientIDSuffix string `yaml:"clientIdSuffix,omitempty"`
+	// ForceCleanSession set clean session(clean start in MQTT 5) of the clients and remove their session expiry
+	ForceCleanSession bool `yaml:"forceCleanSession,omitempty"`
+	// MaxKeepAlive maximum keepalive of the clients, MQTT 5 clients are informed of the new keepalive by
+	// `ServerKeepAlive` of CONNACK. For older clients proxy pings the backend itself in `packets` mode and their
+	// keepalive is not changed in `raw` mode
+	MaxKeepAlive *time.Duration `yaml:"maxKeepAlive,omitempty"`
+}
+
+// connectRewriter rewrite CONNECT of the clients before it is sent to a backend
+type connectRewriter struct {
+	StripCredentials  bool
+	Username          string
+	GetPassword       func() string
+	ClientIDPrefix    string
+	ClientIDSuffix    string
+	ForceCleanSession bool
+	MaxKeepAlive      uint16
+}
+
+// createConnectRewriter compile the config, or return `nil` if config is `nil`
+func createConnectRewriter(config *ConnectRewriteConfig, backendName string) (*connectRewriter, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	result := &connectRewriter{
+		StripCredentials:  config.StripCredentials,
+		Username:          config.Username,
+		ClientIDPrefix:    config.ClientIDPrefix,
+		ClientIDSuffix:    config.ClientIDSuffix,
+		ForceCleanSession: config.ForceCleanSession,
+	}
+	if config.StripCredentials && config.Username == "" && (config.Password != "" || config.PasswordFile != "") {
+		// MQTT 3.1.1 does not allow a password without username
+		return nil, fmt.Errorf("`password` and `passwordFile` need `username` when credentials are stripped")
+	}
+	if config.Password != "" {
+		password := config.Password
+		result.GetPassword = func() string { return password }
+	} else if config.PasswordFile != "" {
+		file, err := newWatchedFile(config.PasswordFile, CreateLogger("backend/"+backendName),
+			func(content []byte) (interface{}, error) { return strings.TrimSpace(string(content)), nil })
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load password file: %w", err)
+		}
+		result.GetPassword = func() string { return file.Get().(string) }
+	}
+	if config.MaxKeepAlive != nil {
+		seconds := *config.MaxKeepAlive / time.Second
+		if seconds < 1 || seconds > 65535 {
+			return nil, fmt.Errorf("`maxKeepAlive` must be between 1s and 65535s")
+		}
+		result.MaxKeepAlive = uint16(seconds)
+	}
+	return result, nil
+}
+
+// Rewrite return a rewritten copy of the CONNECT of a client
+func (this *connectRewriter) Rewrite(connect *ConnectPacket, serviceName, frontendName string) *ConnectPacket {
+	result := *connect
+	result.Properties = append(Properties(nil), connect.Properties...)
+
+	if result.ClientID != "" && (this.ClientIDPrefix != "" || this.ClientIDSuffix != "") {
+		replacer := strings.NewReplacer("%u", connect.Username, "%f", frontendName, "%s", serviceName)
+		result.ClientID = replacer.Replace(this.ClientIDPrefix) + result.ClientID +
+			replacer.Replace(this.ClientIDSuffix)
+	}
+
+	if this.StripCredentials {
+		result.UsernameFlag, result.Username = false, ""
+		result.PasswordFlag, result.Password = false, nil
+	}
+	if this.Username != "" {
+		result.UsernameFlag, result.Username = true, this.Username
+	}
+	if this.GetPassword != nil && (result.UsernameFlag || result.ProtocolVersion >= MQTT5) {
+		// password without username is only valid in MQTT 5
+		result.PasswordFlag, result.Password = true, []byte(this.GetPassword())
+	}
+
+	if this.ForceCleanSession {
+		result.CleanSession = true
+		result.Properties.Remove(PropSessionExpiryInterval)
+	}
+	if this.MaxKeepAlive != 0 && (result.KeepAlive == 0 || result.KeepAlive > this.MaxKeepAlive) {
+		result.KeepAlive = this.MaxKeepAlive
+	}
+	return &result
+}
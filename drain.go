@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+// DisconnectReason reason that is sent to MQTT 5 clients when they are disconnected from a draining backend
+type DisconnectReason string
+
+const (
+	ServerShuttingDown DisconnectReason = "serverShuttingDown"
+	UseAnotherServer   DisconnectReason = "useAnotherServer"
+
+	// default number of clients that are disconnected from a draining backend in each second
+	defaultDrainRate = 10.0
+
+	InvalidDrainRate = helpers.StringError("Drain rate must be positive")
+)
+
+// ReasonCode MQTT 5 reason code of the DISCONNECT packet
+func (this DisconnectReason) ReasonCode() (ReasonCode, error) {
+	switch this {
+	case ServerShuttingDown:
+		return ReasonServerShuttingDown, nil
+	case UseAnotherServer:
+		return ReasonUseAnotherServer, nil
+	default:
+		return 0, fmt.Errorf("Invalid disconnect reason: %s", this)
+	}
+}
+
+type DrainConfig struct {
+	// Rate number of clients that are disconnected from a draining backend in each second
+	Rate *float64 `yaml:"rate,omitempty"`
+	// Reason that is sent to MQTT 5 clients, `useAnotherServer`(this is default) or `serverShuttingDown`
+	Reason *DisconnectReason `yaml:"reason,omitempty"`
+}
+
+// drainSettings is the validated form of `DrainConfig`
+type drainSettings struct {
+	Interval   time.Duration
+	ReasonCode ReasonCode
+}
+
+func newDrainSettings(config *DrainConfig) (drainSettings, error) {
+	if config == nil {
+		config = &DrainConfig{}
+	}
+
+	rate := defaultDrainRate
+	if config.Rate != nil {
+		rate = *config.Rate
+	}
+	if rate <= 0 {
+		return drainSettings{}, InvalidDrainRate
+	}
+
+	reason := UseAnotherServer
+	if config.Reason != nil {
+		reason = *config.Reason
+	}
+	reasonCode, err := reason.ReasonCode()
+	if err != nil {
+		return drainSettings{}, err
+	}
+
+	return drainSettings{
+		Interval:   time.Duration(float64(time.Second) / rate),
+		ReasonCode: reasonCode,
+	}, nil
+}
+
+// drainKey is the key of the drainer of a backend between components of the service
+type drainKey struct{ backend *MQTTBackend }
+
+// backendDrainer disconnect clients of a draining backend one by one, until the backend has no client or an
+// operator change its state
+type backendDrainer struct {
+	Name          string
+	Backend       *MQTTBackend
+	Settings      drainSettings
+	GetClients    func() []*ClientSession
+	stopRequested chan struct{}
+}
+
+func newBackendDrainer(serviceName string, backend *MQTTBackend, settings drainSettings,
+	getClients func() []*ClientSession) *backendDrainer {
+	return &backendDrainer{
+		Name:          fmt.Sprintf("drainer/%s/%s", serviceName, backend.Name),
+		Backend:       backend,
+		Settings:      settings,
+		GetClients:    getClients,
+		stopRequested: make(chan struct{}),
+	}
+}
+
+// nextClient return a client of the backend, or `nil` if there is no client
+func (this *backendDrainer) nextClient() *ClientSession {
+	clients := this.GetClients()
+	for i := 0; i < len(clients); i++ {
+		if clients[i].Backend() == this.Backend {
+			return clients[i]
+		}
+	}
+	return nil
+}
+
+func (this *backendDrainer) GetName() string { return this.Name }
+func (this *backendDrainer) Run() error {
+	OnBackendDrainChanged(this.Backend.Name, false)
+
+	ticker := time.NewTicker(this.Settings.Interval)
+	defer ticker.Stop()
+
+	for {
+		if this.Backend.AdminState() != BackendDraining {
+			// an operator enabled or disabled the backend
+			return nil
+		}
+
+		client := this.nextClient()
+		if client == nil && this.Backend.ActiveConnections() == 0 {
+			this.Backend.logger.Infof("Backend is drained, there is no connection to it")
+			OnBackendDrainChanged(this.Backend.Name, true)
+			return nil
+		}
+		if client != nil {
+			this.Backend.logger.Debugf("Disconnecting client `%s` of the draining backend", client.ClientID())
+			client.DisconnectWithReason(this.Settings.ReasonCode)
+		}
+
+		select {
+		case <-this.stopRequested:
+			return helpers.ErrServiceStopped
+		case <-ticker.C:
+		}
+	}
+}
+func (this *backendDrainer) Shutdown() {
+	defer func() { recover() }()
+	close(this.stopRequested)
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"net"
+	"time"
 
 	"github.com/devops-simba/helpers"
 )
 
 type ClientHandler = func(conn net.Conn)
 
+// AddressFilterer is implemented by listeners that may reject clients before they are passed to the handler, for
+// example before WS upgrade
+type AddressFilterer interface {
+	SetAddressFilter(accept func(addr net.Addr) bool)
+}
+
 // MQTTEndpoint general representation of a MQTT endpoint.
 type MQTTEndpoint interface {
 	// IsSecure Return ``true`` if this connector is secure and ``false`` otherwise
@@ -32,14 +39,27 @@ type MQTTServerEndpoint interface {
 type MQTTClientEndpoint interface {
 	MQTTEndpoint
 
-	// Connect connect to the target of this endpoint
-	Connect(serviceName, backendName string) (net.Conn, error)
+	// Connect connect to the target of this endpoint, `clientAddr` is address of the client that this connection
+	// is made for and `frontendAddr` is the address that client is connected to. They are `nil` for connections
+	// of the proxy itself(for example health checks). `timeout` limit time of connecting and setting up the
+	// connection(PROXY header, TLS and WS handshakes)
+	Connect(serviceName, backendName string, clientAddr, frontendAddr net.Addr, timeout time.Duration) (net.Conn, error)
 }
 
 type MQTTServerEndpointConfig struct {
 	TlsServerConfiguration `yaml:",inline"`
 	// Address address of the endpoint(address that we should listen on)
 	Address string `yaml:"address"`
+	// ProxyProtocol read HAProxy PROXY protocol header of the connections, so clients have their real address
+	ProxyProtocol *ProxyProtocolConfig `yaml:"proxyProtocol,omitempty"`
+	// Socket permission and owner of the socket file, it is only valid for unix sockets
+	Socket *UnixSocketConfig `yaml:"socket,omitempty"`
+	// VirtualHost only accept WS requests whose `Host` is this name, so WS frontends may share an address and path
+	VirtualHost string `yaml:"virtualHost,omitempty"`
+	// TrustedProxies networks of the HTTP proxies whose `X-Forwarded-For` is used as address of the WS clients
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	// HandshakeTimeout maximum time of the TLS handshake and WS upgrade of the clients, default is 10s
+	HandshakeTimeout *time.Duration `yaml:"handshakeTimeout,omitempty"`
 }
 
 type MQTTClientEndpointConfig struct {
@@ -47,6 +67,9 @@ type MQTTClientEndpointConfig struct {
 	Address string `yaml:"address"`
 	// ConnectionCertificate if this is a secure connection, this is certificate that we should use to connect to the backend
 	ConnectionCertificate *CertificateInformation `yaml:"connectionCertificate,omitempty"`
+	// ProxyProtocol send address of the clients to the backend, `v1` or `v2` PROXY header for MQTT backends and
+	// `X-Forwarded-For`/`Forwarded` headers for WS backends
+	ProxyProtocol ProxyProtocolVersion `yaml:"proxyProtocol,omitempty"`
 }
 
 type MQTTEndpointFactory interface {
@@ -65,7 +88,10 @@ const (
 	InvalidBackendAddress         = helpers.StringError("Invalid backend address")
 	TlsInfoIsOnlyForSecureSchemes = helpers.StringError(
 		"Certificate and client validation is only available for secure schemes")
-	MissingTlsInfoForSecureScheme = helpers.StringError("Missing TLS certificate for secure scheme")
+	MissingTlsInfoForSecureScheme  = helpers.StringError("Missing TLS certificate for secure scheme")
+	SocketInfoIsOnlyForUnixSchemes = helpers.StringError("Socket settings are only available for unix sockets")
+	VirtualHostIsOnlyForWebSocket  = helpers.StringError("Virtual host is only available for WebSocket")
+	ProxiesAreOnlyForWebSocket     = helpers.StringError("Trusted proxies are only available for WebSocket")
 )
 
 func RegisterEndpointFactory(factory MQTTEndpointFactory) {
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+//region GLOBALS
+const (
+	UnknownSniffedProtocol = helpers.StringError("Connection is not MQTT, TLS or HTTP")
+	TlsIsNotConfigured     = helpers.StringError("Connection started TLS, but frontend has no certificate")
+	TlsIsRequired          = helpers.StringError("Connection did not start TLS, but frontend requires client certificates")
+)
+
+func init() {
+	RegisterEndpointFactory(auto_EndpointFactory(true))
+}
+
+//endregion
+
+//region sniffing
+type sniffedProtocol int
+
+const (
+	sniffedUnknown sniffedProtocol = iota
+	sniffedMQTT
+	sniffedTLS
+	sniffedHTTP
+)
+
+func (this sniffedProtocol) String() string {
+	switch this {
+	case sniffedMQTT:
+		return "mqtt"
+	case sniffedTLS:
+		return "tls"
+	case sniffedHTTP:
+		return "http"
+	default:
+		return "unknown"
+	}
+}
+
+// sniffedConn is a connection whose first bytes are peeked to find its protocol
+type sniffedConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	tlsState *tls.ConnectionState
+}
+
+func (this *sniffedConn) Read(b []byte) (int, error) { return this.reader.Read(b) }
+
+// ConnectionState TLS state of the connection, it is empty if connection is not secure
+func (this *sniffedConn) ConnectionState() tls.ConnectionState {
+	if this.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *this.tlsState
+}
+
+// sniffConnection peek first bytes of a connection and detect its protocol
+func sniffConnection(conn net.Conn) (*sniffedConn, sniffedProtocol, error) {
+	result := &sniffedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		result.tlsState = &state
+	}
+
+	first, err := result.reader.Peek(1)
+	if err != nil {
+		return nil, sniffedUnknown, err
+	}
+	switch first[0] {
+	case byte(PacketConnect) << 4:
+		return result, sniffedMQTT, nil
+	case 0x16: // TLS handshake record
+		if header, err := result.reader.Peek(2); err == nil && header[1] == 0x03 {
+			return result, sniffedTLS, nil
+		}
+	case 'G':
+		if method, err := result.reader.Peek(4); err == nil && string(method) == "GET " {
+			return result, sniffedHTTP, nil
+		}
+	}
+	return result, sniffedUnknown, nil
+}
+
+// requestTLSState TLS state of a HTTP request, requests of `auto` listeners keep it in their context
+func requestTLSState(r *http.Request) *tls.ConnectionState {
+	if r.TLS != nil {
+		return r.TLS
+	}
+	state, _ := r.Context().Value(tlsStateContextKey{}).(*tls.ConnectionState)
+	return state
+}
+
+type tlsStateContextKey struct{}
+
+//endregion
+
+//region connListener
+// connListener is a listener whose connections are delivered by another listener
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// deliver pass a connection to `Accept`, it return `false` if listener is closed
+func (this *connListener) deliver(conn net.Conn) bool {
+	select {
+	case this.conns <- conn:
+		return true
+	case <-this.done:
+		return false
+	}
+}
+
+func (this *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+	case <-this.done:
+		return nil, ListenerClosed
+	}
+}
+func (this *connListener) Close() error {
+	this.closeOnce.Do(func() { close(this.done) })
+	return nil
+}
+func (this *connListener) Addr() net.Addr { return this.addr }
+
+//endregion
+
+//region auto_Listener
+type auto_Listener struct {
+	Name             string
+	Path             string
+	VirtualHost      string
+	ListenAddress    string
+	Logger           helpers.Logger
+	TlsConfig        *TlsServerConfiguration
+	ProxyProtocol    *proxyProtocolSettings
+	TrustedProxies   []*net.IPNet
+	HandshakeTimeout time.Duration
+	AcceptAddress    func(addr net.Addr) bool
+	Handler          ClientHandler
+	Stopped          chan struct{}
+
+	listener   net.Listener
+	tlsConfig  *tls.Config
+	httpConns  *connListener
+	httpServer *http.Server
+}
+
+// sniff detect protocol of a connection and pass it to the handler of that protocol, TLS connections are
+// terminated and sniffed again. Both sniffing and the TLS handshake must be finished in the handshake timeout
+func (this *auto_Listener) sniff(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(this.HandshakeTimeout))
+	stage := HandshakeStageSniff
+	sniffed, protocol, err := sniffConnection(conn)
+	if err == nil && protocol != sniffedTLS && this.TlsConfig.RequireClientValidation {
+		// plain connections would skip validation of the client certificate
+		err = TlsIsRequired
+	} else if err == nil && protocol == sniffedTLS {
+		if this.tlsConfig == nil {
+			err = TlsIsNotConfigured
+		} else {
+			stage = HandshakeStageTLS
+			tlsConn := tls.Server(sniffed, this.tlsConfig)
+			if err = tlsConn.Handshake(); err == nil {
+				stage = HandshakeStageSniff
+				sniffed, protocol, err = sniffConnection(tlsConn)
+				if err == nil && protocol == sniffedTLS {
+					protocol = sniffedUnknown
+				}
+			}
+		}
+	}
+	if err == nil && protocol == sniffedUnknown {
+		err = UnknownSniffedProtocol
+	}
+	if err != nil {
+		if isTimeout(err) {
+			OnHandshakeTimeout(this.ListenAddress, stage)
+		}
+		this.Logger.Warnf("%v) Failed to detect protocol of the connection: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	this.Logger.Verbosef(10, "%v) Connection is detected as %v(secure: %v)",
+		conn.RemoteAddr(), protocol, sniffed.tlsState != nil)
+	switch protocol {
+	case sniffedMQTT:
+		this.Handler(sniffed)
+	case sniffedHTTP:
+		if !this.httpConns.deliver(sniffed) {
+			sniffed.Close()
+		}
+	}
+}
+
+// SetAddressFilter reject WS requests of the addresses that are not accepted by the filter before upgrade
+func (this *auto_Listener) SetAddressFilter(accept func(addr net.Addr) bool) {
+	this.AcceptAddress = accept
+}
+
+// Listen bind address of the listener and create its HTTP server, so `Shutdown` has everything that it must stop.
+// `Run` call it if it is not called before
+func (this *auto_Listener) Listen() error {
+	var err error
+	if this.TlsConfig.IsSecure() {
+		if this.tlsConfig, err = this.TlsConfig.LoadAsTlsConfig(); err != nil {
+			return err
+		}
+	}
+
+	this.listener, err = listenTCP(this.ListenAddress, this.ProxyProtocol, this.Logger)
+	if err != nil {
+		return err
+	}
+
+	// WS connections are upgraded by a HTTP server that only receive sniffed connections
+	ws := &ws_Listener{
+		Name:             this.Name,
+		Path:             this.Path,
+		VirtualHost:      this.VirtualHost,
+		Logger:           this.Logger,
+		TrustedProxies:   this.TrustedProxies,
+		HandshakeTimeout: this.HandshakeTimeout,
+		AcceptAddress:    this.AcceptAddress,
+		Handler:          this.Handler,
+	}
+	this.httpConns = newConnListener(this.listener.Addr())
+	router := &wsRouter{Logger: this.Logger, routes: []*ws_Listener{ws}}
+	this.httpServer = newWsHTTPServer(router, this.ListenAddress, this.HandshakeTimeout)
+	this.httpServer.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if conn, ok := c.(*sniffedConn); ok && conn.tlsState != nil {
+			return context.WithValue(ctx, tlsStateContextKey{}, conn.tlsState)
+		}
+		return ctx
+	}
+	return nil
+}
+
+func (this *auto_Listener) GetName() string { return this.Name }
+func (this *auto_Listener) Run() error {
+	if this.listener == nil {
+		if err := this.Listen(); err != nil {
+			return err
+		}
+	}
+	defer this.listener.Close()
+
+	go this.httpServer.Serve(this.httpConns)
+	defer this.httpServer.Close()
+
+	return serveConnections(this.listener, this.Stopped, this.Logger, this.sniff)
+}
+func (this *auto_Listener) Shutdown() {
+	defer func() {
+		// listener and HTTP server are only missing if `Listen` failed
+		if r := recover(); r == nil && this.listener != nil {
+			this.listener.Close()
+			this.httpServer.Shutdown(context.Background())
+		}
+	}()
+	close(this.Stopped)
+}
+
+//endregion
+
+//region auto_ServerEndpoint
+type auto_ServerEndpoint struct {
+	// ListenAddress address that we should listen on it
+	ListenAddress *url.URL
+	// TlsConfig TLS connections are only accepted if it has a certificate
+	TlsConfig TlsServerConfiguration
+	// ProxyProtocol settings of PROXY protocol, it is `nil` if PROXY protocol is disabled
+	ProxyProtocol *proxyProtocolSettings
+	// VirtualHost only WS requests with this host are accepted, it is empty if every host is accepted
+	VirtualHost string
+	// TrustedProxies networks of the HTTP proxies whose `X-Forwarded-For` is trusted
+	TrustedProxies []*net.IPNet
+	// HandshakeTimeout maximum time of sniffing, TLS handshake and WS upgrade of the clients
+	HandshakeTimeout time.Duration
+}
+
+func (this *auto_ServerEndpoint) IsSecure() bool      { return this.TlsConfig.IsSecure() }
+func (this *auto_ServerEndpoint) GetProtocol() string { return "auto" }
+func (this *auto_ServerEndpoint) GetAddress() string {
+	host := GetUrlHostname(this.ListenAddress)
+	port := GetUrlPort(this.ListenAddress)
+	path := GetUrlDirPath(this.ListenAddress)
+	return fmt.Sprintf("%s://%s:%s%s", this.ListenAddress.Scheme, host, port, path)
+}
+func (this *auto_ServerEndpoint) CreateListenService(serviceName, frontendName string, handler ClientHandler) helpers.Service {
+	name := fmt.Sprintf("%s/%s/auto-listener[%s]", serviceName, frontendName, this.GetAddress())
+	return &auto_Listener{
+		Name:             name,
+		Path:             GetUrlDirPath(this.ListenAddress),
+		VirtualHost:      this.VirtualHost,
+		TrustedProxies:   this.TrustedProxies,
+		HandshakeTimeout: this.HandshakeTimeout,
+		ListenAddress:    net.JoinHostPort(GetUrlHostname(this.ListenAddress), GetUrlPort(this.ListenAddress)),
+		Logger:           CreateLogger(name),
+		TlsConfig:        &this.TlsConfig,
+		ProxyProtocol:    this.ProxyProtocol,
+		Handler:          handler,
+		Stopped:          make(chan struct{}),
+	}
+}
+
+//endregion
+
+//region auto_EndpointFactory
+type auto_EndpointFactory bool
+
+func (this auto_EndpointFactory) CreateServerEndpoint(config MQTTServerEndpointConfig) (MQTTServerEndpoint, error) {
+	// addresses without scheme belong to `mqtt`, so only explicit `auto://` addresses are claimed
+	if !strings.HasPrefix(config.Address, "auto://") {
+		return nil, nil
+	}
+	var u *url.URL
+	var err error
+	if u, err = ParseUrl(config.Address, "auto"); err != nil {
+		return nil, err
+	}
+	if config.Socket != nil {
+		return nil, SocketInfoIsOnlyForUnixSchemes
+	}
+	if config.Certificate == nil && config.RequireClientValidation {
+		return nil, MissingTlsInfoForSecureScheme
+	}
+	proxyProtocol, err := newProxyProtocolSettings(config.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid trusted proxy: %w", err)
+	}
+	handshakeTimeout, err := newHandshakeTimeout(config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auto_ServerEndpoint{
+		ListenAddress:    u,
+		TlsConfig:        config.TlsServerConfiguration,
+		ProxyProtocol:    proxyProtocol,
+		VirtualHost:      strings.ToLower(config.VirtualHost),
+		TrustedProxies:   trustedProxies,
+		HandshakeTimeout: handshakeTimeout,
+	}, nil
+}
+
+// CreateClientEndpoint `auto` is only available for frontends
+func (this auto_EndpointFactory) CreateClientEndpoint(config MQTTClientEndpointConfig) (MQTTClientEndpoint, error) {
+	return nil, nil
+}
+
+//endregion
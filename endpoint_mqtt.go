@@ -26,6 +26,8 @@ type mqtt_ClientEndpoint struct {
 	// Certificate that we should use to connect to server.
 	// This is only valid in case of WSS.
 	Certificate *CertificateInformation
+	// ProxyProtocol version of the PROXY header that we send before MQTT data, empty if we should not send it
+	ProxyProtocol ProxyProtocolVersion
 }
 
 func (this *mqtt_ClientEndpoint) IsSecure() bool      { return this.ServerAddress.Scheme == "mqtts" }
@@ -35,65 +37,144 @@ func (this *mqtt_ClientEndpoint) GetAddress() string {
 	port := GetUrlPort(this.ServerAddress)
 	return fmt.Sprintf("%s://%s:%s", this.ServerAddress.Scheme, host, port)
 }
-func (this *mqtt_ClientEndpoint) Connect(serviceName, backendName string) (net.Conn, error) {
-	addr := net.JoinHostPort(GetUrlHostname(this.ServerAddress), GetUrlPort(this.ServerAddress))
+func (this *mqtt_ClientEndpoint) Connect(
+	serviceName, backendName string,
+	clientAddr, frontendAddr net.Addr,
+	timeout time.Duration,
+) (net.Conn, error) {
+	host := GetUrlHostname(this.ServerAddress)
+	addr := net.JoinHostPort(host, GetUrlPort(this.ServerAddress))
+
+	var tlsConfig *tls.Config
 	if this.IsSecure() {
 		cert, err := this.Certificate.Load()
 		if err != nil {
 			return nil, err
 		}
 
-		return tls.Dial("tcp", addr, &tls.Config{
+		tlsConfig = &tls.Config{
+			ServerName:   host,
 			Certificates: []tls.Certificate{cert},
-		})
-	} else {
-		return net.Dial("tcp", addr)
+		}
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
 	}
+	return setupBackendConnection(conn, this.ProxyProtocol, clientAddr, frontendAddr, tlsConfig, timeout)
+}
+
+// setupBackendConnection send PROXY header of the client and then start the TLS handshake, if they are enabled.
+// PROXY header must be sent before the TLS handshake, both of them must finish in `timeout`
+func setupBackendConnection(
+	conn net.Conn,
+	proxyProtocol ProxyProtocolVersion,
+	clientAddr net.Addr,
+	frontendAddr net.Addr,
+	tlsConfig *tls.Config,
+	timeout time.Duration,
+) (net.Conn, error) {
+	if proxyProtocol == "" && tlsConfig == nil {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxyProtocol != "" {
+		if err := writeProxyProtocolHeader(conn, proxyProtocol, clientAddr, frontendAddr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if tlsConfig == nil {
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
 //endregion
 
 //region mqtt_Listener
 type mqtt_Listener struct {
-	Name          string
-	Secure        bool
-	ListenAddress string
-	Logger        helpers.Logger
-	TlsConfig     *TlsServerConfiguration
-	Handler       ClientHandler
-	Stopped       chan struct{}
+	Name             string
+	Secure           bool
+	ListenAddress    string
+	Logger           helpers.Logger
+	TlsConfig        *TlsServerConfiguration
+	ProxyProtocol    *proxyProtocolSettings
+	HandshakeTimeout time.Duration
+	Handler          ClientHandler
+	Stopped          chan struct{}
 
 	listener net.Listener
 }
 
 func (this *mqtt_Listener) newListener() error {
+	var tlsConfig *tls.Config
 	var err error
 	if this.Secure {
-		var tlsConfig *tls.Config
-		tlsConfig, err = this.TlsConfig.LoadAsTlsConfig()
-		if err == nil {
-			this.listener, err = tls.Listen("tcp", this.ListenAddress, tlsConfig)
+		if tlsConfig, err = this.TlsConfig.LoadAsTlsConfig(); err != nil {
+			return err
 		}
-	} else {
-		this.listener, err = net.Listen("tcp", this.ListenAddress)
 	}
-	return err
+
+	// PROXY header is sent before TLS handshake, so TLS listener must wrap the PROXY protocol listener
+	this.listener, err = listenTCP(this.ListenAddress, this.ProxyProtocol, this.Logger)
+	if err != nil {
+		return err
+	}
+	if this.Secure {
+		this.listener = newTLSListener(this.listener, tlsConfig, this.HandshakeTimeout, this.ListenAddress, this.Logger)
+	}
+	return nil
 }
 
+// Listen bind address of the listener, `Run` call it if it is not called before
+func (this *mqtt_Listener) Listen() error { return this.newListener() }
+
 func (this *mqtt_Listener) GetName() string { return this.Name }
 func (this *mqtt_Listener) Run() error {
-	var err error
-	if err = this.newListener(); err != nil {
-		return err
+	if this.listener == nil {
+		if err := this.newListener(); err != nil {
+			return err
+		}
 	}
 	defer this.listener.Close()
 
+	return serveConnections(this.listener, this.Stopped, this.Logger, this.Handler)
+}
+func (this *mqtt_Listener) Shutdown() {
+	defer func() {
+		if r := recover(); r == nil {
+			this.listener.Close()
+		}
+	}()
+	close(this.Stopped)
+}
+
+// serveConnections accept connections of a listener until `stopped` is closed, temporary errors are retried with
+// a back-off
+func serveConnections(
+	listener net.Listener,
+	stopped <-chan struct{},
+	logger helpers.Logger,
+	handler ClientHandler,
+) error {
 	var tempDelay time.Duration
 	for {
-		conn, err := this.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
-			case <-this.Stopped:
+			case <-stopped:
 				return helpers.ErrServiceStopped
 			default:
 			}
@@ -109,32 +190,24 @@ func (this *mqtt_Listener) Run() error {
 					tempDelay = maxTemporaryNetworkDelay
 				}
 
-				this.Logger.Verbosef(8, "Accept returned a temporary error: %v; retrying in %v", err, tempDelay)
+				logger.Verbosef(8, "Accept returned a temporary error: %v; retrying in %v", err, tempDelay)
 				timedOut := time.After(tempDelay)
 				select {
-				case <-this.Stopped:
+				case <-stopped:
 					return helpers.ErrServiceStopped
 				case <-timedOut:
 				}
 				continue
 			} else {
-				this.Logger.Errorf("Accept returned an error: %v; Stopping accept loop", err)
+				logger.Errorf("Accept returned an error: %v; Stopping accept loop", err)
 				return err
 			}
 		}
 
 		tempDelay = 0
-		go this.Handler(conn)
+		go handler(conn)
 	}
 }
-func (this *mqtt_Listener) Shutdown() {
-	defer func() {
-		if r := recover(); r == nil {
-			this.listener.Close()
-		}
-	}()
-	close(this.Stopped)
-}
 
 //endregion
 
@@ -144,6 +217,10 @@ type mqtt_ServerEndpoint struct {
 	ListenAddress *url.URL
 	// Certificate
 	TlsConfig TlsServerConfiguration
+	// ProxyProtocol settings of PROXY protocol, it is `nil` if PROXY protocol is disabled
+	ProxyProtocol *proxyProtocolSettings
+	// HandshakeTimeout maximum time of the TLS handshake of the clients
+	HandshakeTimeout time.Duration
 }
 
 func (this *mqtt_ServerEndpoint) IsSecure() bool      { return this.ListenAddress.Scheme == "mqtts" }
@@ -156,13 +233,15 @@ func (this *mqtt_ServerEndpoint) GetAddress() string {
 func (this *mqtt_ServerEndpoint) CreateListenService(serviceName, frontendName string, handler ClientHandler) helpers.Service {
 	name := fmt.Sprintf("%s/%s/mqtt-listener[%s]", serviceName, frontendName, this.GetAddress())
 	return &mqtt_Listener{
-		Name:          name,
-		Secure:        this.IsSecure(),
-		ListenAddress: net.JoinHostPort(GetUrlHostname(this.ListenAddress), GetUrlPort(this.ListenAddress)),
-		Logger:        CreateLogger(name),
-		TlsConfig:     &this.TlsConfig,
-		Handler:       handler,
-		Stopped:       make(chan struct{}),
+		Name:             name,
+		Secure:           this.IsSecure(),
+		ListenAddress:    net.JoinHostPort(GetUrlHostname(this.ListenAddress), GetUrlPort(this.ListenAddress)),
+		Logger:           CreateLogger(name),
+		TlsConfig:        &this.TlsConfig,
+		ProxyProtocol:    this.ProxyProtocol,
+		HandshakeTimeout: this.HandshakeTimeout,
+		Handler:          handler,
+		Stopped:          make(chan struct{}),
 	}
 }
 
@@ -177,21 +256,43 @@ func (this mqtt_EndpointFactory) CreateServerEndpoint(config MQTTServerEndpointC
 	if u, err = ParseUrl(config.Address, "mqtt"); err != nil {
 		return nil, err
 	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+		return nil, nil
+	}
+	if config.Socket != nil {
+		return nil, SocketInfoIsOnlyForUnixSchemes
+	}
+	if config.VirtualHost != "" {
+		return nil, VirtualHostIsOnlyForWebSocket
+	}
+	if len(config.TrustedProxies) != 0 {
+		return nil, ProxiesAreOnlyForWebSocket
+	}
+	proxyProtocol, err := newProxyProtocolSettings(config.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	handshakeTimeout, err := newHandshakeTimeout(config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
 
 	switch u.Scheme {
 	case "mqtt":
 		if config.Certificate != nil || config.RequireClientValidation {
 			return nil, TlsInfoIsOnlyForSecureSchemes
 		}
-		return &mqtt_ServerEndpoint{ListenAddress: u}, nil
+		return &mqtt_ServerEndpoint{ListenAddress: u, ProxyProtocol: proxyProtocol}, nil
 
 	case "mqtts":
 		if config.Certificate == nil {
 			return nil, MissingTlsInfoForSecureScheme
 		}
 		return &mqtt_ServerEndpoint{
-			ListenAddress: u,
-			TlsConfig:     config.TlsServerConfiguration,
+			ListenAddress:    u,
+			TlsConfig:        config.TlsServerConfiguration,
+			ProxyProtocol:    proxyProtocol,
+			HandshakeTimeout: handshakeTimeout,
 		}, nil
 
 	default:
@@ -204,6 +305,9 @@ func (this mqtt_EndpointFactory) CreateClientEndpoint(config MQTTClientEndpointC
 	if u, err = ParseUrl(config.Address, "mqtt"); err != nil {
 		return nil, err
 	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+		return nil, nil
+	}
 	if GetUrlHostname(u) == "0.0.0.0" {
 		return nil, InvalidBackendAddress
 	}
@@ -215,7 +319,14 @@ func (this mqtt_EndpointFactory) CreateClientEndpoint(config MQTTClientEndpointC
 		}
 		fallthrough
 	case "mqtts":
-		return &mqtt_ClientEndpoint{ServerAddress: u, Certificate: config.ConnectionCertificate}, nil
+		if err = config.ProxyProtocol.validate(); err != nil {
+			return nil, err
+		}
+		return &mqtt_ClientEndpoint{
+			ServerAddress: u,
+			Certificate:   config.ConnectionCertificate,
+			ProxyProtocol: config.ProxyProtocol,
+		}, nil
 
 	default:
 		return nil, nil
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+//region GLOBALS
+const (
+	// server name that is used to verify certificate of `unixs` backends
+	unixServerName = "localhost"
+
+	MissingSocketPath     = helpers.StringError("Missing path of the unix socket")
+	SocketFileInUse       = helpers.StringError("Socket file is in use by another process")
+	SocketFileIsNotSocket = helpers.StringError("File exists and it is not a socket")
+)
+
+func init() {
+	RegisterEndpointFactory(unix_EndpointFactory(true))
+}
+
+//endregion
+
+//region unix socket settings
+type UnixSocketConfig struct {
+	// Mode permissions of the socket file in octal, for example `0660`
+	Mode string `yaml:"mode,omitempty"`
+	// Owner name or ID of the user that should own the socket file
+	Owner string `yaml:"owner,omitempty"`
+	// Group name or ID of the group of the socket file
+	Group string `yaml:"group,omitempty"`
+}
+
+type unixSocketSettings struct {
+	// Mode permissions of the socket file, 0 if it should not be changed
+	Mode os.FileMode
+	// UID owner of the socket file, -1 if it should not be changed
+	UID int
+	// GID group of the socket file, -1 if it should not be changed
+	GID int
+}
+
+// newUnixSocketSettings validate the config, or return `nil` if config is `nil`
+func newUnixSocketSettings(config *UnixSocketConfig) (*unixSocketSettings, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	result := &unixSocketSettings{UID: -1, GID: -1}
+	if config.Mode != "" {
+		mode, err := strconv.ParseUint(config.Mode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return nil, fmt.Errorf("Invalid socket mode: %s", config.Mode)
+		}
+		result.Mode = os.FileMode(mode)
+	}
+	if config.Owner != "" {
+		uid, err := strconv.Atoi(config.Owner)
+		if err != nil {
+			u, err := user.Lookup(config.Owner)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid socket owner: %w", err)
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return nil, fmt.Errorf("Invalid socket owner: %w", err)
+			}
+		}
+		result.UID = uid
+	}
+	if config.Group != "" {
+		gid, err := strconv.Atoi(config.Group)
+		if err != nil {
+			g, err := user.LookupGroup(config.Group)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid socket group: %w", err)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return nil, fmt.Errorf("Invalid socket group: %w", err)
+			}
+		}
+		result.GID = gid
+	}
+	return result, nil
+}
+
+func (this *unixSocketSettings) apply(path string) error {
+	if this.Mode != 0 {
+		if err := os.Chmod(path, this.Mode); err != nil {
+			return err
+		}
+	}
+	if this.UID != -1 || this.GID != -1 {
+		if err := os.Chown(path, this.UID, this.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unixSocketPath path of the socket of an `unix://` URL, both `unix:///abs/path` and `unix://relative/path` are
+// supported
+func unixSocketPath(u *url.URL) string { return u.Host + u.Path }
+
+// removeStaleSocket remove socket file of a previous run of the proxy, a socket file that still accepts
+// connections is never removed
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s", SocketFileIsNotSocket, path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%w: %s", SocketFileInUse, path)
+	}
+	return os.Remove(path)
+}
+
+//endregion
+
+//region unix_ClientEndpoint
+type unix_ClientEndpoint struct {
+	// ServerAddress Address of the server that we should connect to it
+	ServerAddress *url.URL
+	// Certificate that we should use to connect to server.
+	// This is only valid in case of UNIXS.
+	Certificate *CertificateInformation
+	// ProxyProtocol version of the PROXY header that we send before MQTT data, empty if we should not send it
+	ProxyProtocol ProxyProtocolVersion
+}
+
+func (this *unix_ClientEndpoint) IsSecure() bool      { return this.ServerAddress.Scheme == "unixs" }
+func (this *unix_ClientEndpoint) GetProtocol() string { return "unix" }
+func (this *unix_ClientEndpoint) GetAddress() string {
+	return fmt.Sprintf("%s://%s", this.ServerAddress.Scheme, unixSocketPath(this.ServerAddress))
+}
+func (this *unix_ClientEndpoint) Connect(
+	serviceName, backendName string,
+	clientAddr, frontendAddr net.Addr,
+	timeout time.Duration,
+) (net.Conn, error) {
+	var tlsConfig *tls.Config
+	if this.IsSecure() {
+		cert, err := this.Certificate.Load()
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = &tls.Config{
+			ServerName:   unixServerName,
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("unix", unixSocketPath(this.ServerAddress))
+	if err != nil {
+		return nil, err
+	}
+	return setupBackendConnection(conn, this.ProxyProtocol, clientAddr, frontendAddr, tlsConfig, timeout)
+}
+
+//endregion
+
+//region unix_Listener
+type unix_Listener struct {
+	Name             string
+	Secure           bool
+	Path             string
+	Logger           helpers.Logger
+	TlsConfig        *TlsServerConfiguration
+	Socket           *unixSocketSettings
+	ProxyProtocol    *proxyProtocolSettings
+	HandshakeTimeout time.Duration
+	Handler          ClientHandler
+	Stopped          chan struct{}
+
+	listener net.Listener
+}
+
+func (this *unix_Listener) newListener() error {
+	var tlsConfig *tls.Config
+	var err error
+	if this.Secure {
+		if tlsConfig, err = this.TlsConfig.LoadAsTlsConfig(); err != nil {
+			return err
+		}
+	}
+
+	if err = removeStaleSocket(this.Path); err != nil {
+		return err
+	}
+	// socket file is removed when the listener is closed
+	this.listener, err = net.Listen("unix", this.Path)
+	if err != nil {
+		return err
+	}
+	if this.Socket != nil {
+		if err = this.Socket.apply(this.Path); err != nil {
+			this.listener.Close()
+			return fmt.Errorf("Failed to set permissions of the socket file: %w", err)
+		}
+	}
+
+	if this.ProxyProtocol != nil {
+		this.listener = newProxyProtocolListener(this.listener, this.ProxyProtocol, this.Logger)
+	}
+	if this.Secure {
+		this.listener = newTLSListener(this.listener, tlsConfig, this.HandshakeTimeout, this.Path, this.Logger)
+	}
+	return nil
+}
+
+// Listen bind address of the listener, `Run` call it if it is not called before
+func (this *unix_Listener) Listen() error { return this.newListener() }
+
+func (this *unix_Listener) GetName() string { return this.Name }
+func (this *unix_Listener) Run() error {
+	if this.listener == nil {
+		if err := this.newListener(); err != nil {
+			return err
+		}
+	}
+	defer this.listener.Close()
+
+	return serveConnections(this.listener, this.Stopped, this.Logger, this.Handler)
+}
+func (this *unix_Listener) Shutdown() {
+	defer func() {
+		if r := recover(); r == nil {
+			this.listener.Close()
+		}
+	}()
+	close(this.Stopped)
+}
+
+//endregion
+
+//region unix_ServerEndpoint
+type unix_ServerEndpoint struct {
+	// ListenAddress address that we should listen on it
+	ListenAddress *url.URL
+	// Certificate
+	TlsConfig TlsServerConfiguration
+	// Socket permission and owner of the socket file, it is `nil` if they should not be changed
+	Socket *unixSocketSettings
+	// ProxyProtocol settings of PROXY protocol, it is `nil` if PROXY protocol is disabled
+	ProxyProtocol *proxyProtocolSettings
+	// HandshakeTimeout maximum time of the TLS handshake of the clients
+	HandshakeTimeout time.Duration
+}
+
+func (this *unix_ServerEndpoint) IsSecure() bool      { return this.ListenAddress.Scheme == "unixs" }
+func (this *unix_ServerEndpoint) GetProtocol() string { return "unix" }
+func (this *unix_ServerEndpoint) GetAddress() string {
+	return fmt.Sprintf("%s://%s", this.ListenAddress.Scheme, unixSocketPath(this.ListenAddress))
+}
+func (this *unix_ServerEndpoint) CreateListenService(serviceName, frontendName string, handler ClientHandler) helpers.Service {
+	name := fmt.Sprintf("%s/%s/unix-listener[%s]", serviceName, frontendName, this.GetAddress())
+	return &unix_Listener{
+		Name:             name,
+		Secure:           this.IsSecure(),
+		Path:             unixSocketPath(this.ListenAddress),
+		Logger:           CreateLogger(name),
+		TlsConfig:        &this.TlsConfig,
+		Socket:           this.Socket,
+		ProxyProtocol:    this.ProxyProtocol,
+		HandshakeTimeout: this.HandshakeTimeout,
+		Handler:          handler,
+		Stopped:          make(chan struct{}),
+	}
+}
+
+//endregion
+
+//region unix_EndpointFactory
+type unix_EndpointFactory bool
+
+func (this unix_EndpointFactory) CreateServerEndpoint(config MQTTServerEndpointConfig) (MQTTServerEndpoint, error) {
+	var u *url.URL
+	var err error
+	if u, err = ParseUrl(config.Address, "unix"); err != nil {
+		return nil, err
+	}
+	if u.Scheme != "unix" && u.Scheme != "unixs" {
+		return nil, nil
+	}
+	if unixSocketPath(u) == "" {
+		return nil, MissingSocketPath
+	}
+	if config.VirtualHost != "" {
+		return nil, VirtualHostIsOnlyForWebSocket
+	}
+	if len(config.TrustedProxies) != 0 {
+		return nil, ProxiesAreOnlyForWebSocket
+	}
+	socket, err := newUnixSocketSettings(config.Socket)
+	if err != nil {
+		return nil, err
+	}
+	proxyProtocol, err := newProxyProtocolSettings(config.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	handshakeTimeout, err := newHandshakeTimeout(config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if config.Certificate != nil || config.RequireClientValidation {
+			return nil, TlsInfoIsOnlyForSecureSchemes
+		}
+		return &unix_ServerEndpoint{ListenAddress: u, Socket: socket, ProxyProtocol: proxyProtocol}, nil
+
+	case "unixs":
+		if config.Certificate == nil {
+			return nil, MissingTlsInfoForSecureScheme
+		}
+		return &unix_ServerEndpoint{
+			ListenAddress:    u,
+			TlsConfig:        config.TlsServerConfiguration,
+			Socket:           socket,
+			ProxyProtocol:    proxyProtocol,
+			HandshakeTimeout: handshakeTimeout,
+		}, nil
+
+	default:
+		return nil, nil
+	}
+}
+func (this unix_EndpointFactory) CreateClientEndpoint(config MQTTClientEndpointConfig) (MQTTClientEndpoint, error) {
+	var u *url.URL
+	var err error
+	if u, err = ParseUrl(config.Address, "unix"); err != nil {
+		return nil, err
+	}
+	if u.Scheme != "unix" && u.Scheme != "unixs" {
+		return nil, nil
+	}
+	if unixSocketPath(u) == "" {
+		return nil, MissingSocketPath
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if config.ConnectionCertificate != nil {
+			return nil, TlsInfoIsOnlyForSecureSchemes
+		}
+		fallthrough
+	case "unixs":
+		if err = config.ProxyProtocol.validate(); err != nil {
+			return nil, err
+		}
+		return &unix_ClientEndpoint{
+			ServerAddress: u,
+			Certificate:   config.ConnectionCertificate,
+			ProxyProtocol: config.ProxyProtocol,
+		}, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+//endregion
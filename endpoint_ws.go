@@ -9,6 +9,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,9 +20,15 @@ import (
 )
 
 //region GLOBALS
+const (
+	DuplicateWsRoute        = helpers.StringError("Two WS listeners have same path and virtual host")
+	IncompatibleWsListeners = helpers.StringError(
+		"WS listeners of an address must have same TLS, PROXY protocol and handshake timeout configuration")
+)
+
 var upgrader = websocket.Upgrader{
-	// Timeout for WS upgrade request handshake
-	HandshakeTimeout: 10 * time.Second,
+	// Timeout for WS upgrade request handshake, it is replaced by handshake timeout of the listener
+	HandshakeTimeout: defaultHandshakeTimeout,
 	// Paho JS client expecting header Sec-WebSocket-Protocol:mqtt in Upgrade response during handshake.
 	Subprotocols: []string{"mqttv3.1", "mqtt"},
 	// Allow CORS
@@ -42,6 +50,8 @@ type ws_ClientEndpoint struct {
 	// Certificate that we should use to connect to server.
 	// This is only valid in case of WSS.
 	Certificate *CertificateInformation
+	// ForwardClientAddress send address of the clients in `X-Forwarded-For` and `Forwarded` headers
+	ForwardClientAddress bool
 }
 
 func (this *ws_ClientEndpoint) IsSecure() bool      { return this.ServerAddress.Scheme == "wss" }
@@ -52,9 +62,14 @@ func (this *ws_ClientEndpoint) GetAddress() string {
 	path := GetUrlDirPath(this.ServerAddress)
 	return fmt.Sprintf("%s://%s:%s%s", this.ServerAddress.Scheme, host, port, path)
 }
-func (this *ws_ClientEndpoint) Connect(serviceName, backendName string) (net.Conn, error) {
+func (this *ws_ClientEndpoint) Connect(
+	serviceName, backendName string,
+	clientAddr, frontendAddr net.Addr,
+	timeout time.Duration,
+) (net.Conn, error) {
 	dialer := &websocket.Dialer{
-		Subprotocols: []string{"mqtt"},
+		Subprotocols:     []string{"mqtt"},
+		HandshakeTimeout: timeout,
 	}
 
 	if this.Certificate != nil {
@@ -67,7 +82,11 @@ func (this *ws_ClientEndpoint) Connect(serviceName, backendName string) (net.Con
 		}
 	}
 
-	conn, _, err := dialer.Dial(this.GetAddress(), nil)
+	var header http.Header
+	if this.ForwardClientAddress {
+		header = forwardedHeaders(clientAddr)
+	}
+	conn, _, err := dialer.Dial(this.GetAddress(), header)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to WS server: %v", err)
 	}
@@ -75,18 +94,58 @@ func (this *ws_ClientEndpoint) Connect(serviceName, backendName string) (net.Con
 	return &ws_Connection{Conn: conn}, nil
 }
 
+// forwardedHeaders create `X-Forwarded-For` and `Forwarded` headers for address of a client, it return `nil` if
+// address has no IP
+func forwardedHeaders(clientAddr net.Addr) http.Header {
+	if clientAddr == nil {
+		return nil
+	}
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return nil
+	}
+
+	forwarded := "for=" + ip.String()
+	if ip.To4() == nil {
+		// IPv6 addresses must be quoted and enclosed in brackets(RFC 7239)
+		forwarded = fmt.Sprintf("for=\"[%s]\"", ip)
+	}
+	return http.Header{
+		"X-Forwarded-For": []string{ip.String()},
+		"Forwarded":       []string{forwarded},
+	}
+}
+
 //endregion
 
 //region ws_Connection
 type ws_Connection struct {
 	*websocket.Conn
-	reader    io.Reader
-	readLock  sync.Mutex
-	writeLock sync.Mutex
+	reader     io.Reader
+	readLock   sync.Mutex
+	writeLock  sync.Mutex
+	tlsState   *tls.ConnectionState
+	remoteAddr net.Addr
+}
+
+func newWsConnection(conn *websocket.Conn, tlsState *tls.ConnectionState, remoteAddr net.Addr) *ws_Connection {
+	return &ws_Connection{Conn: conn, tlsState: tlsState, remoteAddr: remoteAddr}
+}
+
+// RemoteAddr address of the client, it is taken from `X-Forwarded-For` if request is received from a trusted proxy
+func (this *ws_Connection) RemoteAddr() net.Addr {
+	if this.remoteAddr != nil {
+		return this.remoteAddr
+	}
+	return this.Conn.RemoteAddr()
 }
 
-func newWsConnection(conn *websocket.Conn) *ws_Connection {
-	return &ws_Connection{Conn: conn}
+// ConnectionState TLS state of the HTTP request that is upgraded to this connection
+func (this *ws_Connection) ConnectionState() tls.ConnectionState {
+	if this.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *this.tlsState
 }
 func (this *ws_Connection) SetDeadline(t time.Time) error {
 	if err := this.SetReadDeadline(t); err != nil {
@@ -139,59 +198,327 @@ func (this *ws_Connection) Close() error { return this.Conn.Close() }
 
 //region ws_Listener
 type ws_Listener struct {
-	Name          string
-	Secure        bool
-	Logger        helpers.Logger
-	Path          string
-	ListenAddress string
-	TlsConfig     *TlsServerConfiguration
-	Handler       ClientHandler
-
-	httpServer *http.Server
+	Name             string
+	Secure           bool
+	Logger           helpers.Logger
+	Path             string
+	VirtualHost      string
+	ListenAddress    string
+	TlsConfig        *TlsServerConfiguration
+	ProxyProtocol    *proxyProtocolSettings
+	TrustedProxies   []*net.IPNet
+	HandshakeTimeout time.Duration
+	AcceptAddress    func(addr net.Addr) bool
+	Handler          ClientHandler
+	Stopped          chan struct{}
+
+	server *wsServer
 }
 
+// handleRequest upgrade a request that is routed to this listener
 func (this *ws_Listener) handleRequest(w http.ResponseWriter, r *http.Request) {
-	if rpath := GetUrlDirPath(r.URL); rpath != this.Path {
-		this.Logger.Warnf("ws request received from %s for an invalid path: Got: %v, Expected: %v",
-			r.RemoteAddr, rpath, this.Path)
-		http.Error(w, "Not Found", http.StatusNotFound)
+	remoteAddr := forwardedAddr(r, this.TrustedProxies)
+	if this.AcceptAddress != nil && !this.AcceptAddress(remoteAddr) {
+		this.Logger.Warnf("%v) Rejected WS request of a denied address", remoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	wsUpgrader := upgrader
+	wsUpgrader.HandshakeTimeout = this.HandshakeTimeout
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		this.Logger.Errorf("%v) Failed to upgrade to WS: %v", r.RemoteAddr, err)
 		return
 	}
 
-	conn := newWsConnection(ws)
+	conn := newWsConnection(ws, requestTLSState(r), remoteAddr)
 	this.Handler(conn)
 }
 
+// SetAddressFilter reject WS requests of the addresses that are not accepted by the filter before upgrade
+func (this *ws_Listener) SetAddressFilter(accept func(addr net.Addr) bool) {
+	this.AcceptAddress = accept
+}
+
+// forwardedAddr return address of the client of a request. If request is received from a trusted proxy, address is
+// taken from `X-Forwarded-For` and trusted proxies in that header are skipped
+func forwardedAddr(r *http.Request, trustedProxies []*net.IPNet) net.Addr {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	if len(trustedProxies) == 0 || !networksContain(trustedProxies, remoteAddr.IP) {
+		return remoteAddr
+	}
+
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	result := net.Addr(remoteAddr)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		result = &net.TCPAddr{IP: ip}
+		if !networksContain(trustedProxies, ip) {
+			break
+		}
+	}
+	return result
+}
+
+// Listen add the listener to the server of its address, `Run` call it if it is not called before
+func (this *ws_Listener) Listen() error {
+	server, err := acquireWsServer(this)
+	if err != nil {
+		return err
+	}
+	this.server = server
+	return nil
+}
+
 func (this *ws_Listener) GetName() string { return this.Name }
 func (this *ws_Listener) Run() error {
-	if this.Secure != this.TlsConfig.IsSecure() {
-		return helpers.StringError("Invalid TLS configuration")
+	if this.server == nil {
+		if err := this.Listen(); err != nil {
+			return err
+		}
+	}
+	server := this.server
+	defer server.release(this)
+
+	select {
+	case <-this.Stopped:
+		return helpers.ErrServiceStopped
+	case <-server.done:
+		return server.err
+	}
+}
+func (this *ws_Listener) Shutdown() {
+	defer func() { recover() }()
+	close(this.Stopped)
+}
+
+//endregion
+
+//region wsRouter
+// wsRouter route WS requests to the listeners by their path and virtual host, listeners without virtual host
+// accept requests of every host that has no listener of its own
+type wsRouter struct {
+	Logger helpers.Logger
+
+	guard  sync.RWMutex
+	routes []*ws_Listener
+}
+
+func (this *wsRouter) add(listener *ws_Listener) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	for i := 0; i < len(this.routes); i++ {
+		if this.routes[i].Path == listener.Path && this.routes[i].VirtualHost == listener.VirtualHost {
+			return fmt.Errorf("%w: `%s` and `%s`", DuplicateWsRoute, this.routes[i].Name, listener.Name)
+		}
+	}
+	this.routes = append(this.routes, listener)
+	return nil
+}
+
+// remove remove a listener and return number of the remaining listeners
+func (this *wsRouter) remove(listener *ws_Listener) int {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	routes := make([]*ws_Listener, 0, len(this.routes))
+	for i := 0; i < len(this.routes); i++ {
+		if this.routes[i] != listener {
+			routes = append(routes, this.routes[i])
+		}
+	}
+	this.routes = routes
+	return len(routes)
+}
+
+func (this *wsRouter) find(r *http.Request) *ws_Listener {
+	this.guard.RLock()
+	defer this.guard.RUnlock()
+
+	path := GetUrlDirPath(r.URL)
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var fallback *ws_Listener
+	for i := 0; i < len(this.routes); i++ {
+		route := this.routes[i]
+		if route.Path != path {
+			continue
+		}
+		if route.VirtualHost == "" {
+			fallback = route
+		} else if strings.EqualFold(route.VirtualHost, host) {
+			return route
+		}
+	}
+	return fallback
+}
+
+func (this *wsRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	listener := this.find(r)
+	if listener == nil {
+		this.Logger.Warnf("ws request received from %s for an invalid path: Got: %v, Host: %v",
+			r.RemoteAddr, GetUrlDirPath(r.URL), r.Host)
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
 	}
 
-	tlsConfig, err := this.TlsConfig.LoadAsTlsConfig()
+	listener.handleRequest(w, r)
+}
+
+//endregion
+
+//region wsServer
+var (
+	wsServersGuard sync.Mutex
+	// wsServers running HTTP servers of the WS listeners by their listen address
+	wsServers = make(map[string]*wsServer)
+)
+
+// wsServer is a HTTP server that is shared by all WS listeners of an address
+type wsServer struct {
+	Address          string
+	Secure           bool
+	TlsConfig        *TlsServerConfiguration
+	ProxyProtocol    *proxyProtocolSettings
+	HandshakeTimeout time.Duration
+	Router           *wsRouter
+
+	httpServer *http.Server
+	// done is closed when HTTP server is stopped, `err` is the reason
+	done chan struct{}
+	err  error
+}
+
+// acquireWsServer add a listener to the server of its address, server is started by its first listener
+func acquireWsServer(listener *ws_Listener) (*wsServer, error) {
+	wsServersGuard.Lock()
+	defer wsServersGuard.Unlock()
+
+	if server, ok := wsServers[listener.ListenAddress]; ok && !server.isStopped() {
+		if server.Secure != listener.Secure || server.HandshakeTimeout != listener.HandshakeTimeout ||
+			!reflect.DeepEqual(server.TlsConfig, listener.TlsConfig) ||
+			!reflect.DeepEqual(server.ProxyProtocol, listener.ProxyProtocol) {
+			return nil, fmt.Errorf("%w: %s", IncompatibleWsListeners, listener.ListenAddress)
+		}
+		if err := server.Router.add(listener); err != nil {
+			return nil, err
+		}
+		return server, nil
+	}
+
+	server, err := startWsServer(listener)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	wsServers[listener.ListenAddress] = server
+	return server, nil
+}
+
+func startWsServer(listener *ws_Listener) (*wsServer, error) {
+	if listener.Secure != listener.TlsConfig.IsSecure() {
+		return nil, helpers.StringError("Invalid TLS configuration")
+	}
+
+	tlsConfig, err := listener.TlsConfig.LoadAsTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	logger := CreateLogger(fmt.Sprintf("ws-server[%s]", listener.ListenAddress))
+	netListener, err := listenTCP(listener.ListenAddress, listener.ProxyProtocol, logger)
+	if err != nil {
+		return nil, err
 	}
 
-	this.httpServer = &http.Server{
-		TLSConfig: tlsConfig,
-		Addr:      this.ListenAddress,
-		Handler:   http.HandlerFunc(this.handleRequest),
+	if listener.Secure {
+		netListener = newTLSListener(netListener, tlsConfig, listener.HandshakeTimeout, listener.ListenAddress, logger)
 	}
 
-	if this.Secure {
-		return this.httpServer.ListenAndServeTLS("", "")
-	} else {
-		return this.httpServer.ListenAndServe()
+	result := &wsServer{
+		Address:          listener.ListenAddress,
+		Secure:           listener.Secure,
+		TlsConfig:        listener.TlsConfig,
+		ProxyProtocol:    listener.ProxyProtocol,
+		HandshakeTimeout: listener.HandshakeTimeout,
+		Router:           &wsRouter{Logger: logger, routes: []*ws_Listener{listener}},
+		done:             make(chan struct{}),
 	}
+	result.httpServer = newWsHTTPServer(result.Router, listener.ListenAddress, listener.HandshakeTimeout)
+	go func() {
+		result.err = result.httpServer.Serve(netListener)
+		close(result.done)
+	}()
+	return result, nil
+}
+
+// newWsHTTPServer create HTTP server of the WS listeners. Clients must send their upgrade request in `timeout`,
+// connections that are closed because they missed it are counted in metrics of `address`
+func newWsHTTPServer(handler http.Handler, address string, timeout time.Duration) *http.Server {
+	var guard sync.Mutex
+	// connections that have not finished a request yet, by the time that they are accepted
+	pending := make(map[net.Conn]time.Time)
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeout,
+		IdleTimeout:       timeout,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			guard.Lock()
+			defer guard.Unlock()
+
+			switch state {
+			case http.StateNew:
+				pending[conn] = time.Now()
+			case http.StateIdle, http.StateHijacked:
+				delete(pending, conn)
+			case http.StateClosed:
+				if acceptedAt, ok := pending[conn]; ok {
+					delete(pending, conn)
+					if time.Since(acceptedAt) >= timeout {
+						OnHandshakeTimeout(address, HandshakeStageWsUpgrade)
+					}
+				}
+			}
+		},
+	}
+}
+
+func (this *wsServer) isStopped() bool {
+	select {
+	case <-this.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// release remove a listener from the server, server is stopped by its last listener
+func (this *wsServer) release(listener *ws_Listener) {
+	wsServersGuard.Lock()
+	if this.Router.remove(listener) != 0 {
+		wsServersGuard.Unlock()
+		return
+	}
+	if wsServers[this.Address] == this {
+		delete(wsServers, this.Address)
+	}
+	wsServersGuard.Unlock()
+
+	this.httpServer.Shutdown(context.Background())
 }
-func (this *ws_Listener) Shutdown() { this.httpServer.Shutdown(context.Background()) }
 
 //endregion
 
@@ -199,6 +526,13 @@ func (this *ws_Listener) Shutdown() { this.httpServer.Shutdown(context.Backgroun
 type ws_ServerEndpoint struct {
 	ListenAddress *url.URL
 	TlsConfig     TlsServerConfiguration
+	ProxyProtocol *proxyProtocolSettings
+	// VirtualHost only requests with this host are accepted, it is empty if every host is accepted
+	VirtualHost string
+	// TrustedProxies networks of the HTTP proxies whose `X-Forwarded-For` is trusted
+	TrustedProxies []*net.IPNet
+	// HandshakeTimeout maximum time of the TLS handshake and WS upgrade of the clients
+	HandshakeTimeout time.Duration
 }
 
 func (this *ws_ServerEndpoint) IsSecure() bool      { return this.ListenAddress.Scheme == "wss" }
@@ -212,13 +546,18 @@ func (this *ws_ServerEndpoint) GetAddress() string {
 func (this *ws_ServerEndpoint) CreateListenService(serviceName, frontendName string, handler ClientHandler) helpers.Service {
 	name := fmt.Sprintf("%s/%s/ws-listener[%s]", serviceName, frontendName, this.GetAddress())
 	return &ws_Listener{
-		Name:          name,
-		Path:          GetUrlDirPath(this.ListenAddress),
-		ListenAddress: net.JoinHostPort(GetUrlHostname(this.ListenAddress), GetUrlPort(this.ListenAddress)),
-		Secure:        this.IsSecure(),
-		Logger:        CreateLogger(name),
-		TlsConfig:     &this.TlsConfig,
-		Handler:       handler,
+		Name:             name,
+		Path:             GetUrlDirPath(this.ListenAddress),
+		VirtualHost:      this.VirtualHost,
+		TrustedProxies:   this.TrustedProxies,
+		HandshakeTimeout: this.HandshakeTimeout,
+		ListenAddress:    net.JoinHostPort(GetUrlHostname(this.ListenAddress), GetUrlPort(this.ListenAddress)),
+		Secure:           this.IsSecure(),
+		Logger:           CreateLogger(name),
+		TlsConfig:        &this.TlsConfig,
+		ProxyProtocol:    this.ProxyProtocol,
+		Handler:          handler,
+		Stopped:          make(chan struct{}),
 	}
 }
 
@@ -233,21 +572,49 @@ func (this ws_EndpointFactory) CreateServerEndpoint(config MQTTServerEndpointCon
 	if u, err = ParseUrl(config.Address, "ws"); err != nil {
 		return nil, err
 	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, nil
+	}
+	if config.Socket != nil {
+		return nil, SocketInfoIsOnlyForUnixSchemes
+	}
+	proxyProtocol, err := newProxyProtocolSettings(config.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid trusted proxy: %w", err)
+	}
+	handshakeTimeout, err := newHandshakeTimeout(config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
 
 	switch u.Scheme {
 	case "ws":
 		if config.Certificate != nil || config.RequireClientValidation {
 			return nil, TlsInfoIsOnlyForSecureSchemes
 		}
-		return &ws_ServerEndpoint{ListenAddress: u}, nil
+		return &ws_ServerEndpoint{
+			ListenAddress:    u,
+			ProxyProtocol:    proxyProtocol,
+			VirtualHost:      strings.ToLower(config.VirtualHost),
+			TrustedProxies:   trustedProxies,
+			HandshakeTimeout: handshakeTimeout,
+		}, nil
 
 	case "wss":
 		if config.Certificate == nil {
 			return nil, MissingTlsInfoForSecureScheme
 		}
 		return &ws_ServerEndpoint{
-			ListenAddress: u,
-			TlsConfig:     config.TlsServerConfiguration,
+			ListenAddress:    u,
+			TlsConfig:        config.TlsServerConfiguration,
+			ProxyProtocol:    proxyProtocol,
+			VirtualHost:      strings.ToLower(config.VirtualHost),
+			TrustedProxies:   trustedProxies,
+			HandshakeTimeout: handshakeTimeout,
 		}, nil
 
 	default:
@@ -260,6 +627,9 @@ func (this ws_EndpointFactory) CreateClientEndpoint(config MQTTClientEndpointCon
 	if u, err = ParseUrl(config.Address, "ws"); err != nil {
 		return nil, err
 	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, nil
+	}
 	if GetUrlHostname(u) == "0.0.0.0" {
 		return nil, InvalidBackendAddress
 	}
@@ -271,7 +641,14 @@ func (this ws_EndpointFactory) CreateClientEndpoint(config MQTTClientEndpointCon
 		}
 		fallthrough
 	case "wss":
-		return &ws_ClientEndpoint{ServerAddress: u, Certificate: config.ConnectionCertificate}, nil
+		if err = config.ProxyProtocol.validate(); err != nil {
+			return nil, err
+		}
+		return &ws_ClientEndpoint{
+			ServerAddress:        u,
+			Certificate:          config.ConnectionCertificate,
+			ForwardClientAddress: config.ProxyProtocol != "",
+		}, nil
 
 	default:
 		return nil, nil
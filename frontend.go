@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"reflect"
 	"sync"
 
 	"github.com/devops-simba/helpers"
@@ -10,29 +11,47 @@ import (
 
 type frontendListener struct {
 	Name             string
+	ServiceName      string
+	FrontendName     string
+	Filter           *IPFilter
 	Closed           bool
 	Guard            sync.Mutex
-	ConnectedClients []net.Conn
-	Handler          func(net.Conn)
+	ConnectedClients []*ClientSession
+	Handler          func(*ClientSession)
 	Protocol         string
 	Logger           helpers.Logger
 	EndpointListener helpers.Service
 }
 
-func newFrontendListener(serviceName string, frontend *MQTTFrontend, handler func(net.Conn)) *frontendListener {
+func newFrontendListener(serviceName string, frontend *MQTTFrontend, handler func(*ClientSession)) *frontendListener {
 	name := fmt.Sprintf("frontend/%s/listener[%s]", frontend.Name, frontend.Endpoint.GetAddress())
 	result := &frontendListener{
-		Name:     name,
-		Guard:    sync.Mutex{},
-		Handler:  handler,
-		Protocol: frontend.Endpoint.GetProtocol(),
-		Logger:   CreateLogger(name),
+		Name:         name,
+		ServiceName:  serviceName,
+		FrontendName: frontend.Name,
+		Filter:       frontend.Filter,
+		Guard:        sync.Mutex{},
+		Handler:      handler,
+		Protocol:     frontend.Endpoint.GetProtocol(),
+		Logger:       CreateLogger(name),
 	}
 	result.EndpointListener = frontend.Endpoint.CreateListenService(serviceName, frontend.Name, result.handleClient)
+	if filterer, ok := result.EndpointListener.(AddressFilterer); ok && result.Filter != nil {
+		filterer.SetAddressFilter(result.acceptAddress)
+	}
 	return result
 }
 
-func (this *frontendListener) addClient(c net.Conn) bool {
+// acceptAddress check address of a client by the IP filter of the frontend
+func (this *frontendListener) acceptAddress(addr net.Addr) bool {
+	if this.Filter == nil || this.Filter.Accepts(addr) {
+		return true
+	}
+	OnConnectionRejected(this.ServiceName, this.FrontendName, RejectDeniedAddress)
+	return false
+}
+
+func (this *frontendListener) addClient(c *ClientSession) bool {
 	this.Guard.Lock()
 	defer this.Guard.Unlock()
 
@@ -42,7 +61,7 @@ func (this *frontendListener) addClient(c net.Conn) bool {
 	this.ConnectedClients = append(this.ConnectedClients, c)
 	return true
 }
-func (this *frontendListener) removeClient(c net.Conn) {
+func (this *frontendListener) removeClient(c *ClientSession) {
 	this.Guard.Lock()
 	defer this.Guard.Unlock()
 
@@ -53,7 +72,14 @@ func (this *frontendListener) removeClient(c net.Conn) {
 		}
 	}
 }
-func (this *frontendListener) handleClient(c net.Conn) {
+func (this *frontendListener) handleClient(conn net.Conn) {
+	if !this.acceptAddress(conn.RemoteAddr()) {
+		this.Logger.Warnf("%v) Rejected connection of a denied address", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	c := newClientSession(conn)
 	if !this.addClient(c) {
 		return
 	}
@@ -62,8 +88,24 @@ func (this *frontendListener) handleClient(c net.Conn) {
 
 	this.removeClient(c)
 }
+
+// GetConnectedClients return a copy of the list of connected clients
+func (this *frontendListener) GetConnectedClients() []*ClientSession {
+	this.Guard.Lock()
+	defer this.Guard.Unlock()
+
+	return append([]*ClientSession(nil), this.ConnectedClients...)
+}
 func (this *frontendListener) GetName() string { return this.Name }
 func (this *frontendListener) Run() error      { return this.EndpointListener.Run() }
+
+// Listen bind address of the endpoint listener, if it supports binding before `Run`
+func (this *frontendListener) Listen() error {
+	if listening, ok := this.EndpointListener.(listeningService); ok {
+		return listening.Listen()
+	}
+	return nil
+}
 func (this *frontendListener) Shutdown() {
 	this.EndpointListener.Shutdown()
 
@@ -71,7 +113,7 @@ func (this *frontendListener) Shutdown() {
 	if !this.Closed {
 		this.Closed = true
 		for i := 0; i < len(this.ConnectedClients); i++ {
-			this.ConnectedClients[i].Close()
+			this.ConnectedClients[i].Disconnect()
 		}
 	}
 	this.ConnectedClients = nil
@@ -83,16 +125,46 @@ type MQTTFrontend struct {
 	Name string
 	// Endpoint of this frontend
 	Endpoint MQTTServerEndpoint
+	// Topics rewrite topics of the clients of this frontend, it take precedence over topics of the service
+	Topics *TopicRewriter
+	// Limiter limit connections of this frontend, it is `nil` if frontend has no limit
+	Limiter *connectionLimiter
+	// Filter accept or reject clients by their address, it is `nil` if every address is accepted
+	Filter *IPFilter
+
+	config   MQTTFrontendConfig
+	listener *frontendListener
 }
 
-func (this *MQTTFrontend) CreateListenService(serviceName string, handler func(net.Conn)) helpers.Service {
-	return newFrontendListener(serviceName, this, handler)
+// IsSameFrontend return `true` if other frontend is created from the same configuration
+func (this *MQTTFrontend) IsSameFrontend(other *MQTTFrontend) bool {
+	return this.Name == other.Name && reflect.DeepEqual(this.config, other.config)
+}
+
+func (this *MQTTFrontend) CreateListenService(serviceName string, handler func(*ClientSession)) helpers.Service {
+	this.listener = newFrontendListener(serviceName, this, handler)
+	return this.listener
+}
+
+// GetConnectedClients return clients that are connected to this frontend
+func (this *MQTTFrontend) GetConnectedClients() []*ClientSession {
+	if this.listener == nil {
+		return nil
+	}
+	return this.listener.GetConnectedClients()
 }
 
 type MQTTFrontendConfig struct {
 	MQTTServerEndpointConfig `yaml:",inline"`
 	Name                     string `yaml:"name"`
 	Enabled                  *bool  `yaml:"enabled,omitempty"`
+	// Topics rewrite topics of the clients of this frontend, it needs `packets` proxy mode
+	Topics *TopicsConfig `yaml:"topics,omitempty"`
+	// Limits limit connections of this frontend, service may also have its own limits
+	Limits *ConnectionLimitsConfig `yaml:"limits,omitempty"`
+	// IPFilter allow or deny clients by their address, address is taken from PROXY protocol header or
+	// `X-Forwarded-For` if they are configured
+	IPFilter *IPFilterConfig `yaml:"ipFilter,omitempty"`
 }
 
 func CreateFrontend(config MQTTFrontendConfig) (*MQTTFrontend, bool, error) {
@@ -105,6 +177,32 @@ func CreateFrontend(config MQTTFrontendConfig) (*MQTTFrontend, bool, error) {
 		config.Name = "frontend_" + server.GetAddress()
 	}
 
-	frontend := &MQTTFrontend{Name: config.Name, Endpoint: server}
+	topics, err := CreateTopicRewriter(config.Topics)
+	if err != nil {
+		return nil, false, fmt.Errorf("Frontend `%s` has invalid topics: %w", config.Name, err)
+	}
+
+	var limiter *connectionLimiter
+	if config.Limits != nil {
+		limits, err := newConnectionLimits(config.Limits)
+		if err != nil {
+			return nil, false, fmt.Errorf("Frontend `%s` has invalid limits: %w", config.Name, err)
+		}
+		limiter = newConnectionLimiter(limits)
+	}
+
+	filter, err := CreateIPFilter(config.IPFilter, config.Name)
+	if err != nil {
+		return nil, false, fmt.Errorf("Frontend `%s` has invalid IP filter: %w", config.Name, err)
+	}
+
+	frontend := &MQTTFrontend{
+		Name:     config.Name,
+		Endpoint: server,
+		Topics:   topics,
+		Limiter:  limiter,
+		Filter:   filter,
+		config:   config,
+	}
 	return frontend, GetOptionalBool(config.Enabled, true), nil
 }
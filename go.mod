@@ -4,9 +4,9 @@ go 1.15
 
 require (
 	github.com/devops-simba/helpers v1.0.14
-	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/client_golang v1.8.0
+	golang.org/x/crypto v0.0.0-20201124201722-c8d3bf9c5392
 	google.golang.org/appengine v1.4.0
 	gopkg.in/yaml.v2 v2.3.0
 )
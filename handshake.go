@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+const (
+	defaultConnackTimeout = 10 * time.Second
+	defaultConnectTimeout = 10 * time.Second
+
+	// RejectConnectTimeout reason of rejecting clients that do not send their CONNECT in time
+	RejectConnectTimeout = "connect_timeout"
+
+	FirstPacketIsNotConnect = helpers.StringError("First packet of the client is not a CONNECT packet")
+	FirstPacketIsNotConnack = helpers.StringError("First packet of the backend is not a CONNACK packet")
+)
+
+// readConnectPacket read the CONNECT packet that client must send as its first packet
+func readConnectPacket(c net.Conn) ([]byte, *ConnectPacket, error) {
+	raw, err := readPacketBytes(c, maxConnectPacketSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if PacketType(raw[0]>>4) != PacketConnect {
+		return nil, nil, FirstPacketIsNotConnect
+	}
+	// version is not needed for CONNECT, it carry the version itself
+	pkt, err := DecodePacket(raw, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, pkt.(*ConnectPacket), nil
+}
+
+// readConnackPacket read the CONNACK packet that a backend send in response of the CONNECT
+func readConnackPacket(c net.Conn, version byte) ([]byte, *ConnackPacket, error) {
+	raw, err := readPacketBytes(c, maxPacketSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkt, err := DecodePacket(raw, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	connack, ok := pkt.(*ConnackPacket)
+	if !ok {
+		return nil, nil, FirstPacketIsNotConnack
+	}
+	return raw, connack, nil
+}
+
+// newConnackPacket create a CONNACK packet that proxy itself send to the client, `reason` is converted to a
+// return code for older clients
+func newConnackPacket(version byte, reason ReasonCode) []byte {
+	return EncodePacket(&ConnackPacket{ReasonCode: connackReasonCode(version, reason)}, version)
+}
+
+// isClientRefusal return `true` if backend refused the connection because of something that is related to the
+// client itself(for example its credentials). All backends will answer such a client in the same way, so there is
+// no point in trying other backends and the backend should not be considered as failed
+func isClientRefusal(version byte, code ReasonCode) bool {
+	if version < MQTT5 {
+		switch code {
+		case ConnackRefusedProtocolVersion,
+			ConnackRefusedIdentifierRejected,
+			ConnackRefusedBadUsernameOrPassword,
+			ConnackRefusedNotAuthorized:
+			return true
+		default:
+			return false
+		}
+	}
+
+	switch code {
+	case ReasonMalformedPacket,
+		ReasonProtocolError,
+		ReasonUnsupportedProtocolVersion,
+		ReasonClientIdentifierNotValid,
+		ReasonBadUsernameOrPassword,
+		ReasonNotAuthorized,
+		ReasonBanned,
+		ReasonBadAuthenticationMethod,
+		ReasonPacketTooLarge,
+		ReasonPayloadFormatInvalid,
+		ReasonRetainNotSupported,
+		ReasonQoSNotSupported:
+		return true
+	default:
+		return false
+	}
+}
+
+// backendHandshake connect to the backend, replay CONNECT of the client to it and wait for its CONNACK. Whole of
+// the handshake, including connecting to the backend, must finish in `timeout`
+func backendHandshake(
+	serviceName string,
+	backend *MQTTBackend,
+	clientAddr net.Addr,
+	frontendAddr net.Addr,
+	connect []byte,
+	version byte,
+	timeout time.Duration,
+) (net.Conn, []byte, *ConnackPacket, error) {
+	deadline := time.Now().Add(timeout)
+	conn, err := backend.Endpoint.Connect(serviceName, backend.Name, clientAddr, frontendAddr, timeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conn.SetDeadline(deadline)
+	if _, err = conn.Write(connect); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	raw, connack, err := readConnackPacket(conn, version)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, raw, connack, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	// number of points that each unit of weight of a backend own on the ring
+	ringPointsPerWeight = 100
+	// default value of `c` in consistent hashing with bounded loads, each backend may handle at most
+	// `c` times of its fair share of the connections
+	defaultHashLoadFactor = 1.25
+)
+
+type ringPoint struct {
+	hash    uint64
+	backend *MQTTBackend
+}
+
+// consistentHashRing map keys(client identifiers) to backends, so that adding or removing a backend only move
+// a minimal share of the keys
+type consistentHashRing struct {
+	points     []ringPoint
+	loadFactor float64
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	// fnv is weak for keys that only differ in their last characters, mix its result to spread the points
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func newConsistentHashRing(backends MQTTBackendList, loadFactor float64) *consistentHashRing {
+	result := &consistentHashRing{loadFactor: loadFactor}
+	for i := 0; i < len(backends); i++ {
+		backend := backends[i]
+		weight := backend.GetWeight()
+		if weight < 1 {
+			// passive backends also need a place in the ring
+			weight = 1
+		}
+
+		numberOfPoints := weight * ringPointsPerWeight
+		for j := 0; j < numberOfPoints; j++ {
+			result.points = append(result.points, ringPoint{
+				hash:    hashKey(backend.Name + "#" + strconv.Itoa(j)),
+				backend: backend,
+			})
+		}
+	}
+
+	sort.Slice(result.points, func(i, j int) bool { return result.points[i].hash < result.points[j].hash })
+	return result
+}
+
+// Select find owner of the key between candidates. Starting from the position of the key in the ring, the first
+// candidate that has not reached its bounded load will be selected.
+func (this *consistentHashRing) Select(key string, candidates MQTTBackendList, active bool) *MQTTBackend {
+	if len(candidates) == 0 || len(this.points) == 0 {
+		return nil
+	}
+
+	var totalConnections int64
+	totalWeight := 0
+	for i := 0; i < len(candidates); i++ {
+		totalConnections += candidates[i].ActiveConnections()
+		totalWeight += candidates[i].EffectiveWeight(active)
+	}
+
+	var firstCandidate *MQTTBackend
+	keyHash := hashKey(key)
+	start := sort.Search(len(this.points), func(i int) bool { return this.points[i].hash >= keyHash })
+	for i := 0; i < len(this.points); i++ {
+		backend := this.points[(start+i)%len(this.points)].backend
+		if !candidates.Contains(backend) {
+			continue
+		}
+		if firstCandidate == nil {
+			firstCandidate = backend
+		}
+
+		share := float64(totalConnections+1) * float64(backend.EffectiveWeight(active)) / float64(totalWeight)
+		if backend.ActiveConnections() < int64(math.Ceil(this.loadFactor*share)) {
+			return backend
+		}
+	}
+
+	// every candidate reached its bound, this may only happen with very small number of connections
+	return firstCandidate
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func newTestBackend(name string, weight int) *MQTTBackend {
+	backend, _, err := CreateBackend(MQTTBackendConfig{
+		MQTTClientEndpointConfig: MQTTClientEndpointConfig{Address: "mqtt://127.0.0.1:1883"},
+		Name:                     name,
+		Weight:                   &weight,
+	}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return backend
+}
+
+func TestHashRingStickiness(t *testing.T) {
+	a, b, c := newTestBackend("a", 1), newTestBackend("b", 1), newTestBackend("c", 1)
+	backends := MQTTBackendList{a, b, c}
+	ring := newConsistentHashRing(backends, defaultHashLoadFactor)
+
+	owners := make(map[string]*MQTTBackend)
+	counts := make(map[*MQTTBackend]int)
+	for i := 0; i < 3000; i++ {
+		key := "client-" + strconv.Itoa(i)
+		owners[key] = ring.Select(key, backends, true)
+		counts[owners[key]]++
+	}
+	for _, backend := range backends {
+		if counts[backend] < 800 || counts[backend] > 1200 {
+			t.Errorf("Backend `%s` owns %d of 3000 keys", backend.Name, counts[backend])
+		}
+	}
+
+	// a new ring of the same backends must map keys in the same way, so reloads keep the clients in place
+	other := newConsistentHashRing(MQTTBackendList{c, a, b}, defaultHashLoadFactor)
+	for key, owner := range owners {
+		if ring.Select(key, backends, true) != owner || other.Select(key, backends, true) != owner {
+			t.Fatalf("Key `%s` moved away from `%s`", key, owner.Name)
+		}
+	}
+
+	// when `b` is unavailable only its own keys move
+	available := MQTTBackendList{a, c}
+	for key, owner := range owners {
+		selected := ring.Select(key, available, true)
+		if owner != b && selected != owner {
+			t.Fatalf("Key `%s` moved from `%s` to `%s`", key, owner.Name, selected.Name)
+		}
+		if selected == b {
+			t.Fatalf("Key `%s` is sent to an unavailable backend", key)
+		}
+	}
+
+	if ring.Select("client", nil, true) != nil {
+		t.Error("Expected no backend without candidates")
+	}
+}
+
+func TestHashRingBoundedLoad(t *testing.T) {
+	a, b, c := newTestBackend("a", 1), newTestBackend("b", 1), newTestBackend("c", 2)
+	backends := MQTTBackendList{a, b, c}
+	ring := newConsistentHashRing(backends, defaultHashLoadFactor)
+
+	// keys of a loaded backend go to the next backend of the ring
+	var key string
+	for i := 0; key == ""; i++ {
+		if candidate := "client-" + strconv.Itoa(i); ring.Select(candidate, backends, true) == a {
+			key = candidate
+		}
+	}
+	a.activeConnections = 10
+	if ring.Select(key, backends, true) == a {
+		t.Fatal("Expected key of an overloaded backend to move")
+	}
+	a.activeConnections = 0
+
+	const clients = 400
+	for i := 0; i < clients; i++ {
+		ring.Select("client-"+strconv.Itoa(i), backends, true).OnClientAttached()
+	}
+	for _, backend := range backends {
+		share := float64(clients) * float64(backend.GetWeight()) / 4
+		if limit := int64(math.Ceil(defaultHashLoadFactor * share)); backend.ActiveConnections() > limit {
+			t.Errorf("Backend `%s` has %d clients, more than its limit %d", backend.Name,
+				backend.ActiveConnections(), limit)
+		}
+	}
+	if c.ActiveConnections() <= a.ActiveConnections() || c.ActiveConnections() <= b.ActiveConnections() {
+		t.Errorf("Expected backend with weight 2 to have more clients, got %d, %d and %d",
+			a.ActiveConnections(), b.ActiveConnections(), c.ActiveConnections())
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+type HealthState int32
+
+const (
+	HealthUnknown HealthState = iota
+	Healthy
+	Unhealthy
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+
+	UnexpectedPingResponse      = helpers.StringError("Backend did not answer PINGREQ with PINGRESP")
+	InvalidHealthCheckThreshold = helpers.StringError("Health check thresholds must be positive")
+	InvalidHealthCheckInterval  = helpers.StringError("Health check interval and timeout must be positive")
+)
+
+func (this HealthState) String() string {
+	switch this {
+	case Healthy:
+		return "healthy"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// defaultHealthCheckClientID return a client ID that is unique for each process of the proxy, brokers disconnect
+// the old client when a new one connect with the same ID
+func defaultHealthCheckClientID(backendName string) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("mqproxy-health-%s-%s-%d", backendName, hostname, os.Getpid())
+}
+
+type HealthCheckConfig struct {
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Interval time between two consecutive checks
+	Interval *time.Duration `yaml:"interval,omitempty"`
+	// Timeout maximum time that a single check may take
+	Timeout *time.Duration `yaml:"timeout,omitempty"`
+	// HealthyThreshold number of consecutive succeeded checks that mark an unhealthy backend as healthy
+	HealthyThreshold *int `yaml:"healthyThreshold,omitempty"`
+	// UnhealthyThreshold number of consecutive failed checks that mark a healthy backend as unhealthy
+	UnhealthyThreshold *int `yaml:"unhealthyThreshold,omitempty"`
+	// ClientID client identifier that is used in CONNECT of the check, default is unique for each instance of the
+	// proxy, so replicas do not disconnect checks of each other
+	ClientID string `yaml:"clientId,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Ping also check that backend answer a PINGREQ after accepting the connection
+	Ping bool `yaml:"ping,omitempty"`
+}
+
+// healthChecker regularly connect to a backend and perform a MQTT handshake with it, to learn about its health
+// before any client hit it
+type healthChecker struct {
+	Name               string
+	ServiceName        string
+	Backend            *MQTTBackend
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	Connect            []byte
+	Ping               bool
+	Logger             helpers.Logger
+	Stopped            chan struct{}
+
+	consecutiveSuccesses int
+	consecutiveFailures  int
+}
+
+func newHealthChecker(serviceName string, backend *MQTTBackend, config *HealthCheckConfig) (*healthChecker, error) {
+	name := fmt.Sprintf("%s/%s/health-checker", serviceName, backend.Name)
+	result := &healthChecker{
+		Name:               name,
+		ServiceName:        serviceName,
+		Backend:            backend,
+		Interval:           defaultHealthCheckInterval,
+		Timeout:            defaultHealthCheckTimeout,
+		HealthyThreshold:   defaultHealthyThreshold,
+		UnhealthyThreshold: defaultUnhealthyThreshold,
+		Ping:               config.Ping,
+		Logger:             CreateLogger(name),
+		Stopped:            make(chan struct{}),
+	}
+	if config.Interval != nil {
+		result.Interval = *config.Interval
+	}
+	if config.Timeout != nil {
+		result.Timeout = *config.Timeout
+	}
+	if config.HealthyThreshold != nil {
+		result.HealthyThreshold = *config.HealthyThreshold
+	}
+	if config.UnhealthyThreshold != nil {
+		result.UnhealthyThreshold = *config.UnhealthyThreshold
+	}
+	if err := result.validate(); err != nil {
+		return nil, err
+	}
+
+	connect := &ConnectPacket{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: MQTT311,
+		CleanSession:    true,
+		KeepAlive:       uint16(result.Timeout.Seconds()) + 1,
+		ClientID:        config.ClientID,
+	}
+	if connect.ClientID == "" {
+		connect.ClientID = defaultHealthCheckClientID(backend.Name)
+	}
+	if config.Username != "" {
+		connect.UsernameFlag = true
+		connect.Username = config.Username
+	}
+	if config.Password != "" {
+		connect.PasswordFlag = true
+		connect.Password = []byte(config.Password)
+	}
+
+	result.Connect = EncodePacket(connect, MQTT311)
+	return result, nil
+}
+
+func (this *healthChecker) validate() error {
+	if this.Interval <= 0 || this.Timeout <= 0 {
+		return InvalidHealthCheckInterval
+	}
+	if this.HealthyThreshold <= 0 || this.UnhealthyThreshold <= 0 {
+		return InvalidHealthCheckThreshold
+	}
+	return nil
+}
+// check connect to the backend and optionally ping it, whole of the check must finish in `Timeout`. Checks are not
+// counted as pending attempts of the backend, so they never take place of the half-open probes of the clients
+func (this *healthChecker) check() error {
+	deadline := time.Now().Add(this.Timeout)
+	conn, _, connack, err := backendHandshake(this.ServiceName, this.Backend, nil, nil, this.Connect, MQTT311,
+		this.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	this.Logger.Verbosef(11, "Received CONNACK: %s", connack.String())
+	if connack.ReasonCode != ConnackAccepted {
+		return fmt.Errorf("Backend refused the connection: %s", connackReasonString(MQTT311, connack.ReasonCode))
+	}
+
+	conn.SetDeadline(deadline)
+	if this.Ping {
+		if err = WritePacket(conn, &PingreqPacket{}, MQTT311); err != nil {
+			return err
+		}
+		pkt, err := ReadPacket(conn, MQTT311)
+		if err != nil {
+			return err
+		}
+		if _, ok := pkt.(*PingrespPacket); !ok {
+			return UnexpectedPingResponse
+		}
+	}
+
+	return WritePacket(conn, &DisconnectPacket{}, MQTT311)
+}
+func (this *healthChecker) onCheckResult(err error) {
+	state := this.Backend.HealthState()
+	if err == nil {
+		this.consecutiveFailures = 0
+		this.consecutiveSuccesses++
+		this.Logger.Verbosef(10, "Health check succeeded")
+		if state != Healthy && (state == HealthUnknown || this.consecutiveSuccesses >= this.HealthyThreshold) {
+			this.Logger.Infof("Backend `%s` is healthy now", this.Backend.Name)
+			this.Backend.SetHealthState(Healthy)
+		}
+	} else {
+		this.consecutiveSuccesses = 0
+		this.consecutiveFailures++
+		this.Logger.Debugf("Health check failed: %v", err)
+		if state != Unhealthy && this.consecutiveFailures >= this.UnhealthyThreshold {
+			this.Logger.Warnf("Backend `%s` is unhealthy now: %v", this.Backend.Name, err)
+			this.Backend.SetHealthState(Unhealthy)
+		}
+	}
+}
+
+func (this *healthChecker) GetName() string { return this.Name }
+func (this *healthChecker) Run() error {
+	ticker := time.NewTicker(this.Interval)
+	defer ticker.Stop()
+
+	for {
+		this.onCheckResult(this.check())
+
+		select {
+		case <-this.Stopped:
+			return helpers.ErrServiceStopped
+		case <-ticker.C:
+		}
+	}
+}
+func (this *healthChecker) Shutdown() {
+	defer func() { recover() }()
+	close(this.Stopped)
+}
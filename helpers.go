@@ -37,7 +37,7 @@ func GetUrlPort(u *url.URL) string {
 		switch u.Scheme {
 		case "http", "ws":
 			return "80"
-		case "https", "wss":
+		case "https", "wss", "auto":
 			return "443"
 		case "mqtt":
 			return "1883"
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RejectDeniedAddress reason of rejecting clients that are denied by the IP filter of their frontend
+const RejectDeniedAddress = "denied_address"
+
+type IPFilterConfig struct {
+	// Allow CIDRs of the clients that are accepted, if it is empty every client that is not denied is accepted
+	Allow []string `yaml:"allow,omitempty"`
+	// Deny CIDRs of the clients that are rejected, it take precedence over `Allow`
+	Deny []string `yaml:"deny,omitempty"`
+	// File a file with `allow <CIDR>` and `deny <CIDR>` lines that are added to the lists above, it is reloaded
+	// when it changes
+	File string `yaml:"file,omitempty"`
+}
+
+type ipRules struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// parseIPRules parse a file of IP rules, each line is `allow <CIDR>` or `deny <CIDR>` and `#` start a comment
+func parseIPRules(content []byte) (interface{}, error) {
+	rules := &ipRules{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid IP rule at line %d", lineNumber)
+		}
+
+		networks, err := parseNetworks(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IP rule at line %d: %w", lineNumber, err)
+		}
+		switch fields[0] {
+		case "allow":
+			rules.Allow = append(rules.Allow, networks...)
+		case "deny":
+			rules.Deny = append(rules.Deny, networks...)
+		default:
+			return nil, fmt.Errorf("Invalid IP rule at line %d: unknown action `%s`", lineNumber, fields[0])
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// IPFilter accept or reject clients of a frontend by their address
+type IPFilter struct {
+	rules     ipRules
+	fileRules func() *ipRules
+}
+
+// CreateIPFilter create the filter of a frontend, or return `nil` if config is `nil`
+func CreateIPFilter(config *IPFilterConfig, frontendName string) (*IPFilter, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	result := &IPFilter{}
+	var err error
+	if result.rules.Allow, err = parseNetworks(config.Allow); err != nil {
+		return nil, fmt.Errorf("Invalid allowed network: %w", err)
+	}
+	if result.rules.Deny, err = parseNetworks(config.Deny); err != nil {
+		return nil, fmt.Errorf("Invalid denied network: %w", err)
+	}
+	if config.File != "" {
+		file, err := newWatchedFile(config.File, CreateLogger("frontend/"+frontendName+"/ip-filter"), parseIPRules)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load IP filter file: %w", err)
+		}
+		result.fileRules = func() *ipRules { return file.Get().(*ipRules) }
+	}
+	return result, nil
+}
+
+// Accepts check address of a client, clients without IP(for example clients of unix sockets) are only accepted
+// if there is no allowed network
+func (this *IPFilter) Accepts(addr net.Addr) bool {
+	rules := []*ipRules{&this.rules}
+	if this.fileRules != nil {
+		rules = append(rules, this.fileRules())
+	}
+
+	var ip net.IP
+	if addr != nil {
+		ip = addrIP(addr)
+	}
+	hasAllow, allowed := false, false
+	for i := 0; i < len(rules); i++ {
+		if ip != nil && networksContain(rules[i].Deny, ip) {
+			return false
+		}
+		if len(rules[i].Allow) != 0 {
+			hasAllow = true
+			allowed = allowed || (ip != nil && networksContain(rules[i].Allow, ip))
+		}
+	}
+	return !hasAllow || allowed
+}
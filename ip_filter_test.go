@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIPRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		allow   int
+		deny    int
+		failure bool
+	}{
+		{name: "rules", content: "# rules\n\nallow 10.0.0.0/8\n  deny 10.1.0.0/16  # lab\nallow 2001:db8::1\n",
+			allow: 2, deny: 1},
+		{name: "empty", content: ""},
+		{name: "unknown action", content: "permit 10.0.0.0/8", failure: true},
+		{name: "missing network", content: "allow", failure: true},
+		{name: "several networks", content: "allow 10.0.0.0/8 11.0.0.0/8", failure: true},
+		{name: "invalid network", content: "deny 10.0.0.0/33", failure: true},
+		{name: "invalid address", content: "deny example.com", failure: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := parseIPRules([]byte(test.content))
+			if test.failure {
+				if err == nil {
+					t.Error("Expected content to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rules := result.(*ipRules); len(rules.Allow) != test.allow || len(rules.Deny) != test.deny {
+				t.Errorf("Expected %d allowed and %d denied networks, got %v and %v", test.allow, test.deny,
+					rules.Allow, rules.Deny)
+			}
+		})
+	}
+}
+
+func TestIPFilterAccepts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ip-rules")
+	if err := ioutil.WriteFile(file, []byte("allow 192.168.0.0/16\ndeny 10.2.0.0/16\ndeny 192.168.1.0/24\n"),
+		0600); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+	filter, err := CreateIPFilter(&IPFilterConfig{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.1.0.0/16", "192.168.2.0/24", "2001:db8::1"},
+		File:  file,
+	}, "test")
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		address  string
+		accepted bool
+	}{
+		{name: "inline allow", address: "10.0.0.1", accepted: true},
+		{name: "inline deny before inline allow", address: "10.1.0.1"},
+		{name: "file deny before inline allow", address: "10.2.0.1"},
+		{name: "file allow", address: "192.168.0.1", accepted: true},
+		{name: "file deny before file allow", address: "192.168.1.1"},
+		{name: "inline deny before file allow", address: "192.168.2.1"},
+		{name: "not allowed", address: "172.16.0.1"},
+		{name: "IPv6 allow", address: "2001:db8::2", accepted: true},
+		{name: "IPv6 deny", address: "2001:db8::1"},
+		{name: "IPv4 mapped IPv6", address: "::ffff:10.1.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if filter.Accepts(&net.TCPAddr{IP: net.ParseIP(test.address), Port: 1000}) != test.accepted {
+				t.Errorf("Expected accepted to be %v", test.accepted)
+			}
+		})
+	}
+
+	if filter.Accepts(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}) || filter.Accepts(nil) {
+		t.Error("Expected clients without IP to be rejected when there are allowed networks")
+	}
+}
+
+func TestIPFilterDenyOnly(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ip-rules")
+	if err := ioutil.WriteFile(file, []byte("deny 10.0.0.0/8\n"), 0600); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+	filter, err := CreateIPFilter(&IPFilterConfig{Deny: []string{"192.168.0.0/16"}, File: file}, "test")
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	if filter.Accepts(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) ||
+		filter.Accepts(&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}) {
+		t.Error("Expected denied networks to be rejected")
+	}
+	if !filter.Accepts(&net.TCPAddr{IP: net.ParseIP("172.16.0.1")}) {
+		t.Error("Expected clients that are not denied to be accepted")
+	}
+	if !filter.Accepts(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}) {
+		t.Error("Expected clients without IP to be accepted when there is no allowed network")
+	}
+
+	if filter, err := CreateIPFilter(nil, "test"); filter != nil || err != nil {
+		t.Error("Expected no filter without config")
+	}
+	if _, err := CreateIPFilter(&IPFilterConfig{Allow: []string{"10.0.0.0/40"}}, "test"); err == nil {
+		t.Error("Expected invalid network to be rejected")
+	}
+	if err := ioutil.WriteFile(file, []byte("block 10.0.0.0/8\n"), 0600); err != nil {
+		t.Fatalf("Failed to write rules file: %v", err)
+	}
+	if _, err := CreateIPFilter(&IPFilterConfig{File: file}, "test"); err == nil {
+		t.Error("Expected invalid rules file to be rejected")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// time that we wait for CONNECT of a client that is over the limits, so we can answer it with a CONNACK
+	rejectedConnectTimeout = time.Second
+
+	LimitMaxConnections = "max_connections"
+	LimitMaxPerSource   = "max_per_source"
+	LimitConnectionRate = "connection_rate"
+)
+
+type ConnectionLimitsConfig struct {
+	// MaxConnections maximum number of concurrent connections
+	MaxConnections *int `yaml:"maxConnections,omitempty"`
+	// MaxConnectionsPerSource maximum number of concurrent connections of a source, source is IP of the client or
+	// its network if `sourcePrefixV4` or `sourcePrefixV6` is set
+	MaxConnectionsPerSource *int `yaml:"maxConnectionsPerSource,omitempty"`
+	// SourcePrefixV4 prefix length of the networks that group IPv4 clients, default is 32(each IP is a source)
+	SourcePrefixV4 *int `yaml:"sourcePrefixV4,omitempty"`
+	// SourcePrefixV6 prefix length of the networks that group IPv6 clients, default is 128(each IP is a source)
+	SourcePrefixV6 *int `yaml:"sourcePrefixV6,omitempty"`
+	// ConnectionRate maximum number of new connections per second
+	ConnectionRate *float64 `yaml:"connectionRate,omitempty"`
+	// ConnectionBurst number of new connections that may be accepted at once, default is `connectionRate`
+	ConnectionBurst *int `yaml:"connectionBurst,omitempty"`
+}
+
+// connectionLimits compiled limits, zero values mean no limit
+type connectionLimits struct {
+	MaxConnections int
+	MaxPerSource   int
+	SourceMaskV4   net.IPMask
+	SourceMaskV6   net.IPMask
+	Rate           float64
+	Burst          float64
+}
+
+func newConnectionLimits(config *ConnectionLimitsConfig) (connectionLimits, error) {
+	result := connectionLimits{
+		SourceMaskV4: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len),
+		SourceMaskV6: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len),
+	}
+	if config == nil {
+		return result, nil
+	}
+
+	if config.MaxConnections != nil {
+		if *config.MaxConnections < 1 {
+			return result, fmt.Errorf("`maxConnections` must be at least 1")
+		}
+		result.MaxConnections = *config.MaxConnections
+	}
+	if config.MaxConnectionsPerSource != nil {
+		if *config.MaxConnectionsPerSource < 1 {
+			return result, fmt.Errorf("`maxConnectionsPerSource` must be at least 1")
+		}
+		result.MaxPerSource = *config.MaxConnectionsPerSource
+	}
+	if config.SourcePrefixV4 != nil {
+		if *config.SourcePrefixV4 < 0 || *config.SourcePrefixV4 > 8*net.IPv4len {
+			return result, fmt.Errorf("`sourcePrefixV4` must be between 0 and 32")
+		}
+		result.SourceMaskV4 = net.CIDRMask(*config.SourcePrefixV4, 8*net.IPv4len)
+	}
+	if config.SourcePrefixV6 != nil {
+		if *config.SourcePrefixV6 < 0 || *config.SourcePrefixV6 > 8*net.IPv6len {
+			return result, fmt.Errorf("`sourcePrefixV6` must be between 0 and 128")
+		}
+		result.SourceMaskV6 = net.CIDRMask(*config.SourcePrefixV6, 8*net.IPv6len)
+	}
+	if config.ConnectionRate != nil {
+		if *config.ConnectionRate <= 0 {
+			return result, fmt.Errorf("`connectionRate` must be positive")
+		}
+		result.Rate = *config.ConnectionRate
+		result.Burst = result.Rate
+		if result.Burst < 1 {
+			result.Burst = 1
+		}
+	}
+	if config.ConnectionBurst != nil {
+		if result.Rate == 0 {
+			return result, fmt.Errorf("`connectionBurst` needs `connectionRate`")
+		}
+		if *config.ConnectionBurst < 1 {
+			return result, fmt.Errorf("`connectionBurst` must be at least 1")
+		}
+		result.Burst = float64(*config.ConnectionBurst)
+	}
+	return result, nil
+}
+
+// source return the source that a client belongs to, it is empty if client has no IP
+func (this *connectionLimits) source(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(this.SourceMaskV4).String()
+	}
+	return ip.Mask(this.SourceMaskV6).String()
+}
+
+// connectionLimiter count connections of a frontend or a service and reject the connections that exceed the
+// limits. A `nil` limiter accept every connection
+type connectionLimiter struct {
+	guard       sync.Mutex
+	limits      connectionLimits
+	connections int
+	perSource   map[string]int
+	tokens      float64
+	refilledAt  time.Time
+}
+
+func newConnectionLimiter(limits connectionLimits) *connectionLimiter {
+	return &connectionLimiter{
+		limits:     limits,
+		perSource:  make(map[string]int),
+		tokens:     limits.Burst,
+		refilledAt: time.Now(),
+	}
+}
+
+// update change limits of the limiter and keep its counters
+func (this *connectionLimiter) update(limits connectionLimits) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	if limits.Rate != this.limits.Rate || limits.Burst != this.limits.Burst {
+		this.tokens, this.refilledAt = limits.Burst, time.Now()
+	}
+	this.limits = limits
+}
+
+func (this *connectionLimiter) getLimits() connectionLimits {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.limits
+}
+
+// takeToken take a token from the bucket of the connection rate, guard must be locked
+func (this *connectionLimiter) takeToken() bool {
+	if this.limits.Rate == 0 {
+		return true
+	}
+
+	now := time.Now()
+	this.tokens += now.Sub(this.refilledAt).Seconds() * this.limits.Rate
+	if this.tokens > this.limits.Burst {
+		this.tokens = this.limits.Burst
+	}
+	this.refilledAt = now
+
+	if this.tokens < 1 {
+		return false
+	}
+	this.tokens--
+	return true
+}
+
+// acquire reserve a connection for a client. It return a function that must be called when client disconnect,
+// or `nil` and the reason if client exceed the limits
+func (this *connectionLimiter) acquire(addr net.Addr) (func(), string) {
+	if this == nil {
+		return func() {}, ""
+	}
+
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	if this.limits.MaxConnections != 0 && this.connections >= this.limits.MaxConnections {
+		return nil, LimitMaxConnections
+	}
+	source := ""
+	if this.limits.MaxPerSource != 0 {
+		source = this.limits.source(addr)
+		if source != "" && this.perSource[source] >= this.limits.MaxPerSource {
+			return nil, LimitMaxPerSource
+		}
+	}
+	if !this.takeToken() {
+		return nil, LimitConnectionRate
+	}
+
+	this.connections++
+	if source != "" {
+		this.perSource[source]++
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { this.release(source) }) }, ""
+}
+
+func (this *connectionLimiter) release(source string) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.connections--
+	if source != "" {
+		if this.perSource[source] <= 1 {
+			delete(this.perSource, source)
+		} else {
+			this.perSource[source]--
+		}
+	}
+}
+
+// rejectOverloadedClient answer CONNECT of a client that exceed the limits with `server unavailable`, client is
+// closed without an answer if it does not send a valid CONNECT quickly
+func rejectOverloadedClient(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(rejectedConnectTimeout))
+	if _, connect, err := readConnectPacket(c); err == nil {
+		c.SetWriteDeadline(time.Now().Add(rejectedConnectTimeout))
+		c.Write(newConnackPacket(connect.ProtocolVersion, ReasonServerUnavailable))
+	}
+	c.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ConnectionLimitsConfig
+		failure bool
+	}{
+		{name: "empty"},
+		{name: "all limits", config: ConnectionLimitsConfig{MaxConnections: intPtr(10),
+			MaxConnectionsPerSource: intPtr(2), SourcePrefixV4: intPtr(24), SourcePrefixV6: intPtr(64),
+			ConnectionRate: float64Ptr(5), ConnectionBurst: intPtr(10)}},
+		{name: "zero connections", config: ConnectionLimitsConfig{MaxConnections: intPtr(0)}, failure: true},
+		{name: "zero per source", config: ConnectionLimitsConfig{MaxConnectionsPerSource: intPtr(0)}, failure: true},
+		{name: "long IPv4 prefix", config: ConnectionLimitsConfig{SourcePrefixV4: intPtr(33)}, failure: true},
+		{name: "negative IPv6 prefix", config: ConnectionLimitsConfig{SourcePrefixV6: intPtr(-1)}, failure: true},
+		{name: "zero rate", config: ConnectionLimitsConfig{ConnectionRate: float64Ptr(0)}, failure: true},
+		{name: "burst without rate", config: ConnectionLimitsConfig{ConnectionBurst: intPtr(5)}, failure: true},
+		{name: "zero burst", config: ConnectionLimitsConfig{ConnectionRate: float64Ptr(1), ConnectionBurst: intPtr(0)},
+			failure: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newConnectionLimits(&test.config); (err != nil) != test.failure {
+				t.Errorf("Expected failure to be %v, got `%v`", test.failure, err)
+			}
+		})
+	}
+}
+
+func TestConnectionLimiterRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		// accepted number of connections that are accepted at once
+		accepted int
+		// refill time that is needed for the next connection
+		refill time.Duration
+	}{
+		{name: "burst is rate", rate: 10, accepted: 10, refill: 100 * time.Millisecond},
+		{name: "burst", rate: 10, burst: 3, accepted: 3, refill: 100 * time.Millisecond},
+		{name: "rate below one", rate: 0.5, accepted: 1, refill: 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &ConnectionLimitsConfig{ConnectionRate: &test.rate}
+			if test.burst != 0 {
+				config.ConnectionBurst = intPtr(test.burst)
+			}
+			limits, err := newConnectionLimits(config)
+			if err != nil {
+				t.Fatalf("Failed to create limits: %v", err)
+			}
+			limiter := newConnectionLimiter(limits)
+			addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+			for i := 0; i < test.accepted; i++ {
+				if release, reason := limiter.acquire(addr); release == nil {
+					t.Fatalf("Expected connection %d to be accepted, got `%s`", i, reason)
+				}
+			}
+			if release, reason := limiter.acquire(addr); release != nil || reason != LimitConnectionRate {
+				t.Fatalf("Expected connection over the burst to be rejected, got `%s`", reason)
+			}
+
+			// the clock is moved by changing time of the last refill, so the test does not depend on its speed
+			limiter.refilledAt = limiter.refilledAt.Add(-test.refill / 2)
+			if release, _ := limiter.acquire(addr); release != nil {
+				t.Fatal("Expected connection to be rejected before a token is refilled")
+			}
+			limiter.refilledAt = limiter.refilledAt.Add(-test.refill)
+			if release, reason := limiter.acquire(addr); release == nil {
+				t.Fatalf("Expected connection to be accepted after a token is refilled, got `%s`", reason)
+			}
+
+			// a long pause only refill the burst
+			limiter.refilledAt = limiter.refilledAt.Add(-time.Hour)
+			for i := 0; i < test.accepted; i++ {
+				if release, _ := limiter.acquire(addr); release == nil {
+					t.Fatalf("Expected connection %d to be accepted after a pause", i)
+				}
+			}
+			if release, _ := limiter.acquire(addr); release != nil {
+				t.Error("Expected tokens to be limited by the burst")
+			}
+		})
+	}
+}
+
+func TestConnectionLimiterPerSource(t *testing.T) {
+	limits, err := newConnectionLimits(&ConnectionLimitsConfig{
+		MaxConnections:          intPtr(6),
+		MaxConnectionsPerSource: intPtr(2),
+		SourcePrefixV4:          intPtr(24),
+		SourcePrefixV6:          intPtr(64),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create limits: %v", err)
+	}
+	limiter := newConnectionLimiter(limits)
+	acquire := func(address string) (func(), string) {
+		return limiter.acquire(&net.TCPAddr{IP: net.ParseIP(address), Port: 1000})
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		reason  string
+	}{
+		{name: "first IPv4", address: "10.0.0.1"},
+		{name: "another IP of the network", address: "10.0.0.2"},
+		{name: "third IP of the network", address: "10.0.0.3", reason: LimitMaxPerSource},
+		{name: "IPv4 mapped IPv6 of the network", address: "::ffff:10.0.0.4", reason: LimitMaxPerSource},
+		{name: "another IPv4 network", address: "10.0.1.1"},
+		{name: "first IPv6", address: "2001:db8::1"},
+		{name: "another IP of the IPv6 network", address: "2001:db8::ffff:1"},
+		{name: "third IP of the IPv6 network", address: "2001:db8::2", reason: LimitMaxPerSource},
+		{name: "another IPv6 network", address: "2001:db8:0:1::1"},
+		{name: "maximum connections", address: "10.0.2.1", reason: LimitMaxConnections},
+	}
+	releases := make(map[string]func())
+	for _, test := range tests {
+		release, reason := acquire(test.address)
+		if reason != test.reason || (release == nil) != (test.reason != "") {
+			t.Fatalf("%s: expected `%s`, got `%s`", test.name, test.reason, reason)
+		}
+		releases[test.address] = release
+	}
+	if len(limiter.perSource) != 4 || limiter.perSource["10.0.0.0"] != 2 || limiter.perSource["2001:db8::"] != 2 {
+		t.Fatalf("Unexpected connections per source: %v", limiter.perSource)
+	}
+
+	// releasing a connection twice only free one connection
+	releases["10.0.0.1"]()
+	releases["10.0.0.1"]()
+	if limiter.connections != 5 || limiter.perSource["10.0.0.0"] != 1 {
+		t.Fatalf("Expected a single connection to be released, got %d, %v", limiter.connections, limiter.perSource)
+	}
+	if release, reason := acquire("10.0.0.3"); release == nil {
+		t.Fatalf("Expected connection of the network to be accepted after a release, got `%s`", reason)
+	}
+
+	releases["10.0.1.1"]()
+	if _, found := limiter.perSource["10.0.1.0"]; found {
+		t.Error("Expected source without connections to be removed")
+	}
+
+	// clients without IP are only counted in maximum connections
+	releases["2001:db8::1"]()
+	if release, reason := limiter.acquire(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}); release == nil {
+		t.Errorf("Expected client without IP to be accepted, got `%s`", reason)
+	}
+	if limiter.connections != 5 || len(limiter.perSource) != 3 {
+		t.Errorf("Expected client without IP to have no source, got %d, %v", limiter.connections, limiter.perSource)
+	}
+
+	var unlimited *connectionLimiter
+	if release, _ := unlimited.acquire(nil); release == nil {
+		t.Error("Expected nil limiter to accept every connection")
+	}
+}
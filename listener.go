@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+const (
+	// defaultHandshakeTimeout default maximum time of the TLS handshake and WS upgrade of a client
+	defaultHandshakeTimeout = 10 * time.Second
+
+	HandshakeStageTLS       = "tls"
+	HandshakeStageSniff     = "sniff"
+	HandshakeStageWsUpgrade = "ws_upgrade"
+)
+
+// newHandshakeTimeout validate the configured handshake timeout, or return the default if it is `nil`
+func newHandshakeTimeout(value *time.Duration) (time.Duration, error) {
+	if value == nil {
+		return defaultHandshakeTimeout, nil
+	}
+	if *value <= 0 {
+		return 0, helpers.StringError("`handshakeTimeout` must be positive")
+	}
+	return *value, nil
+}
+
+//region preparingListener
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// preparingListener is a listener that prepare the connections(for example read their PROXY header or complete
+// their TLS handshake) before they are returned by `Accept`. Connections are prepared in the background, so a slow
+// client does not block other clients
+type preparingListener struct {
+	net.Listener
+	prepare   func(conn net.Conn) (net.Conn, error)
+	logger    helpers.Logger
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPreparingListener(
+	listener net.Listener,
+	prepare func(conn net.Conn) (net.Conn, error),
+	logger helpers.Logger,
+) net.Listener {
+	result := &preparingListener{
+		Listener: listener,
+		prepare:  prepare,
+		logger:   logger,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go result.acceptLoop()
+	return result
+}
+
+func (this *preparingListener) deliver(result acceptResult) bool {
+	select {
+	case this.accepted <- result:
+		return true
+	case <-this.done:
+		return false
+	}
+}
+func (this *preparingListener) acceptLoop() {
+	for {
+		conn, err := this.Listener.Accept()
+		if err != nil {
+			if !this.deliver(acceptResult{err: err}) {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go func() {
+			prepared, err := this.prepare(conn)
+			if err != nil {
+				this.logger.Warnf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if !this.deliver(acceptResult{conn: prepared}) {
+				prepared.Close()
+			}
+		}()
+	}
+}
+
+func (this *preparingListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-this.accepted:
+		return result.conn, result.err
+	case <-this.done:
+		return nil, ListenerClosed
+	}
+}
+func (this *preparingListener) Close() error {
+	this.closeOnce.Do(func() { close(this.done) })
+	return this.Listener.Close()
+}
+
+//endregion
+
+// newTLSListener create a listener that complete TLS handshake of the connections before they are returned by
+// `Accept`, connections that do not finish their handshake in `timeout` are closed. `address` is only used in
+// metrics
+func newTLSListener(
+	listener net.Listener,
+	config *tls.Config,
+	timeout time.Duration,
+	address string,
+	logger helpers.Logger,
+) net.Listener {
+	return newPreparingListener(listener, func(conn net.Conn) (net.Conn, error) {
+		conn.SetDeadline(time.Now().Add(timeout))
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			if isTimeout(err) {
+				OnHandshakeTimeout(address, HandshakeStageTLS)
+			}
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}, logger)
+}
@@ -36,6 +36,9 @@ func InitializeLogging(config *LoggingConfig) error {
 			Template:  defaultLogTemplate,
 		}
 	} else {
+		// do not change the caller's config, it is compared with reloaded configurations
+		copied := *config
+		config = &copied
 		if config.Level == nil {
 			config.Level = &defaultLevel
 		}
@@ -13,6 +13,7 @@ import (
 type Config struct {
 	Logging  *LoggingConfig `yaml:"logging,omitempty"`
 	Metrics  *MetricsConfig `yaml:"metrics,omitempty"`
+	Admin    *AdminConfig   `yaml:"admin,omitempty"`
 	Services map[string]MQTTServiceConfig
 }
 
@@ -65,25 +66,19 @@ func main() {
 	}
 	defer StopMetrics()
 
-	services := make([]helpers.Service, 0, len(config.Services))
-	for svcName, svcConfig := range config.Services {
-		service, enabled, err := CreateService(svcName, svcConfig)
-		if err != nil {
-			GetMainLogger().Fatalf("Failed to load service(%v): %v",
-				helpers.CContent(helpers.Green, svcName),
-				helpers.CContent(helpers.Orange, err))
-		}
-		if !enabled {
-			GetMainLogger().Verbosef(1, "Ignoring service(%v) as it is not enabled",
-				helpers.CContent(helpers.Green, svcName))
-		}
-
-		services = append(services, service)
+	manager, err := NewProxyManager(configFilePath, config)
+	if err != nil {
+		GetMainLogger().Fatalf("Failed to load services: %v", helpers.CContent(helpers.Orange, err))
+	}
+
+	err = InitializeAdmin(config.Admin, manager)
+	if err != nil {
+		GetMainLogger().Fatalf("Failed to initialize admin API: %v", helpers.CContent(helpers.Orange, err))
 	}
+	defer StopAdmin()
 
 	stopRequested := make(chan struct{})
-	svc := helpers.MergeServices("Application Services", services...)
-	stopped := helpers.ExecuteServiceAsync(svc, stopRequested)
+	stopped := helpers.ExecuteServiceAsync(manager, stopRequested)
 
 	helpers.WaitForApplicationTermination(func() {
 		GetMainLogger().Debug("Close signal received")
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// factories create their loggers, so logging must be ready before any test
+	if err := InitializeLogging(nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
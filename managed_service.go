@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/devops-simba/helpers"
+)
+
+// managedService is a service that is executed in the background and may be stopped individually, so components
+// of a running service can be added or removed without touching the others
+type managedService struct {
+	Service helpers.Service
+
+	stopRequested chan struct{}
+	stopOnce      sync.Once
+	done          chan struct{}
+}
+
+// listeningService is implemented by services that bind their address before they run, so an address that can not
+// be used is reported to the caller of `startManagedService` instead of being logged in the background
+type listeningService interface {
+	helpers.Service
+	Listen() error
+}
+
+func startManagedService(logger helpers.Logger, service helpers.Service) (*managedService, error) {
+	if listening, ok := service.(listeningService); ok {
+		if err := listening.Listen(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &managedService{
+		Service:       service,
+		stopRequested: make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	stopped := helpers.ExecuteServiceAsync(service, result.stopRequested)
+	go func() {
+		if err := <-stopped; err != nil {
+			logger.Errorf("`%s` stopped with an error: %v", service.GetName(), err)
+		}
+		close(result.done)
+	}()
+	return result, nil
+}
+
+// Stop request the service to stop and wait for it
+func (this *managedService) Stop() {
+	this.stopOnce.Do(func() { close(this.stopRequested) })
+	<-this.done
+}
@@ -19,12 +19,27 @@ const (
 	lbBackend        = "backend"
 	lbProtocol       = "protocol"
 	lbNewBackend     = "new_backend_name"
+	lbFrom           = "from"
+	lbTo             = "to"
+	lbResult         = "result"
+	lbAction         = "action"
+	lbReason         = "reason"
+	lbAddress        = "address"
+	lbStage          = "stage"
 
 	numConnectedClients         = "mqproxy_connected_clients"
 	numRequests                 = "mqproxy_proxy_requests_total"
 	histogramResponseTime       = "mqproxy_response_duration_seconds"
 	succeededBackendConnections = "mqproxy_succeeded_backend_connections_total"
 	failedBackendConnections    = "mqproxy_failed_backend_connections_total"
+	backendHealth               = "mqproxy_backend_health"
+	backendAvailability         = "mqproxy_backend_availability_status"
+	backendAvailabilityChanges  = "mqproxy_backend_availability_transitions_total"
+	backendDrained              = "mqproxy_backend_drained"
+	authResults                 = "mqproxy_auth_results_total"
+	aclDenied                   = "mqproxy_acl_denied_total"
+	connectionsRejected         = "mqproxy_connections_rejected_total"
+	handshakeTimeouts           = "mqproxy_handshake_timeouts_total"
 )
 
 var (
@@ -69,6 +84,70 @@ var (
 		}, []string{lbBackend},
 	)
 
+	// Labels: backend
+	metricBackendHealth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: backendHealth,
+			Help: "Result of active health checks of a backend, 1 for healthy, 0 for unhealthy and -1 for unknown",
+		}, []string{lbBackend},
+	)
+
+	// Labels: backend
+	metricBackendAvailability = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: backendAvailability,
+			Help: "Availability status of a backend, 0: available, 1: unknown, 2: unavailable, 3: half-open",
+		}, []string{lbBackend},
+	)
+
+	// Labels: backend, from, to
+	metricBackendAvailabilityChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: backendAvailabilityChanges,
+			Help: "Number of times that availability status of a backend changed",
+		}, []string{lbBackend, lbFrom, lbTo},
+	)
+
+	// Labels: service, result
+	metricAuthResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: authResults,
+			Help: "Number of authenticated clients by the result of their authentication",
+		}, []string{lbService, lbResult},
+	)
+
+	// Labels: service, action
+	metricACLDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: aclDenied,
+			Help: "Number of PUBLISH packets and subscriptions that are rejected by the ACL",
+		}, []string{lbService, lbAction},
+	)
+
+	// Labels: service, frontend, reason
+	metricConnectionsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: connectionsRejected,
+			Help: "Number of connections that are rejected by the limits, the IP filter or the CONNECT timeout",
+		}, []string{lbService, lbFrontend, lbReason},
+	)
+
+	// Labels: address, stage
+	metricHandshakeTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: handshakeTimeouts,
+			Help: "Number of connections that are closed because they did not finish TLS handshake or WS upgrade in time",
+		}, []string{lbAddress, lbStage},
+	)
+
+	// Labels: backend
+	metricBackendDrained = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: backendDrained,
+			Help: "1 when a draining backend has no connection left, 0 while it is draining",
+		}, []string{lbBackend},
+	)
+
 	metricsServer *http.Server   = nil
 	metricsLogger helpers.Logger = nil
 )
@@ -121,7 +200,58 @@ func InitializeMetrics(config *MetricsConfig) error {
 		return err
 	}
 
+	err = prometheus.Register(metricBackendHealth)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", backendHealth, err)
+		return err
+	}
+
+	err = prometheus.Register(metricBackendAvailability)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", backendAvailability, err)
+		return err
+	}
+
+	err = prometheus.Register(metricBackendAvailabilityChanges)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", backendAvailabilityChanges, err)
+		return err
+	}
+
+	err = prometheus.Register(metricBackendDrained)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", backendDrained, err)
+		return err
+	}
+
+	err = prometheus.Register(metricAuthResults)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", authResults, err)
+		return err
+	}
+
+	err = prometheus.Register(metricACLDenied)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", aclDenied, err)
+		return err
+	}
+
+	err = prometheus.Register(metricConnectionsRejected)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", connectionsRejected, err)
+		return err
+	}
+
+	err = prometheus.Register(metricHandshakeTimeouts)
+	if err != nil {
+		metricsLogger.Errorf("Failed to register metric `%s`: %v", handshakeTimeouts, err)
+		return err
+	}
+
 	if config.Address == "" {
+		// do not change the caller's config, it is compared with reloaded configurations
+		copied := *config
+		config = &copied
 		config.Address = "http://:8080/metrics/"
 	}
 	u, err := ParseUrl(config.Address, "http")
@@ -230,3 +360,72 @@ func OnBackendConnectionFailed(backend string) {
 	c := metricFailedBackendConnections.WithLabelValues(backend)
 	c.Inc()
 }
+func OnBackendHealthChanged(backend string, state HealthState) {
+	if metricsServer == nil {
+		return
+	}
+
+	g := metricBackendHealth.WithLabelValues(backend)
+	switch state {
+	case Healthy:
+		g.Set(1)
+	case Unhealthy:
+		g.Set(0)
+	default:
+		g.Set(-1)
+	}
+}
+func OnBackendAvailabilityChanged(backend string, from, to AvailabilityStatus) {
+	if metricsServer == nil {
+		return
+	}
+
+	metricBackendAvailability.WithLabelValues(backend).Set(float64(to))
+	c := metricBackendAvailabilityChanges.WithLabelValues(backend, from.String(), to.String())
+	c.Inc()
+}
+func OnBackendDrainChanged(backend string, drained bool) {
+	if metricsServer == nil {
+		return
+	}
+
+	g := metricBackendDrained.WithLabelValues(backend)
+	if drained {
+		g.Set(1)
+	} else {
+		g.Set(0)
+	}
+}
+func OnAuthResult(serviceName, result string) {
+	if metricsServer == nil {
+		return
+	}
+
+	c := metricAuthResults.WithLabelValues(serviceName, result)
+	c.Inc()
+}
+func OnACLDenied(serviceName, action string) {
+	if metricsServer == nil {
+		return
+	}
+
+	c := metricACLDenied.WithLabelValues(serviceName, action)
+	c.Inc()
+}
+
+func OnConnectionRejected(serviceName, frontend, reason string) {
+	if metricsServer == nil {
+		return
+	}
+
+	c := metricConnectionsRejected.WithLabelValues(serviceName, frontend, reason)
+	c.Inc()
+}
+func OnHandshakeTimeout(address, stage string) {
+	if metricsServer == nil {
+		return
+	}
+
+	c := metricHandshakeTimeouts.WithLabelValues(address, stage)
+	c.Inc()
+}
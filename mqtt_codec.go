@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/devops-simba/helpers"
+)
+
+// protocol levels of MQTT
+const (
+	MQTT31  byte = 3
+	MQTT311 byte = 4
+	MQTT5   byte = 5
+)
+
+type PacketType byte
+
+const (
+	PacketConnect     PacketType = 1
+	PacketConnack     PacketType = 2
+	PacketPublish     PacketType = 3
+	PacketPuback      PacketType = 4
+	PacketPubrec      PacketType = 5
+	PacketPubrel      PacketType = 6
+	PacketPubcomp     PacketType = 7
+	PacketSubscribe   PacketType = 8
+	PacketSuback      PacketType = 9
+	PacketUnsubscribe PacketType = 10
+	PacketUnsuback    PacketType = 11
+	PacketPingreq     PacketType = 12
+	PacketPingresp    PacketType = 13
+	PacketDisconnect  PacketType = 14
+	PacketAuth        PacketType = 15
+)
+
+const (
+	MalformedRemainingLength = helpers.StringError("Malformed remaining length")
+	MalformedPacket          = helpers.StringError("Malformed packet")
+	InvalidFixedHeaderFlags  = helpers.StringError("Invalid flags in the fixed header")
+	PacketTooLarge           = helpers.StringError("Packet is larger than the maximum packet size")
+
+	// maxPacketSize largest packet that is read from a connection, including its fixed header
+	maxPacketSize = 1024 * 1024
+	// maxConnectPacketSize largest CONNECT that is read from a client. CONNECT is read before the client is
+	// authenticated, so it is limited to the buffer of the raw mode
+	maxConnectPacketSize = 64 * 1024
+)
+
+var packetTypeNames = []string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+func (this PacketType) String() string {
+	if int(this) < len(packetTypeNames) {
+		return packetTypeNames[this]
+	}
+	return fmt.Sprintf("PacketType(%d)", byte(this))
+}
+
+// MQTTPacket is a decoded MQTT control packet. Body of most of the packets depend on the protocol version, so
+// version of the connection is needed to encode or decode them
+type MQTTPacket interface {
+	Type() PacketType
+	String() string
+
+	headerFlags() byte
+	encodeBody(encoder *packetEncoder, version byte)
+	decodeBody(decoder *packetDecoder, flags byte, version byte)
+}
+
+func newPacket(packetType PacketType) MQTTPacket {
+	switch packetType {
+	case PacketConnect:
+		return &ConnectPacket{}
+	case PacketConnack:
+		return &ConnackPacket{}
+	case PacketPublish:
+		return &PublishPacket{}
+	case PacketPuback, PacketPubrec, PacketPubrel, PacketPubcomp:
+		return &AckPacket{PacketType: packetType}
+	case PacketSubscribe:
+		return &SubscribePacket{}
+	case PacketSuback:
+		return &SubackPacket{}
+	case PacketUnsubscribe:
+		return &UnsubscribePacket{}
+	case PacketUnsuback:
+		return &UnsubackPacket{}
+	case PacketPingreq:
+		return &PingreqPacket{}
+	case PacketPingresp:
+		return &PingrespPacket{}
+	case PacketDisconnect:
+		return &DisconnectPacket{}
+	case PacketAuth:
+		return &AuthPacket{}
+	default:
+		return nil
+	}
+}
+
+//region packetDecoder
+// packetDecoder read fields of a packet, after first error every read return zero value and the error is kept
+type packetDecoder struct {
+	data []byte
+	err  error
+}
+
+func (this *packetDecoder) fail() {
+	if this.err == nil {
+		this.err = MalformedPacket
+	}
+	this.data = nil
+}
+func (this *packetDecoder) remaining() int { return len(this.data) }
+func (this *packetDecoder) readBytes(n int) []byte {
+	if n > len(this.data) {
+		this.fail()
+		return nil
+	}
+	result := this.data[:n:n]
+	this.data = this.data[n:]
+	return result
+}
+func (this *packetDecoder) readRest() []byte { return this.readBytes(len(this.data)) }
+func (this *packetDecoder) readByte() byte {
+	b := this.readBytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+func (this *packetDecoder) readUint16() uint16 {
+	b := this.readBytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+func (this *packetDecoder) readUint32() uint32 {
+	b := this.readBytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+func (this *packetDecoder) readVarint() uint32 {
+	var result uint32
+	for i := 0; i < 4; i++ {
+		b := this.readByte()
+		if this.err != nil {
+			return 0
+		}
+		result |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return result
+		}
+	}
+	this.fail()
+	return 0
+}
+func (this *packetDecoder) readBinary() []byte {
+	return this.readBytes(int(this.readUint16()))
+}
+func (this *packetDecoder) readString() string { return string(this.readBinary()) }
+
+//endregion
+
+//region packetEncoder
+type packetEncoder struct {
+	buffer []byte
+}
+
+func (this *packetEncoder) writeBytes(b []byte) { this.buffer = append(this.buffer, b...) }
+func (this *packetEncoder) writeByte(b byte)    { this.buffer = append(this.buffer, b) }
+func (this *packetEncoder) writeUint16(v uint16) {
+	this.buffer = append(this.buffer, byte(v>>8), byte(v))
+}
+func (this *packetEncoder) writeUint32(v uint32) {
+	this.buffer = append(this.buffer, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+func (this *packetEncoder) writeVarint(v uint32) {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		this.buffer = append(this.buffer, b)
+		if v == 0 {
+			return
+		}
+	}
+}
+func (this *packetEncoder) writeBinary(b []byte) {
+	this.writeUint16(uint16(len(b)))
+	this.writeBytes(b)
+}
+func (this *packetEncoder) writeString(s string) {
+	this.writeUint16(uint16(len(s)))
+	this.buffer = append(this.buffer, s...)
+}
+
+//endregion
+
+// readPacketBytes read a complete MQTT control packet from the reader and return its raw content,
+// including the fixed header. Packets larger than `maxSize` are rejected before their body is read
+func readPacketBytes(r io.Reader, maxSize int) ([]byte, error) {
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 1)
+	remainingLength := 0
+	multiplier := 1
+	for {
+		if len(header) == 5 {
+			return nil, MalformedRemainingLength
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+		remainingLength += int(b[0]&127) * multiplier
+		if b[0]&128 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if len(header)+remainingLength > maxSize {
+		return nil, PacketTooLarge
+	}
+
+	result := make([]byte, len(header)+remainingLength)
+	copy(result, header)
+	if _, err := io.ReadFull(r, result[len(header):]); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// packetLength return length of the first packet in the buffer, including its fixed header. If the buffer does
+// not contain a complete packet, it returns 0
+func packetLength(buffer []byte) (int, error) {
+	remainingLength := 0
+	multiplier := 1
+	for i := 1; i < len(buffer); i++ {
+		if i == 5 {
+			return 0, MalformedRemainingLength
+		}
+		remainingLength += int(buffer[i]&127) * multiplier
+		if buffer[i]&128 == 0 {
+			length := i + 1 + remainingLength
+			if length > len(buffer) {
+				return 0, nil
+			}
+			return length, nil
+		}
+		multiplier *= 128
+	}
+	return 0, nil
+}
+
+// DecodePacket decode a complete packet that is read by `readPacketBytes`
+func DecodePacket(raw []byte, version byte) (MQTTPacket, error) {
+	decoder := &packetDecoder{data: raw}
+	header := decoder.readByte()
+	decoder.readVarint()
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+
+	packetType := PacketType(header >> 4)
+	packet := newPacket(packetType)
+	if packet == nil {
+		return nil, fmt.Errorf("Invalid packet type: %d", byte(packetType))
+	}
+
+	flags := header & 0x0F
+	if packetType != PacketPublish && flags != packet.headerFlags() {
+		return nil, fmt.Errorf("%w(%v)", InvalidFixedHeaderFlags, packetType)
+	}
+
+	packet.decodeBody(decoder, flags, version)
+	if decoder.err != nil {
+		return nil, fmt.Errorf("Failed to decode %v: %w", packetType, decoder.err)
+	}
+	return packet, nil
+}
+
+// EncodePacket encode the packet, including its fixed header
+func EncodePacket(packet MQTTPacket, version byte) []byte {
+	body := &packetEncoder{}
+	packet.encodeBody(body, version)
+
+	result := &packetEncoder{buffer: make([]byte, 0, len(body.buffer)+5)}
+	result.writeByte(byte(packet.Type())<<4 | packet.headerFlags())
+	result.writeVarint(uint32(len(body.buffer)))
+	result.writeBytes(body.buffer)
+	return result.buffer
+}
+
+// ReadPacket read and decode a packet from the reader
+func ReadPacket(r io.Reader, version byte) (MQTTPacket, error) {
+	raw, err := readPacketBytes(r, maxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePacket(raw, version)
+}
+
+// WritePacket encode the packet and write it in a single call
+func WritePacket(w io.Writer, packet MQTTPacket, version byte) error {
+	_, err := w.Write(EncodePacket(packet, version))
+	return err
+}
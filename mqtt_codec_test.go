@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	result, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("Invalid hex string `%s`: %v", s, err)
+	}
+	return result
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	props := Properties{
+		{ID: PropUserProperty, Data: []byte("name"), Value: []byte("value")},
+		{ID: PropContentType, Data: []byte("text/plain")},
+		{ID: PropMessageExpiryInterval, Int: 3600},
+		{ID: PropSubscriptionIdentifier, Int: 268435455},
+		{ID: PropTopicAlias, Int: 7},
+		{ID: PropPayloadFormatIndicator, Int: 1},
+		{ID: PropCorrelationData, Data: []byte{0, 1, 2}},
+	}
+
+	tests := []struct {
+		name    string
+		version byte
+		packet  MQTTPacket
+		// raw expected encoding, it is not checked if it is empty
+		raw string
+	}{
+		{name: "connect", version: MQTT311, packet: &ConnectPacket{
+			ProtocolName: "MQTT", ProtocolVersion: MQTT311, CleanSession: true, KeepAlive: 60, ClientID: "c",
+		}, raw: "10 0d 0004 4d515454 04 02 003c 0001 63"},
+		{name: "connect with will and credentials", version: MQTT311, packet: &ConnectPacket{
+			ProtocolName: "MQTT", ProtocolVersion: MQTT311, KeepAlive: 10, ClientID: "client",
+			WillFlag: true, WillQoS: 2, WillRetain: true, WillTopic: "will", WillPayload: []byte("bye"),
+			UsernameFlag: true, Username: "user", PasswordFlag: true, Password: []byte("pass"),
+		}},
+		{name: "connect 5", version: MQTT5, packet: &ConnectPacket{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: MQTT5,
+			KeepAlive:       30,
+			Properties:      Properties{{ID: PropSessionExpiryInterval, Int: 120}, {ID: PropReceiveMaximum, Int: 10}},
+			ClientID:        "client",
+			WillFlag:        true,
+			WillProperties:  Properties{{ID: PropWillDelayInterval, Int: 5}},
+			WillTopic:       "will",
+			WillPayload:     []byte("bye"),
+			PasswordFlag:    true,
+			Password:        []byte("token"),
+		}},
+		{name: "connack", version: MQTT311, packet: &ConnackPacket{SessionPresent: true, ReasonCode: 5},
+			raw: "20 02 01 05"},
+		{name: "connack 5", version: MQTT5, packet: &ConnackPacket{
+			ReasonCode: ReasonNotAuthorized,
+			Properties: Properties{{ID: PropServerKeepAlive, Int: 20}, {ID: PropReasonString, Data: []byte("no")}},
+		}},
+		{name: "publish qos 0", version: MQTT311, packet: &PublishPacket{TopicName: "a/b", Payload: []byte("hi")},
+			raw: "30 07 0003 612f62 6869"},
+		{name: "publish qos 2", version: MQTT311, packet: &PublishPacket{
+			Dup: true, QoS: 2, Retain: true, TopicName: "a/b", PacketID: 10, Payload: []byte("hi"),
+		}, raw: "3d 09 0003 612f62 000a 6869"},
+		{name: "publish 5", version: MQTT5, packet: &PublishPacket{
+			QoS: 1, TopicName: "a/b", PacketID: 1, Properties: props, Payload: []byte("hi"),
+		}},
+		{name: "puback", version: MQTT311, packet: &AckPacket{PacketType: PacketPuback, PacketID: 1},
+			raw: "40 02 0001"},
+		{name: "pubrel", version: MQTT311, packet: &AckPacket{PacketType: PacketPubrel, PacketID: 1},
+			raw: "62 02 0001"},
+		{name: "pubrec 5 success", version: MQTT5, packet: &AckPacket{PacketType: PacketPubrec, PacketID: 2},
+			raw: "50 02 0002"},
+		{name: "pubcomp 5", version: MQTT5, packet: &AckPacket{
+			PacketType: PacketPubcomp, PacketID: 3, ReasonCode: 0x92,
+			Properties: Properties{{ID: PropReasonString, Data: []byte("unknown")}},
+		}},
+		{name: "puback 5 reason", version: MQTT5, packet: &AckPacket{
+			PacketType: PacketPuback, PacketID: 4, ReasonCode: ReasonNotAuthorized,
+		}, raw: "40 03 0004 87"},
+		{name: "subscribe", version: MQTT311, packet: &SubscribePacket{
+			PacketID: 1, Subscriptions: []Subscription{{TopicFilter: "a/#", QoS: 1}, {TopicFilter: "b", QoS: 2}},
+		}, raw: "82 0c 0001 0003 612f23 01 0001 62 02"},
+		{name: "subscribe 5", version: MQTT5, packet: &SubscribePacket{
+			PacketID:   1,
+			Properties: Properties{{ID: PropSubscriptionIdentifier, Int: 128}},
+			Subscriptions: []Subscription{
+				{TopicFilter: "a", QoS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+			},
+		}},
+		{name: "suback", version: MQTT311, packet: &SubackPacket{
+			PacketID: 1, ReasonCodes: []ReasonCode{ReasonGrantedQoS1, 0x80},
+		}, raw: "90 04 0001 01 80"},
+		{name: "suback 5", version: MQTT5, packet: &SubackPacket{
+			PacketID: 1, Properties: Properties{{ID: PropReasonString, Data: []byte("ok")}},
+			ReasonCodes: []ReasonCode{ReasonNotAuthorized},
+		}},
+		{name: "unsubscribe", version: MQTT311, packet: &UnsubscribePacket{
+			PacketID: 1, TopicFilters: []string{"a", "b/c"},
+		}, raw: "a2 0a 0001 0001 61 0003 622f63"},
+		{name: "unsubscribe 5", version: MQTT5, packet: &UnsubscribePacket{
+			PacketID: 1, Properties: Properties{{ID: PropUserProperty, Data: []byte("k"), Value: []byte("v")}},
+			TopicFilters: []string{"a"},
+		}},
+		{name: "unsuback", version: MQTT311, packet: &UnsubackPacket{PacketID: 1}, raw: "b0 02 0001"},
+		{name: "unsuback 5", version: MQTT5, packet: &UnsubackPacket{
+			PacketID: 1, ReasonCodes: []ReasonCode{ReasonSuccess, ReasonNoSubscriptionExisted},
+		}, raw: "b0 05 0001 00 00 11"},
+		{name: "pingreq", version: MQTT311, packet: &PingreqPacket{}, raw: "c0 00"},
+		{name: "pingresp", version: MQTT5, packet: &PingrespPacket{}, raw: "d0 00"},
+		{name: "disconnect", version: MQTT311, packet: &DisconnectPacket{}, raw: "e0 00"},
+		{name: "disconnect 5 success", version: MQTT5, packet: &DisconnectPacket{}, raw: "e0 00"},
+		{name: "disconnect 5", version: MQTT5, packet: &DisconnectPacket{
+			ReasonCode: 0x8E, Properties: Properties{{ID: PropServerReference, Data: []byte("other")}},
+		}},
+		{name: "auth 5", version: MQTT5, packet: &AuthPacket{
+			ReasonCode: ReasonContinueAuthentication,
+			Properties: Properties{
+				{ID: PropAuthenticationMethod, Data: []byte("SCRAM")},
+				{ID: PropAuthenticationData, Data: []byte{1, 2}},
+			},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := EncodePacket(test.packet, test.version)
+			if test.raw != "" && !bytes.Equal(raw, mustDecodeHex(t, test.raw)) {
+				t.Errorf("Expected encoding `%s`, got `%x`", test.raw, raw)
+			}
+
+			length, err := packetLength(raw)
+			if err != nil || length != len(raw) {
+				t.Errorf("Expected packet length %d, got %d: %v", len(raw), length, err)
+			}
+
+			packet, err := ReadPacket(bytes.NewReader(raw), test.version)
+			if err != nil {
+				t.Fatalf("Failed to decode `%x`: %v", raw, err)
+			}
+			if !reflect.DeepEqual(packet, test.packet) {
+				t.Errorf("Expected %v, got %v", test.packet, packet)
+			}
+		})
+	}
+}
+
+func TestDecodeOlderPackets(t *testing.T) {
+	// MQTT 5 connections may receive packets without reason code and properties
+	tests := []struct {
+		name   string
+		raw    string
+		packet MQTTPacket
+	}{
+		{name: "connack of a MQTT 3.1.1 server", raw: "20 02 00 00", packet: &ConnackPacket{}},
+		{name: "puback without reason", raw: "40 02 0001", packet: &AckPacket{PacketType: PacketPuback, PacketID: 1}},
+		{name: "puback without properties", raw: "40 03 0001 10",
+			packet: &AckPacket{PacketType: PacketPuback, PacketID: 1, ReasonCode: 0x10}},
+		{name: "disconnect with reason", raw: "e0 01 8e", packet: &DisconnectPacket{ReasonCode: 0x8E}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := DecodePacket(mustDecodeHex(t, test.raw), MQTT5)
+			if err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if !reflect.DeepEqual(packet, test.packet) {
+				t.Errorf("Expected %v, got %v", test.packet, packet)
+			}
+		})
+	}
+}
+
+func TestPacketLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+		length int
+		err    error
+	}{
+		{name: "empty", buffer: nil},
+		{name: "only type", buffer: []byte{0x30}},
+		{name: "empty body", buffer: []byte{0xC0, 0x00}, length: 2},
+		{name: "incomplete body", buffer: []byte{0x30, 0x05, 'a', 'b'}},
+		{name: "next packet is ignored", buffer: []byte{0xC0, 0x00, 0xD0, 0x00}, length: 2},
+		{name: "incomplete length", buffer: []byte{0x30, 0x80}},
+		{name: "two byte length", buffer: append([]byte{0x30, 0x80, 0x01}, make([]byte, 128)...), length: 131},
+		{name: "two byte length incomplete", buffer: append([]byte{0x30, 0x80, 0x01}, make([]byte, 127)...)},
+		{name: "four byte length incomplete", buffer: []byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}},
+		{name: "five byte length", buffer: []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+			err: MalformedRemainingLength},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			length, err := packetLength(test.buffer)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Errorf("Expected error `%v`, got `%v`", test.err, err)
+			}
+			if length != test.length {
+				t.Errorf("Expected length %d, got %d", test.length, length)
+			}
+		})
+	}
+}
+
+func TestReadPacketBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{name: "empty", raw: nil, err: io.EOF},
+		{name: "truncated length", raw: []byte{0x30, 0x80}, err: io.EOF},
+		{name: "truncated body", raw: []byte{0x30, 0x05, 'a'}, err: io.ErrUnexpectedEOF},
+		{name: "five byte length", raw: []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, err: MalformedRemainingLength},
+		// body of the largest possible packet is never sent, packet must be rejected by its length
+		{name: "too large", raw: []byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}, err: PacketTooLarge},
+		{name: "larger than limit", raw: []byte{0x10, 0x81, 0x80, 0x04}, err: PacketTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readPacketBytes(bytes.NewReader(test.raw), maxConnectPacketSize); !errors.Is(err, test.err) {
+				t.Errorf("Expected error `%v`, got `%v`", test.err, err)
+			}
+		})
+	}
+
+	// smallest length that need 3 bytes, next packet must not be read
+	raw := append([]byte{0x30, 0x80, 0x80, 0x01}, make([]byte, 16384)...)
+	result, err := readPacketBytes(bytes.NewReader(append(raw, 0xC0, 0x00)), maxConnectPacketSize)
+	if err != nil || !bytes.Equal(result, raw) {
+		t.Errorf("Failed to read a packet with 3 bytes length: %v", err)
+	}
+}
+
+func TestDecodeMalformedPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		raw     string
+		err     error
+	}{
+		{name: "empty", version: MQTT311, raw: "", err: MalformedPacket},
+		{name: "truncated length", version: MQTT311, raw: "30 80", err: MalformedPacket},
+		{name: "oversized length", version: MQTT311, raw: "30 ff ff ff ff 01", err: MalformedPacket},
+		{name: "reserved type", version: MQTT311, raw: "00 00"},
+		{name: "subscribe flags", version: MQTT311, raw: "80 06 0001 0001 61 00", err: InvalidFixedHeaderFlags},
+		{name: "pubrel flags", version: MQTT311, raw: "60 02 0001", err: InvalidFixedHeaderFlags},
+		{name: "pingreq flags", version: MQTT311, raw: "c1 00", err: InvalidFixedHeaderFlags},
+		{name: "publish qos 3", version: MQTT311, raw: "36 05 0001 61 0001", err: MalformedPacket},
+		{name: "publish truncated topic", version: MQTT311, raw: "30 03 0005 61", err: MalformedPacket},
+		{name: "publish missing packet id", version: MQTT311, raw: "32 03 0001 61", err: MalformedPacket},
+		{name: "connect reserved flag", version: MQTT311, raw: "10 0d 0004 4d515454 04 03 003c 0001 63",
+			err: MalformedPacket},
+		{name: "connect missing password", version: MQTT311, raw: "10 0d 0004 4d515454 04 42 003c 0001 63",
+			err: MalformedPacket},
+		{name: "subscribe without filter", version: MQTT311, raw: "82 02 0001", err: MalformedPacket},
+		{name: "subscribe without options", version: MQTT311, raw: "82 05 0001 0001 61", err: MalformedPacket},
+		{name: "unsubscribe without filter", version: MQTT311, raw: "a2 02 0001", err: MalformedPacket},
+		{name: "properties longer than packet", version: MQTT5, raw: "30 06 0001 61 05 0101", err: MalformedPacket},
+		{name: "truncated properties length", version: MQTT5, raw: "30 04 0001 61 80", err: MalformedPacket},
+		{name: "oversized properties length", version: MQTT5, raw: "30 08 0001 61 ff ff ff ff 01",
+			err: MalformedPacket},
+		{name: "unknown property", version: MQTT5, raw: "30 06 0001 61 02 0001", err: MalformedPacket},
+		{name: "truncated property value", version: MQTT5, raw: "30 07 0001 61 03 02 0001", err: MalformedPacket},
+		{name: "truncated string property", version: MQTT5, raw: "30 08 0001 61 04 03 0005 61",
+			err: MalformedPacket},
+		{name: "truncated user property", version: MQTT5, raw: "30 0b 0001 61 07 26 0001 6b 0003 76",
+			err: MalformedPacket},
+		{name: "oversized varint property", version: MQTT5, raw: "30 0a 0001 61 06 0b ff ff ff ff 01",
+			err: MalformedPacket},
+		{name: "connack properties", version: MQTT5, raw: "20 04 00 00 02 13", err: MalformedPacket},
+		{name: "disconnect properties", version: MQTT5, raw: "e0 03 00 01 26", err: MalformedPacket},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := DecodePacket(mustDecodeHex(t, test.raw), test.version)
+			if err == nil {
+				t.Fatalf("Expected an error, got %v", packet)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("Expected error `%v`, got `%v`", test.err, err)
+			}
+		})
+	}
+}
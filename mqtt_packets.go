@@ -0,0 +1,514 @@
+package main
+
+import (
+	"fmt"
+)
+
+//region ConnectPacket
+type ConnectPacket struct {
+	ProtocolName    string
+	ProtocolVersion byte
+	// CleanSession is `Clean Start` in MQTT 5
+	CleanSession bool
+	WillFlag     bool
+	WillQoS      byte
+	WillRetain   bool
+	UsernameFlag bool
+	PasswordFlag bool
+	KeepAlive    uint16
+	Properties   Properties
+
+	ClientID       string
+	WillProperties Properties
+	WillTopic      string
+	WillPayload    []byte
+	Username       string
+	Password       []byte
+}
+
+func (this *ConnectPacket) Type() PacketType  { return PacketConnect }
+func (this *ConnectPacket) headerFlags() byte { return 0 }
+func (this *ConnectPacket) String() string {
+	return fmt.Sprintf("CONNECT{version: %d, clientId: %s, cleanSession: %v, keepAlive: %d, username: %s, "+
+		"will: %v, properties: %v}", this.ProtocolVersion, this.ClientID, this.CleanSession, this.KeepAlive,
+		this.Username, this.WillFlag, this.Properties)
+}
+
+// CONNECT carry the protocol version itself, so `version` is ignored
+func (this *ConnectPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.ProtocolName = decoder.readString()
+	this.ProtocolVersion = decoder.readByte()
+	connectFlags := decoder.readByte()
+	if connectFlags&0x01 != 0 {
+		decoder.fail() // reserved flag must be zero
+		return
+	}
+	this.CleanSession = connectFlags&0x02 != 0
+	this.WillFlag = connectFlags&0x04 != 0
+	this.WillQoS = (connectFlags >> 3) & 0x03
+	this.WillRetain = connectFlags&0x20 != 0
+	this.PasswordFlag = connectFlags&0x40 != 0
+	this.UsernameFlag = connectFlags&0x80 != 0
+	this.KeepAlive = decoder.readUint16()
+	if this.ProtocolVersion >= MQTT5 {
+		this.Properties = decoder.readProperties()
+	}
+
+	this.ClientID = decoder.readString()
+	if this.WillFlag {
+		if this.ProtocolVersion >= MQTT5 {
+			this.WillProperties = decoder.readProperties()
+		}
+		this.WillTopic = decoder.readString()
+		this.WillPayload = decoder.readBinary()
+	}
+	if this.UsernameFlag {
+		this.Username = decoder.readString()
+	}
+	if this.PasswordFlag {
+		this.Password = decoder.readBinary()
+	}
+}
+func (this *ConnectPacket) encodeBody(encoder *packetEncoder, version byte) {
+	var connectFlags byte
+	if this.CleanSession {
+		connectFlags |= 0x02
+	}
+	if this.WillFlag {
+		connectFlags |= 0x04 | (this.WillQoS&0x03)<<3
+		if this.WillRetain {
+			connectFlags |= 0x20
+		}
+	}
+	if this.PasswordFlag {
+		connectFlags |= 0x40
+	}
+	if this.UsernameFlag {
+		connectFlags |= 0x80
+	}
+
+	encoder.writeString(this.ProtocolName)
+	encoder.writeByte(this.ProtocolVersion)
+	encoder.writeByte(connectFlags)
+	encoder.writeUint16(this.KeepAlive)
+	if this.ProtocolVersion >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+	}
+
+	encoder.writeString(this.ClientID)
+	if this.WillFlag {
+		if this.ProtocolVersion >= MQTT5 {
+			encoder.writeProperties(this.WillProperties)
+		}
+		encoder.writeString(this.WillTopic)
+		encoder.writeBinary(this.WillPayload)
+	}
+	if this.UsernameFlag {
+		encoder.writeString(this.Username)
+	}
+	if this.PasswordFlag {
+		encoder.writeBinary(this.Password)
+	}
+}
+
+//endregion
+
+//region ConnackPacket
+type ConnackPacket struct {
+	SessionPresent bool
+	// ReasonCode is the return code of CONNACK in MQTT 3.1.1
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (this *ConnackPacket) Type() PacketType  { return PacketConnack }
+func (this *ConnackPacket) headerFlags() byte { return 0 }
+func (this *ConnackPacket) String() string {
+	return fmt.Sprintf("CONNACK{sessionPresent: %v, code: %d, properties: %v}",
+		this.SessionPresent, byte(this.ReasonCode), this.Properties)
+}
+func (this *ConnackPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.SessionPresent = decoder.readByte()&0x01 != 0
+	this.ReasonCode = ReasonCode(decoder.readByte())
+	// a server that does not support MQTT 5 answer with a MQTT 3.1.1 CONNACK that has no properties
+	if version >= MQTT5 && decoder.remaining() != 0 {
+		this.Properties = decoder.readProperties()
+	}
+}
+func (this *ConnackPacket) encodeBody(encoder *packetEncoder, version byte) {
+	if this.SessionPresent {
+		encoder.writeByte(1)
+	} else {
+		encoder.writeByte(0)
+	}
+	encoder.writeByte(byte(this.ReasonCode))
+	if version >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+	}
+}
+
+//endregion
+
+//region PublishPacket
+type PublishPacket struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	TopicName  string
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+func (this *PublishPacket) Type() PacketType { return PacketPublish }
+func (this *PublishPacket) headerFlags() byte {
+	var flags byte
+	if this.Dup {
+		flags |= 0x08
+	}
+	flags |= (this.QoS & 0x03) << 1
+	if this.Retain {
+		flags |= 0x01
+	}
+	return flags
+}
+func (this *PublishPacket) String() string {
+	return fmt.Sprintf("PUBLISH{topic: %s, qos: %d, retain: %v, dup: %v, packetId: %d, properties: %v, "+
+		"payload: %d bytes}", this.TopicName, this.QoS, this.Retain, this.Dup, this.PacketID, this.Properties,
+		len(this.Payload))
+}
+func (this *PublishPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.Dup = flags&0x08 != 0
+	this.QoS = (flags >> 1) & 0x03
+	this.Retain = flags&0x01 != 0
+	if this.QoS == 3 {
+		decoder.fail()
+		return
+	}
+
+	this.TopicName = decoder.readString()
+	if this.QoS > 0 {
+		this.PacketID = decoder.readUint16()
+	}
+	if version >= MQTT5 {
+		this.Properties = decoder.readProperties()
+	}
+	this.Payload = decoder.readRest()
+}
+func (this *PublishPacket) encodeBody(encoder *packetEncoder, version byte) {
+	encoder.writeString(this.TopicName)
+	if this.QoS > 0 {
+		encoder.writeUint16(this.PacketID)
+	}
+	if version >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+	}
+	encoder.writeBytes(this.Payload)
+}
+
+//endregion
+
+//region AckPacket
+// AckPacket is a PUBACK, PUBREC, PUBREL or PUBCOMP packet
+type AckPacket struct {
+	PacketType PacketType
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (this *AckPacket) Type() PacketType { return this.PacketType }
+func (this *AckPacket) headerFlags() byte {
+	if this.PacketType == PacketPubrel {
+		return 0x02
+	}
+	return 0
+}
+func (this *AckPacket) String() string {
+	return fmt.Sprintf("%v{packetId: %d, reason: %v, properties: %v}",
+		this.PacketType, this.PacketID, this.ReasonCode, this.Properties)
+}
+func (this *AckPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.PacketID = decoder.readUint16()
+	if version >= MQTT5 && decoder.remaining() != 0 {
+		this.ReasonCode = ReasonCode(decoder.readByte())
+		if decoder.remaining() != 0 {
+			this.Properties = decoder.readProperties()
+		}
+	}
+}
+func (this *AckPacket) encodeBody(encoder *packetEncoder, version byte) {
+	encoder.writeUint16(this.PacketID)
+	if version >= MQTT5 && (this.ReasonCode != ReasonSuccess || len(this.Properties) != 0) {
+		encoder.writeByte(byte(this.ReasonCode))
+		if len(this.Properties) != 0 {
+			encoder.writeProperties(this.Properties)
+		}
+	}
+}
+
+//endregion
+
+//region SubscribePacket
+type Subscription struct {
+	TopicFilter string
+	QoS         byte
+	// NoLocal, RetainAsPublished and RetainHandling are only available in MQTT 5
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+type SubscribePacket struct {
+	PacketID      uint16
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+func (this *SubscribePacket) Type() PacketType  { return PacketSubscribe }
+func (this *SubscribePacket) headerFlags() byte { return 0x02 }
+func (this *SubscribePacket) String() string {
+	filters := make([]string, len(this.Subscriptions))
+	for i := 0; i < len(this.Subscriptions); i++ {
+		filters[i] = fmt.Sprintf("%s(qos: %d)", this.Subscriptions[i].TopicFilter, this.Subscriptions[i].QoS)
+	}
+	return fmt.Sprintf("SUBSCRIBE{packetId: %d, subscriptions: %v, properties: %v}",
+		this.PacketID, filters, this.Properties)
+}
+func (this *SubscribePacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.PacketID = decoder.readUint16()
+	if version >= MQTT5 {
+		this.Properties = decoder.readProperties()
+	}
+	for decoder.err == nil && decoder.remaining() != 0 {
+		subscription := Subscription{TopicFilter: decoder.readString()}
+		options := decoder.readByte()
+		subscription.QoS = options & 0x03
+		if version >= MQTT5 {
+			subscription.NoLocal = options&0x04 != 0
+			subscription.RetainAsPublished = options&0x08 != 0
+			subscription.RetainHandling = (options >> 4) & 0x03
+		}
+		this.Subscriptions = append(this.Subscriptions, subscription)
+	}
+	if len(this.Subscriptions) == 0 {
+		decoder.fail()
+	}
+}
+func (this *SubscribePacket) encodeBody(encoder *packetEncoder, version byte) {
+	encoder.writeUint16(this.PacketID)
+	if version >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+	}
+	for i := 0; i < len(this.Subscriptions); i++ {
+		subscription := this.Subscriptions[i]
+		options := subscription.QoS & 0x03
+		if version >= MQTT5 {
+			if subscription.NoLocal {
+				options |= 0x04
+			}
+			if subscription.RetainAsPublished {
+				options |= 0x08
+			}
+			options |= (subscription.RetainHandling & 0x03) << 4
+		}
+		encoder.writeString(subscription.TopicFilter)
+		encoder.writeByte(options)
+	}
+}
+
+//endregion
+
+//region SubackPacket
+type SubackPacket struct {
+	PacketID   uint16
+	Properties Properties
+	// ReasonCodes one code for each subscription, they are the return codes in MQTT 3.1.1
+	ReasonCodes []ReasonCode
+}
+
+func (this *SubackPacket) Type() PacketType  { return PacketSuback }
+func (this *SubackPacket) headerFlags() byte { return 0 }
+func (this *SubackPacket) String() string {
+	return fmt.Sprintf("SUBACK{packetId: %d, codes: %v, properties: %v}",
+		this.PacketID, this.ReasonCodes, this.Properties)
+}
+func (this *SubackPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.PacketID = decoder.readUint16()
+	if version >= MQTT5 {
+		this.Properties = decoder.readProperties()
+	}
+	codes := decoder.readRest()
+	this.ReasonCodes = make([]ReasonCode, len(codes))
+	for i := 0; i < len(codes); i++ {
+		this.ReasonCodes[i] = ReasonCode(codes[i])
+	}
+}
+func (this *SubackPacket) encodeBody(encoder *packetEncoder, version byte) {
+	encoder.writeUint16(this.PacketID)
+	if version >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+	}
+	for i := 0; i < len(this.ReasonCodes); i++ {
+		encoder.writeByte(byte(this.ReasonCodes[i]))
+	}
+}
+
+//endregion
+
+//region UnsubscribePacket
+type UnsubscribePacket struct {
+	PacketID     uint16
+	Properties   Properties
+	TopicFilters []string
+}
+
+func (this *UnsubscribePacket) Type() PacketType  { return PacketUnsubscribe }
+func (this *UnsubscribePacket) headerFlags() byte { return 0x02 }
+func (this *UnsubscribePacket) String() string {
+	return fmt.Sprintf("UNSUBSCRIBE{packetId: %d, filters: %v, properties: %v}",
+		this.PacketID, this.TopicFilters, this.Properties)
+}
+func (this *UnsubscribePacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.PacketID = decoder.readUint16()
+	if version >= MQTT5 {
+		this.Properties = decoder.readProperties()
+	}
+	for decoder.err == nil && decoder.remaining() != 0 {
+		this.TopicFilters = append(this.TopicFilters, decoder.readString())
+	}
+	if len(this.TopicFilters) == 0 {
+		decoder.fail()
+	}
+}
+func (this *UnsubscribePacket) encodeBody(encoder *packetEncoder, version byte) {
+	encoder.writeUint16(this.PacketID)
+	if version >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+	}
+	for i := 0; i < len(this.TopicFilters); i++ {
+		encoder.writeString(this.TopicFilters[i])
+	}
+}
+
+//endregion
+
+//region UnsubackPacket
+type UnsubackPacket struct {
+	PacketID   uint16
+	Properties Properties
+	// ReasonCodes are only available in MQTT 5
+	ReasonCodes []ReasonCode
+}
+
+func (this *UnsubackPacket) Type() PacketType  { return PacketUnsuback }
+func (this *UnsubackPacket) headerFlags() byte { return 0 }
+func (this *UnsubackPacket) String() string {
+	return fmt.Sprintf("UNSUBACK{packetId: %d, codes: %v, properties: %v}",
+		this.PacketID, this.ReasonCodes, this.Properties)
+}
+func (this *UnsubackPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.PacketID = decoder.readUint16()
+	if version >= MQTT5 {
+		this.Properties = decoder.readProperties()
+		codes := decoder.readRest()
+		this.ReasonCodes = make([]ReasonCode, len(codes))
+		for i := 0; i < len(codes); i++ {
+			this.ReasonCodes[i] = ReasonCode(codes[i])
+		}
+	}
+}
+func (this *UnsubackPacket) encodeBody(encoder *packetEncoder, version byte) {
+	encoder.writeUint16(this.PacketID)
+	if version >= MQTT5 {
+		encoder.writeProperties(this.Properties)
+		for i := 0; i < len(this.ReasonCodes); i++ {
+			encoder.writeByte(byte(this.ReasonCodes[i]))
+		}
+	}
+}
+
+//endregion
+
+//region PingreqPacket & PingrespPacket
+type PingreqPacket struct{}
+
+func (this *PingreqPacket) Type() PacketType                                            { return PacketPingreq }
+func (this *PingreqPacket) headerFlags() byte                                           { return 0 }
+func (this *PingreqPacket) String() string                                              { return "PINGREQ" }
+func (this *PingreqPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {}
+func (this *PingreqPacket) encodeBody(encoder *packetEncoder, version byte)             {}
+
+type PingrespPacket struct{}
+
+func (this *PingrespPacket) Type() PacketType                                            { return PacketPingresp }
+func (this *PingrespPacket) headerFlags() byte                                           { return 0 }
+func (this *PingrespPacket) String() string                                              { return "PINGRESP" }
+func (this *PingrespPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {}
+func (this *PingrespPacket) encodeBody(encoder *packetEncoder, version byte)             {}
+
+//endregion
+
+//region DisconnectPacket & AuthPacket
+// DisconnectPacket have a reason code and properties in MQTT 5
+type DisconnectPacket struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (this *DisconnectPacket) Type() PacketType  { return PacketDisconnect }
+func (this *DisconnectPacket) headerFlags() byte { return 0 }
+func (this *DisconnectPacket) String() string {
+	return fmt.Sprintf("DISCONNECT{reason: %v, properties: %v}", this.ReasonCode, this.Properties)
+}
+func (this *DisconnectPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	this.ReasonCode, this.Properties = decodeReasonAndProperties(decoder, version)
+}
+func (this *DisconnectPacket) encodeBody(encoder *packetEncoder, version byte) {
+	encodeReasonAndProperties(encoder, version, this.ReasonCode, this.Properties)
+}
+
+// AuthPacket is only available in MQTT 5
+type AuthPacket struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (this *AuthPacket) Type() PacketType  { return PacketAuth }
+func (this *AuthPacket) headerFlags() byte { return 0 }
+func (this *AuthPacket) String() string {
+	return fmt.Sprintf("AUTH{reason: %v, properties: %v}", this.ReasonCode, this.Properties)
+}
+func (this *AuthPacket) decodeBody(decoder *packetDecoder, flags byte, version byte) {
+	if version < MQTT5 {
+		decoder.fail()
+		return
+	}
+	this.ReasonCode, this.Properties = decodeReasonAndProperties(decoder, version)
+}
+func (this *AuthPacket) encodeBody(encoder *packetEncoder, version byte) {
+	encodeReasonAndProperties(encoder, version, this.ReasonCode, this.Properties)
+}
+
+// decodeReasonAndProperties decode body of DISCONNECT and AUTH, an empty body means success without properties
+func decodeReasonAndProperties(decoder *packetDecoder, version byte) (ReasonCode, Properties) {
+	if version < MQTT5 || decoder.remaining() == 0 {
+		return ReasonSuccess, nil
+	}
+
+	reasonCode := ReasonCode(decoder.readByte())
+	if decoder.remaining() == 0 {
+		return reasonCode, nil
+	}
+	return reasonCode, decoder.readProperties()
+}
+func encodeReasonAndProperties(encoder *packetEncoder, version byte, reasonCode ReasonCode, props Properties) {
+	if version < MQTT5 || (reasonCode == ReasonSuccess && len(props) == 0) {
+		return
+	}
+
+	encoder.writeByte(byte(reasonCode))
+	encoder.writeProperties(props)
+}
+
+//endregion
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PropertyID identifier of a MQTT 5 property
+type PropertyID byte
+
+const (
+	PropPayloadFormatIndicator          PropertyID = 0x01
+	PropMessageExpiryInterval           PropertyID = 0x02
+	PropContentType                     PropertyID = 0x03
+	PropResponseTopic                   PropertyID = 0x08
+	PropCorrelationData                 PropertyID = 0x09
+	PropSubscriptionIdentifier          PropertyID = 0x0B
+	PropSessionExpiryInterval           PropertyID = 0x11
+	PropAssignedClientIdentifier        PropertyID = 0x12
+	PropServerKeepAlive                 PropertyID = 0x13
+	PropAuthenticationMethod            PropertyID = 0x15
+	PropAuthenticationData              PropertyID = 0x16
+	PropRequestProblemInformation       PropertyID = 0x17
+	PropWillDelayInterval               PropertyID = 0x18
+	PropRequestResponseInformation      PropertyID = 0x19
+	PropResponseInformation             PropertyID = 0x1A
+	PropServerReference                 PropertyID = 0x1C
+	PropReasonString                    PropertyID = 0x1F
+	PropReceiveMaximum                  PropertyID = 0x21
+	PropTopicAliasMaximum               PropertyID = 0x22
+	PropTopicAlias                      PropertyID = 0x23
+	PropMaximumQoS                      PropertyID = 0x24
+	PropRetainAvailable                 PropertyID = 0x25
+	PropUserProperty                    PropertyID = 0x26
+	PropMaximumPacketSize               PropertyID = 0x27
+	PropWildcardSubscriptionAvailable   PropertyID = 0x28
+	PropSubscriptionIdentifierAvailable PropertyID = 0x29
+	PropSharedSubscriptionAvailable     PropertyID = 0x2A
+)
+
+type propertyKind int
+
+const (
+	propByte propertyKind = iota
+	propUint16
+	propUint32
+	propVarint
+	propString
+	propBinary
+	propStringPair
+)
+
+type propertyInfo struct {
+	Name string
+	Kind propertyKind
+}
+
+var propertyInfos = map[PropertyID]propertyInfo{
+	PropPayloadFormatIndicator:          {"PayloadFormatIndicator", propByte},
+	PropMessageExpiryInterval:           {"MessageExpiryInterval", propUint32},
+	PropContentType:                     {"ContentType", propString},
+	PropResponseTopic:                   {"ResponseTopic", propString},
+	PropCorrelationData:                 {"CorrelationData", propBinary},
+	PropSubscriptionIdentifier:          {"SubscriptionIdentifier", propVarint},
+	PropSessionExpiryInterval:           {"SessionExpiryInterval", propUint32},
+	PropAssignedClientIdentifier:        {"AssignedClientIdentifier", propString},
+	PropServerKeepAlive:                 {"ServerKeepAlive", propUint16},
+	PropAuthenticationMethod:            {"AuthenticationMethod", propString},
+	PropAuthenticationData:              {"AuthenticationData", propBinary},
+	PropRequestProblemInformation:       {"RequestProblemInformation", propByte},
+	PropWillDelayInterval:               {"WillDelayInterval", propUint32},
+	PropRequestResponseInformation:      {"RequestResponseInformation", propByte},
+	PropResponseInformation:             {"ResponseInformation", propString},
+	PropServerReference:                 {"ServerReference", propString},
+	PropReasonString:                    {"ReasonString", propString},
+	PropReceiveMaximum:                  {"ReceiveMaximum", propUint16},
+	PropTopicAliasMaximum:               {"TopicAliasMaximum", propUint16},
+	PropTopicAlias:                      {"TopicAlias", propUint16},
+	PropMaximumQoS:                      {"MaximumQoS", propByte},
+	PropRetainAvailable:                 {"RetainAvailable", propByte},
+	PropUserProperty:                    {"UserProperty", propStringPair},
+	PropMaximumPacketSize:               {"MaximumPacketSize", propUint32},
+	PropWildcardSubscriptionAvailable:   {"WildcardSubscriptionAvailable", propByte},
+	PropSubscriptionIdentifierAvailable: {"SubscriptionIdentifierAvailable", propByte},
+	PropSharedSubscriptionAvailable:     {"SharedSubscriptionAvailable", propByte},
+}
+
+func (this PropertyID) String() string {
+	if info, ok := propertyInfos[this]; ok {
+		return info.Name
+	}
+	return fmt.Sprintf("PropertyID(0x%02X)", byte(this))
+}
+
+// Property is a MQTT 5 property, numeric properties use `Int`, string and binary properties use `Data` and user
+// properties use `Data` as their name and `Value` as their value
+type Property struct {
+	ID    PropertyID
+	Int   uint32
+	Data  []byte
+	Value []byte
+}
+
+func (this Property) String() string {
+	info := propertyInfos[this.ID]
+	switch info.Kind {
+	case propString:
+		return fmt.Sprintf("%v=%s", this.ID, this.Data)
+	case propBinary:
+		return fmt.Sprintf("%v=%x", this.ID, this.Data)
+	case propStringPair:
+		return fmt.Sprintf("%v(%s=%s)", this.ID, this.Data, this.Value)
+	default:
+		return fmt.Sprintf("%v=%d", this.ID, this.Int)
+	}
+}
+
+// Properties list of properties of a packet, in the order that they appear in the packet
+type Properties []Property
+
+// Get return first property with the ID or `nil` if there is no such property
+func (this Properties) Get(id PropertyID) *Property {
+	for i := 0; i < len(this); i++ {
+		if this[i].ID == id {
+			return &this[i]
+		}
+	}
+	return nil
+}
+func (this Properties) GetInt(id PropertyID) (uint32, bool) {
+	if prop := this.Get(id); prop != nil {
+		return prop.Int, true
+	}
+	return 0, false
+}
+func (this Properties) GetString(id PropertyID) (string, bool) {
+	if prop := this.Get(id); prop != nil {
+		return string(prop.Data), true
+	}
+	return "", false
+}
+
+// Set replace the property with the same ID or add it to the list
+func (this *Properties) Set(prop Property) {
+	if current := this.Get(prop.ID); current != nil {
+		*current = prop
+	} else {
+		*this = append(*this, prop)
+	}
+}
+
+// Remove remove every property with the ID
+func (this *Properties) Remove(id PropertyID) {
+	result := (*this)[:0]
+	for i := 0; i < len(*this); i++ {
+		if (*this)[i].ID != id {
+			result = append(result, (*this)[i])
+		}
+	}
+	*this = result
+}
+
+func (this Properties) String() string {
+	parts := make([]string, len(this))
+	for i := 0; i < len(this); i++ {
+		parts[i] = this[i].String()
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func (this *packetDecoder) readProperties() Properties {
+	length := int(this.readVarint())
+	if this.err != nil {
+		return nil
+	}
+	if length > len(this.data) {
+		this.fail()
+		return nil
+	}
+
+	decoder := &packetDecoder{data: this.readBytes(length)}
+	var result Properties
+	for decoder.err == nil && decoder.remaining() != 0 {
+		prop := Property{ID: PropertyID(decoder.readVarint())}
+		info, ok := propertyInfos[prop.ID]
+		if !ok {
+			decoder.fail()
+			break
+		}
+
+		switch info.Kind {
+		case propByte:
+			prop.Int = uint32(decoder.readByte())
+		case propUint16:
+			prop.Int = uint32(decoder.readUint16())
+		case propUint32:
+			prop.Int = decoder.readUint32()
+		case propVarint:
+			prop.Int = decoder.readVarint()
+		case propString, propBinary:
+			prop.Data = decoder.readBinary()
+		case propStringPair:
+			prop.Data = decoder.readBinary()
+			prop.Value = decoder.readBinary()
+		}
+		result = append(result, prop)
+	}
+	if decoder.err != nil {
+		this.fail()
+		return nil
+	}
+	return result
+}
+func (this *packetEncoder) writeProperties(props Properties) {
+	encoder := &packetEncoder{}
+	for i := 0; i < len(props); i++ {
+		prop := props[i]
+		encoder.writeVarint(uint32(prop.ID))
+		switch propertyInfos[prop.ID].Kind {
+		case propByte:
+			encoder.writeByte(byte(prop.Int))
+		case propUint16:
+			encoder.writeUint16(uint16(prop.Int))
+		case propUint32:
+			encoder.writeUint32(prop.Int)
+		case propVarint:
+			encoder.writeVarint(prop.Int)
+		case propString, propBinary:
+			encoder.writeBinary(prop.Data)
+		case propStringPair:
+			encoder.writeBinary(prop.Data)
+			encoder.writeBinary(prop.Value)
+		}
+	}
+	this.writeVarint(uint32(len(encoder.buffer)))
+	this.writeBytes(encoder.buffer)
+}
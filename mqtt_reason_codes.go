@@ -0,0 +1,163 @@
+package main
+
+import "fmt"
+
+// ReasonCode is a MQTT 5 reason code, for older protocol versions it is the return code of CONNACK and SUBACK
+type ReasonCode byte
+
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonGrantedQoS1                         ReasonCode = 0x01
+	ReasonGrantedQoS2                         ReasonCode = 0x02
+	ReasonDisconnectWithWillMessage           ReasonCode = 0x04
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonContinueAuthentication              ReasonCode = 0x18
+	ReasonReAuthenticate                      ReasonCode = 0x19
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUsernameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8A
+	ReasonServerShuttingDown                  ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8C
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8D
+	ReasonSessionTakenOver                    ReasonCode = 0x8E
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8F
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9A
+	ReasonQoSNotSupported                     ReasonCode = 0x9B
+	ReasonUseAnotherServer                    ReasonCode = 0x9C
+	ReasonServerMoved                         ReasonCode = 0x9D
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ReasonConnectionRateExceeded              ReasonCode = 0x9F
+	ReasonMaximumConnectTime                  ReasonCode = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+// return codes of CONNACK in MQTT 3.1 and 3.1.1
+const (
+	ConnackAccepted                     ReasonCode = 0x00
+	ConnackRefusedProtocolVersion       ReasonCode = 0x01
+	ConnackRefusedIdentifierRejected    ReasonCode = 0x02
+	ConnackRefusedServerUnavailable     ReasonCode = 0x03
+	ConnackRefusedBadUsernameOrPassword ReasonCode = 0x04
+	ConnackRefusedNotAuthorized         ReasonCode = 0x05
+
+	// SubackFailure is the return code of a rejected subscription in MQTT 3.1.1
+	SubackFailure ReasonCode = 0x80
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	ReasonSuccess:                             "Success",
+	ReasonGrantedQoS1:                         "Granted QoS 1",
+	ReasonGrantedQoS2:                         "Granted QoS 2",
+	ReasonDisconnectWithWillMessage:           "Disconnect with Will Message",
+	ReasonNoMatchingSubscribers:               "No matching subscribers",
+	ReasonNoSubscriptionExisted:               "No subscription existed",
+	ReasonContinueAuthentication:              "Continue authentication",
+	ReasonReAuthenticate:                      "Re-authenticate",
+	ReasonUnspecifiedError:                    "Unspecified error",
+	ReasonMalformedPacket:                     "Malformed Packet",
+	ReasonProtocolError:                       "Protocol Error",
+	ReasonImplementationSpecificError:         "Implementation specific error",
+	ReasonUnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ReasonClientIdentifierNotValid:            "Client Identifier not valid",
+	ReasonBadUsernameOrPassword:               "Bad User Name or Password",
+	ReasonNotAuthorized:                       "Not authorized",
+	ReasonServerUnavailable:                   "Server unavailable",
+	ReasonServerBusy:                          "Server busy",
+	ReasonBanned:                              "Banned",
+	ReasonServerShuttingDown:                  "Server shutting down",
+	ReasonBadAuthenticationMethod:             "Bad authentication method",
+	ReasonKeepAliveTimeout:                    "Keep Alive timeout",
+	ReasonSessionTakenOver:                    "Session taken over",
+	ReasonTopicFilterInvalid:                  "Topic Filter invalid",
+	ReasonTopicNameInvalid:                    "Topic Name invalid",
+	ReasonPacketIdentifierInUse:               "Packet Identifier in use",
+	ReasonPacketIdentifierNotFound:            "Packet Identifier not found",
+	ReasonReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	ReasonTopicAliasInvalid:                   "Topic Alias invalid",
+	ReasonPacketTooLarge:                      "Packet too large",
+	ReasonMessageRateTooHigh:                  "Message rate too high",
+	ReasonQuotaExceeded:                       "Quota exceeded",
+	ReasonAdministrativeAction:                "Administrative action",
+	ReasonPayloadFormatInvalid:                "Payload format invalid",
+	ReasonRetainNotSupported:                  "Retain not supported",
+	ReasonQoSNotSupported:                     "QoS not supported",
+	ReasonUseAnotherServer:                    "Use another server",
+	ReasonServerMoved:                         "Server moved",
+	ReasonSharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	ReasonConnectionRateExceeded:              "Connection rate exceeded",
+	ReasonMaximumConnectTime:                  "Maximum connect time",
+	ReasonSubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	ReasonWildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+var connackReturnCodeNames = map[ReasonCode]string{
+	ConnackAccepted:                     "Connection Accepted",
+	ConnackRefusedProtocolVersion:       "Connection Refused: unacceptable protocol version",
+	ConnackRefusedIdentifierRejected:    "Connection Refused: identifier rejected",
+	ConnackRefusedServerUnavailable:     "Connection Refused: Server unavailable",
+	ConnackRefusedBadUsernameOrPassword: "Connection Refused: bad user name or password",
+	ConnackRefusedNotAuthorized:         "Connection Refused: not authorized",
+}
+
+func (this ReasonCode) String() string {
+	if name, ok := reasonCodeNames[this]; ok {
+		return name
+	}
+	return fmt.Sprintf("ReasonCode(0x%02X)", byte(this))
+}
+
+// IsError return `true` if this is a failure reason code
+func (this ReasonCode) IsError() bool { return this >= 0x80 }
+
+// connackReasonString return description of the CONNACK code for the protocol version
+func connackReasonString(version byte, code ReasonCode) string {
+	if version >= MQTT5 {
+		return code.String()
+	}
+	if name, ok := connackReturnCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConnackReturnCode(%d)", byte(code))
+}
+
+// connackReasonCode convert a MQTT 5 reason code to the nearest CONNACK return code of the protocol version
+func connackReasonCode(version byte, reason ReasonCode) ReasonCode {
+	if version >= MQTT5 {
+		return reason
+	}
+
+	switch reason {
+	case ReasonSuccess:
+		return ConnackAccepted
+	case ReasonUnsupportedProtocolVersion:
+		return ConnackRefusedProtocolVersion
+	case ReasonClientIdentifierNotValid:
+		return ConnackRefusedIdentifierRejected
+	case ReasonBadUsernameOrPassword:
+		return ConnackRefusedBadUsernameOrPassword
+	case ReasonNotAuthorized, ReasonBanned, ReasonBadAuthenticationMethod:
+		return ConnackRefusedNotAuthorized
+	default:
+		return ConnackRefusedServerUnavailable
+	}
+}
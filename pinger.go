@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+const (
+	AnswerPingsNeedsPacketsMode = helpers.StringError("Answering PINGREQ is only supported in `packets` proxy mode")
+)
+
+// backendPinger keep a backend connection alive when proxy answers PINGREQ of the client itself. A PINGREQ is
+// sent to the backend only when nothing is sent to it in a keepalive interval, so there is at most one ping in
+// each interval
+type backendPinger struct {
+	conn     net.Conn
+	version  byte
+	interval time.Duration
+	logger   helpers.Logger
+	// lastWrite unix time of the last packet that is sent to the backend, in nanoseconds
+	lastWrite int64
+	stopped   chan struct{}
+	stopOnce  sync.Once
+}
+
+// newBackendPinger start pinging a backend, it return `nil` if backend has no keepalive
+func newBackendPinger(logger helpers.Logger, conn net.Conn, version byte, keepAlive uint16) *backendPinger {
+	if keepAlive == 0 {
+		return nil
+	}
+
+	result := &backendPinger{
+		conn:      conn,
+		version:   version,
+		interval:  time.Duration(keepAlive) * time.Second,
+		logger:    logger,
+		lastWrite: time.Now().UnixNano(),
+		stopped:   make(chan struct{}),
+	}
+	go result.run()
+	return result
+}
+
+// touch record a packet that is sent to the backend
+func (this *backendPinger) touch() {
+	if this != nil {
+		atomic.StoreInt64(&this.lastWrite, time.Now().UnixNano())
+	}
+}
+
+func (this *backendPinger) run() {
+	wait := this.interval
+	for {
+		select {
+		case <-this.stopped:
+			return
+		case <-time.After(wait):
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&this.lastWrite)))
+		if idle < this.interval {
+			wait = this.interval - idle
+			continue
+		}
+
+		this.logger.Verbosef(11, "Sending PINGREQ to the backend")
+		if err := WritePacket(this.conn, &PingreqPacket{}, this.version); err != nil {
+			this.logger.Warnf("Failed to send PINGREQ to the backend: %v", err)
+			return
+		}
+		this.touch()
+		wait = this.interval
+	}
+}
+
+func (this *backendPinger) stop() {
+	if this != nil {
+		this.stopOnce.Do(func() { close(this.stopped) })
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/devops-simba/helpers"
-	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 const (
@@ -36,6 +37,12 @@ func isEOF(err error) bool {
 	return false
 }
 
+// isTimeout return `true` if err is caused by a deadline of the connection
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 type ServiceProxyDirection bool
 
 func (this ServiceProxyDirection) SourceConnectionName() string {
@@ -50,7 +57,6 @@ func (this ServiceProxyDirection) String() string {
 
 type memoryBuffer struct {
 	buffer []byte
-	used   int
 	length int
 }
 
@@ -58,28 +64,271 @@ func newMemoryBuffer(capacity int) *memoryBuffer {
 	return &memoryBuffer{buffer: make([]byte, capacity)}
 }
 
-func (this *memoryBuffer) remaining() int     { return this.length - this.used }
 func (this *memoryBuffer) readBuffer() []byte { return this.buffer[this.length:] }
 func (this *memoryBuffer) remove(n int) {
 	this.length = copy(this.buffer, this.buffer[n:this.length])
-	this.used = 0
 }
 func (this *memoryBuffer) add(n int) {
 	this.length += n
 }
-func (this *memoryBuffer) Read(buffer []byte) (int, error) {
-	numberOfBytesRead := copy(buffer, this.buffer[this.used:this.length])
-	this.used += numberOfBytesRead
-	if numberOfBytesRead < len(buffer) {
-		return numberOfBytesRead, io.EOF
-	} else {
-		return numberOfBytesRead, nil
+
+type ServiceProxyMode string
+
+// proxyState state of a proxied client that is shared between both directions
+type proxyState struct {
+	ServiceName string
+	ClientID    string
+	Username    string
+	Version     byte
+	// ACL return current ACL of the service, it is `nil` if topics of the client are not checked
+	ACL func() *ACL
+	// Topics rewrite topics of the client, it is `nil` if topics are not rewritten
+	Topics *clientTopics
+	// IdleTimeout client is closed if it send nothing for this duration, 0 if it is never closed
+	IdleTimeout time.Duration
+	// Pinger keep the backend alive when PINGREQs of the client are answered by the proxy, it is `nil` if they are
+	// forwarded to the backend
+	Pinger *backendPinger
+	// AnswerPings answer PINGREQ of the client in the proxy and drop PINGRESP of the backend
+	AnswerPings bool
+
+	guard sync.Mutex
+	// packet IDs of the QoS 2 PUBLISHes that are dropped by the proxy, their PUBRELs are answered by the proxy too
+	droppedPublishes map[uint16]struct{}
+	// accepted subscriptions of the SUBSCRIBEs that are partially rejected, they are used to merge SUBACK of the
+	// backend with the rejected subscriptions
+	partialSubscribes map[uint16][]bool
+	// topics of the aliases that the client set by its accepted PUBLISHes, it is only used by the client side
+	topicAliases map[uint16]string
+}
+
+func newProxyState(serviceName string, connect *ConnectPacket, acl func() *ACL, topics *clientTopics) *proxyState {
+	return &proxyState{
+		ServiceName:       serviceName,
+		ClientID:          connect.ClientID,
+		Username:          connect.Username,
+		Version:           connect.ProtocolVersion,
+		ACL:               acl,
+		Topics:            topics,
+		droppedPublishes:  make(map[uint16]struct{}),
+		partialSubscribes: make(map[uint16][]bool),
+		topicAliases:      make(map[uint16]string),
 	}
 }
 
-type ServiceProxyMode string
+// setIdleDeadline set deadline of the next read from the client, so an idle client is closed
+func (this *proxyState) setIdleDeadline(dir ServiceProxyDirection, src net.Conn) {
+	if dir == FrontendToBackend && this.IdleTimeout != 0 {
+		src.SetReadDeadline(time.Now().Add(this.IdleTimeout))
+	}
+}
 
-func rawProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Conn) error {
+// isIdleTimeout return `true` if reading from `src` failed because the client is idle
+func (this *proxyState) isIdleTimeout(dir ServiceProxyDirection, err error) bool {
+	return dir == FrontendToBackend && this.IdleTimeout != 0 && isTimeout(err)
+}
+
+// rejectedReasonCode reason code of the acknowledgements that the proxy send for rejected packets
+func (this *proxyState) rejectedReasonCode() ReasonCode {
+	if this.Version >= MQTT5 {
+		return ReasonNotAuthorized
+	}
+	return SubackFailure
+}
+
+// publishTopic return topic of a PUBLISH of the client. MQTT 5 clients may send an empty topic along with a topic
+// alias that an earlier PUBLISH has set, it return false if such an alias is unknown
+func (this *proxyState) publishTopic(pkt *PublishPacket) (string, bool) {
+	alias, ok := pkt.Properties.GetInt(PropTopicAlias)
+	if !ok || pkt.TopicName != "" {
+		return pkt.TopicName, true
+	}
+	topic, ok := this.topicAliases[uint16(alias)]
+	return topic, ok
+}
+
+// setTopicAlias remember topic alias of a PUBLISH that is forwarded to the backend. Aliases of the dropped PUBLISHes
+// are never set in the backend, so they are not remembered either
+func (this *proxyState) setTopicAlias(pkt *PublishPacket) {
+	if alias, ok := pkt.Properties.GetInt(PropTopicAlias); ok && pkt.TopicName != "" {
+		this.topicAliases[uint16(alias)] = pkt.TopicName
+	}
+}
+
+// rejectPublish drop a PUBLISH that the client may not send and acknowledge it, so the client does not wait for it
+func (this *proxyState) rejectPublish(client net.Conn, pkt *PublishPacket) error {
+	ack := &AckPacket{PacketID: pkt.PacketID}
+	if this.Version >= MQTT5 {
+		ack.ReasonCode = ReasonNotAuthorized
+	}
+	switch pkt.QoS {
+	case 0:
+		return nil
+	case 1:
+		ack.PacketType = PacketPuback
+	default:
+		ack.PacketType = PacketPubrec
+		this.guard.Lock()
+		this.droppedPublishes[pkt.PacketID] = struct{}{}
+		this.guard.Unlock()
+	}
+	return WritePacket(client, ack, this.Version)
+}
+
+// forgetDroppedPublish forget a dropped QoS 2 PUBLISH when its packet ID is used by a new PUBLISH, client only reuse
+// a packet ID after its flow is finished, so its PUBREL will never come
+func (this *proxyState) forgetDroppedPublish(pkt *PublishPacket) {
+	if pkt.QoS == 0 {
+		return
+	}
+	this.guard.Lock()
+	delete(this.droppedPublishes, pkt.PacketID)
+	this.guard.Unlock()
+}
+
+// completeDroppedPublish answer PUBREL of a dropped QoS 2 PUBLISH, it return false if PUBLISH was not dropped
+func (this *proxyState) completeDroppedPublish(client net.Conn, pkt *AckPacket) (bool, error) {
+	this.guard.Lock()
+	_, ok := this.droppedPublishes[pkt.PacketID]
+	delete(this.droppedPublishes, pkt.PacketID)
+	this.guard.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, WritePacket(client, &AckPacket{PacketType: PacketPubcomp, PacketID: pkt.PacketID}, this.Version)
+}
+
+// filterSubscribe remove subscriptions that the client may not make. If nothing remains proxy itself send the
+// SUBACK and `nil` is returned
+func (this *proxyState) filterSubscribe(
+	logger helpers.Logger,
+	client net.Conn,
+	acl *ACL,
+	pkt *SubscribePacket,
+) (MQTTPacket, error) {
+	accepted := make([]bool, len(pkt.Subscriptions))
+	subscriptions := make([]Subscription, 0, len(pkt.Subscriptions))
+	for i := 0; i < len(pkt.Subscriptions); i++ {
+		filter := pkt.Subscriptions[i].TopicFilter
+		if acl.CanSubscribe(this.Username, this.ClientID, filter) {
+			accepted[i] = true
+			subscriptions = append(subscriptions, pkt.Subscriptions[i])
+		} else {
+			logger.Debugf("Rejected subscription of the client to `%s`", filter)
+			OnACLDenied(this.ServiceName, "subscribe")
+		}
+	}
+
+	switch len(subscriptions) {
+	case len(pkt.Subscriptions):
+		return pkt, nil
+	case 0:
+		suback := &SubackPacket{PacketID: pkt.PacketID, ReasonCodes: make([]ReasonCode, len(accepted))}
+		for i := 0; i < len(accepted); i++ {
+			suback.ReasonCodes[i] = this.rejectedReasonCode()
+		}
+		return nil, WritePacket(client, suback, this.Version)
+	default:
+		this.guard.Lock()
+		this.partialSubscribes[pkt.PacketID] = accepted
+		this.guard.Unlock()
+		pkt.Subscriptions = subscriptions
+		return pkt, nil
+	}
+}
+
+// mergeSuback add reason codes of the rejected subscriptions to SUBACK of the backend
+func (this *proxyState) mergeSuback(pkt *SubackPacket) *SubackPacket {
+	this.guard.Lock()
+	accepted, ok := this.partialSubscribes[pkt.PacketID]
+	delete(this.partialSubscribes, pkt.PacketID)
+	this.guard.Unlock()
+	if !ok {
+		return pkt
+	}
+
+	codes := make([]ReasonCode, 0, len(accepted))
+	next := 0
+	for i := 0; i < len(accepted); i++ {
+		if !accepted[i] {
+			codes = append(codes, this.rejectedReasonCode())
+		} else if next < len(pkt.ReasonCodes) {
+			codes = append(codes, pkt.ReasonCodes[next])
+			next++
+		}
+	}
+	pkt.ReasonCodes = codes
+	return pkt
+}
+
+// intercept check and rewrite a packet before it is forwarded. It return the packet that should be forwarded, or
+// `nil` if the packet is handled by the proxy itself. `src` is the connection that the packet is read from. ACL is
+// checked against topics of the client, before they are rewritten
+func (this *proxyState) intercept(
+	logger helpers.Logger,
+	dir ServiceProxyDirection,
+	src net.Conn,
+	packet MQTTPacket,
+) (MQTTPacket, error) {
+	var acl *ACL
+	if this.ACL != nil {
+		acl = this.ACL()
+	}
+
+	if dir == BackendToFrontend {
+		switch pkt := packet.(type) {
+		case *SubackPacket:
+			return this.mergeSuback(pkt), nil
+		case *PingrespPacket:
+			if this.AnswerPings {
+				// client never send PINGREQ to the backend, so this is the answer of a ping of the proxy
+				return nil, nil
+			}
+		}
+		if this.Topics != nil {
+			this.Topics.RewriteToClient(packet)
+		}
+		return packet, nil
+	}
+
+	switch pkt := packet.(type) {
+	case *PingreqPacket:
+		if this.AnswerPings {
+			return nil, WritePacket(src, &PingrespPacket{}, this.Version)
+		}
+	case *PublishPacket:
+		this.forgetDroppedPublish(pkt)
+		if acl != nil {
+			topic, known := this.publishTopic(pkt)
+			if !known || !acl.CanPublish(this.Username, this.ClientID, topic) {
+				logger.Debugf("Dropped PUBLISH of the client to `%s`", topic)
+				OnACLDenied(this.ServiceName, "publish")
+				return nil, this.rejectPublish(src, pkt)
+			}
+			this.setTopicAlias(pkt)
+		}
+	case *AckPacket:
+		if pkt.PacketType == PacketPubrel {
+			if handled, err := this.completeDroppedPublish(src, pkt); handled {
+				return nil, err
+			}
+		}
+	case *SubscribePacket:
+		if acl != nil {
+			filtered, err := this.filterSubscribe(logger, src, acl, pkt)
+			if filtered == nil || err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if this.Topics != nil {
+		this.Topics.RewriteToBackend(packet)
+	}
+	return packet, nil
+}
+
+func rawProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Conn, state *proxyState) error {
 	buffer := newMemoryBuffer(65536)
 	sourceName := dir.SourceConnectionName()
 	destName := dir.DestinationConnectionName()
@@ -90,10 +339,15 @@ func rawProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Con
 			return helpers.StringError("Message is too big")
 		}
 
+		state.setIdleDeadline(dir, src)
 		numberOfBytesRead, err := src.Read(buf)
 		if err != nil {
 			dst.Close()
-			if isEOF(err) {
+			if state.isIdleTimeout(dir, err) {
+				src.Close()
+				logger.Infof("Client `%s` sent nothing in %v, closed it", state.ClientID, state.IdleTimeout)
+				return nil
+			} else if isEOF(err) {
 				logger.Debugf("%s connection closed", sourceName)
 				return nil
 			} else {
@@ -104,28 +358,44 @@ func rawProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Con
 		}
 		buffer.add(numberOfBytesRead)
 
+		// only complete packets are written, so packets that proxy itself write never land inside another one
 		used := 0
-		for buffer.remaining() != 0 {
-			pkt, err := packets.ReadPacket(buffer)
-			if err == nil {
-				logger.Verbosef(11, "Read a packet from %s: %s", sourceName, pkt.String())
-				numberOfBytesWrite, err := dst.Write(buffer.buffer[used:buffer.used])
-				if err != nil {
-					src.Close()
-					if isEOF(err) {
-						logger.Verbosef(11, "%s connection closed", destName)
-						return nil
-					} else {
-						dst.Close()
-						logger.Errorf("error in writing data to %s: %v", destName, err)
-						return err
-					}
+		for used != buffer.length {
+			length, err := packetLength(buffer.buffer[used:buffer.length])
+			if err != nil {
+				src.Close()
+				dst.Close()
+				logger.Errorf("Failed to read a packet from received buffer: %v", err)
+				return err
+			}
+			if length == 0 {
+				break // packet is not complete yet
+			}
+
+			raw := buffer.buffer[used : used+length]
+			// packets are only decoded for this log, `V` of the logger compare verbosity levels the other way
+			if logger.GetVerbosityLevel() >= 11 {
+				if pkt, err := DecodePacket(raw, state.Version); err == nil {
+					logger.Verbosef(11, "Read a packet from %s: %s", sourceName, pkt.String())
+				} else {
+					logger.Debugf("Failed to decode a packet from %s: %v", sourceName, err)
+				}
+			}
+
+			numberOfBytesWrite, err := dst.Write(raw)
+			if err != nil {
+				src.Close()
+				if isEOF(err) {
+					logger.Verbosef(11, "%s connection closed", destName)
+					return nil
+				} else {
+					dst.Close()
+					logger.Errorf("error in writing data to %s: %v", destName, err)
+					return err
 				}
-				logger.Verbosef(11, "Written %d bytes of data to %s", numberOfBytesWrite, destName)
-				used = buffer.used
-			} else if !isEOF(err) {
-				logger.Errorf("Failed to read a packet from received buffer: %#v", err)
 			}
+			logger.Verbosef(11, "Written %d bytes of data to %s", numberOfBytesWrite, destName)
+			used += length
 		}
 		buffer.remove(used)
 		if buffer.length != 0 {
@@ -133,12 +403,17 @@ func rawProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Con
 		}
 	}
 }
-func packetsProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Conn) error {
+func packetsProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Conn, state *proxyState) error {
 	for {
-		packet, err := packets.ReadPacket(src)
+		state.setIdleDeadline(dir, src)
+		packet, err := ReadPacket(src, state.Version)
 		if err != nil {
 			dst.Close()
-			if isEOF(err) {
+			if state.isIdleTimeout(dir, err) {
+				src.Close()
+				logger.Infof("Client `%s` sent nothing in %v, closed it", state.ClientID, state.IdleTimeout)
+				return nil
+			} else if isEOF(err) {
 				logger.Verbosef(11, "%s connection closed", dir.SourceConnectionName())
 				return nil
 			} else {
@@ -148,7 +423,18 @@ func packetsProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net
 			}
 		}
 
-		err = packet.Write(dst)
+		packet, err = state.intercept(logger, dir, src, packet)
+		if err != nil {
+			src.Close()
+			dst.Close()
+			logger.Errorf("error in answering packet of %s: %v", dir.SourceConnectionName(), err)
+			return err
+		}
+		if packet == nil {
+			continue
+		}
+
+		err = WritePacket(dst, packet, state.Version)
 		if err != nil {
 			src.Close()
 			if isEOF(err) {
@@ -160,14 +446,22 @@ func packetsProxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net
 				return err
 			}
 		}
+		if dir == FrontendToBackend {
+			state.Pinger.touch()
+		}
 	}
 }
-func (this ServiceProxyMode) Proxy(logger helpers.Logger, dir ServiceProxyDirection, src, dst net.Conn) error {
+func (this ServiceProxyMode) Proxy(
+	logger helpers.Logger,
+	dir ServiceProxyDirection,
+	src, dst net.Conn,
+	state *proxyState,
+) error {
 	switch this {
 	case Raw:
-		return rawProxy(logger, dir, src, dst)
+		return rawProxy(logger, dir, src, dst, state)
 	case PacketProxy:
-		return packetsProxy(logger, dir, src, dst)
+		return packetsProxy(logger, dir, src, dst, state)
 	default:
 		return helpers.StringError("Invalid proxy mode")
 	}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+//region GLOBALS
+const (
+	// default time that we wait for the PROXY header of a connection
+	defaultProxyProtocolTimeout = 5 * time.Second
+	// maximum length of a PROXY protocol v1 header, including CRLF
+	maxProxyProtocolV1Length = 107
+
+	ProxyProtocolAccept  ProxyProtocolMode = "accept"
+	ProxyProtocolRequire ProxyProtocolMode = "require"
+
+	ProxyProtocolV1 ProxyProtocolVersion = "v1"
+	ProxyProtocolV2 ProxyProtocolVersion = "v2"
+
+	InvalidProxyProtocolMode    = helpers.StringError("Invalid PROXY protocol mode, it must be `accept` or `require`")
+	InvalidProxyProtocolVersion = helpers.StringError("Invalid PROXY protocol version, it must be `v1` or `v2`")
+	InvalidProxyProtocolHeader  = helpers.StringError("Invalid PROXY protocol header")
+	MissingProxyProtocolHeader  = helpers.StringError("Connection has no PROXY protocol header")
+	UntrustedProxyProtocolPeer  = helpers.StringError("PROXY protocol header from an untrusted address")
+	ListenerClosed              = helpers.StringError("Listener is closed")
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//endregion
+
+//region networks
+// parseNetworks parse a list of CIDRs, a single IP is accepted as a network with only one address
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(list))
+	for i := 0; i < len(list); i++ {
+		s := strings.TrimSpace(list[i])
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for i := 0; i < len(networks); i++ {
+		if networks[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP return IP of a TCP address, or `nil` if address has no IP
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+//endregion
+
+type ProxyProtocolMode string
+
+// ProxyProtocolVersion version of the PROXY header that is sent to the backends
+type ProxyProtocolVersion string
+
+func (this ProxyProtocolVersion) validate() error {
+	switch this {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", InvalidProxyProtocolVersion, this)
+	}
+}
+
+type ProxyProtocolConfig struct {
+	// Mode `accept` parse PROXY header if connection has one, `require` reject connections without a PROXY header
+	Mode ProxyProtocolMode `yaml:"mode"`
+	// TrustedNetworks CIDRs of the load balancers that may send PROXY headers, if it is empty every address is
+	// trusted
+	TrustedNetworks []string `yaml:"trustedNetworks,omitempty"`
+	// Timeout maximum time that we wait for the PROXY header, default is 5s
+	Timeout *time.Duration `yaml:"timeout,omitempty"`
+}
+
+type proxyProtocolSettings struct {
+	Require         bool
+	TrustedNetworks []*net.IPNet
+	Timeout         time.Duration
+}
+
+// newProxyProtocolSettings validate the config, or return `nil` if config is `nil`
+func newProxyProtocolSettings(config *ProxyProtocolConfig) (*proxyProtocolSettings, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	result := &proxyProtocolSettings{Timeout: defaultProxyProtocolTimeout}
+	switch config.Mode {
+	case ProxyProtocolAccept:
+	case ProxyProtocolRequire:
+		result.Require = true
+	default:
+		return nil, fmt.Errorf("%w: %s", InvalidProxyProtocolMode, config.Mode)
+	}
+
+	var err error
+	if result.TrustedNetworks, err = parseNetworks(config.TrustedNetworks); err != nil {
+		return nil, fmt.Errorf("Invalid trusted network of PROXY protocol: %w", err)
+	}
+	if config.Timeout != nil {
+		result.Timeout = *config.Timeout
+	}
+	return result, nil
+}
+
+func (this *proxyProtocolSettings) isTrusted(addr net.Addr) bool {
+	if len(this.TrustedNetworks) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	return ip != nil && networksContain(this.TrustedNetworks, ip)
+}
+
+//region header parsing
+// readProxyProtocolV1 parse a text header, `UNKNOWN` headers return `nil` addresses
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, maxProxyProtocolV1Length)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == maxProxyProtocolV1Length {
+			return nil, nil, InvalidProxyProtocolHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, InvalidProxyProtocolHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, InvalidProxyProtocolHeader
+	}
+
+	parse := func(host, port string) (net.Addr, error) {
+		ip := net.ParseIP(host)
+		p, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			return nil, InvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+	}
+	src, err := parse(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parse(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// readProxyProtocolV2 parse a binary header, `LOCAL` commands and unsupported families return `nil` addresses
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, InvalidProxyProtocolHeader
+	}
+	command, family := header[12]&0x0F, header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0: // LOCAL, connection is made by the load balancer itself
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, InvalidProxyProtocolHeader
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, nil, InvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, nil, InvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// readProxyProtocolHeader parse the PROXY header of a connection, `found` is false if connection has no header
+func readProxyProtocolHeader(reader *bufio.Reader) (src, dst net.Addr, found bool, err error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	switch first[0] {
+	case 'P':
+		signature, err := reader.Peek(6)
+		if err != nil || string(signature) != "PROXY " {
+			return nil, nil, false, err
+		}
+		src, dst, err = readProxyProtocolV1(reader)
+		return src, dst, true, err
+	case '\r':
+		signature, err := reader.Peek(len(proxyProtocolV2Signature))
+		if err != nil || !bytes.Equal(signature, proxyProtocolV2Signature) {
+			return nil, nil, false, err
+		}
+		src, dst, err = readProxyProtocolV2(reader)
+		return src, dst, true, err
+	default:
+		return nil, nil, false, nil
+	}
+}
+
+//endregion
+
+//region header writing
+// proxyProtocolAddresses return TCP addresses of the header, IPv4 addresses are mapped to IPv6 if families of
+// source and destination are not same. `ok` is false if source has no IP, if destination has no IP(for example a
+// unix socket) an unspecified address is used instead
+func proxyProtocolAddresses(src, dst net.Addr) (srcAddr, dstAddr *net.TCPAddr, v4 bool, ok bool) {
+	if src == nil {
+		return nil, nil, false, false
+	}
+	srcIP := addrIP(src)
+	if srcIP == nil {
+		return nil, nil, false, false
+	}
+
+	var dstIP net.IP
+	dstPort := 0
+	if dst != nil {
+		if dstIP = addrIP(dst); dstIP != nil {
+			dstPort = addrPort(dst)
+		}
+	}
+	if dstIP == nil {
+		dstIP = net.IPv6unspecified
+		if srcIP.To4() != nil {
+			dstIP = net.IPv4zero
+		}
+	}
+
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		return &net.TCPAddr{IP: src4, Port: addrPort(src)}, &net.TCPAddr{IP: dst4, Port: dstPort}, true, true
+	}
+	return &net.TCPAddr{IP: srcIP.To16(), Port: addrPort(src)}, &net.TCPAddr{IP: dstIP.To16(), Port: dstPort},
+		false, true
+}
+
+func addrPort(addr net.Addr) int {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.Port
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return int(p)
+}
+
+func proxyProtocolIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyProtocolHeader write a PROXY header that introduce `src` as the client, if `src` has no IP a
+// `UNKNOWN`(v1) or `LOCAL`(v2) header is written
+func writeProxyProtocolHeader(w io.Writer, version ProxyProtocolVersion, src, dst net.Addr) error {
+	srcAddr, dstAddr, v4, ok := proxyProtocolAddresses(src, dst)
+
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		if !ok {
+			header = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		family, srcIP, dstIP := "TCP4", srcAddr.IP.String(), dstAddr.IP.String()
+		if !v4 {
+			// `net.IP` print mapped IPv4 addresses in dotted form, but TCP6 needs an IPv6 address
+			family, srcIP, dstIP = "TCP6", proxyProtocolIPv6(srcAddr.IP), proxyProtocolIPv6(dstAddr.IP)
+		}
+		header = []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcAddr.Port, dstAddr.Port))
+
+	case ProxyProtocolV2:
+		header = append(header, proxyProtocolV2Signature...)
+		if !ok {
+			header = append(header, 0x20, 0x00, 0x00, 0x00) // LOCAL, UNSPEC
+			break
+		}
+		var body []byte
+		if v4 {
+			header = append(header, 0x21, 0x11) // PROXY, TCP over IPv4
+		} else {
+			header = append(header, 0x21, 0x21) // PROXY, TCP over IPv6
+		}
+		body = append(body, srcAddr.IP...)
+		body = append(body, dstAddr.IP...)
+		body = append(body, byte(srcAddr.Port>>8), byte(srcAddr.Port), byte(dstAddr.Port>>8), byte(dstAddr.Port))
+		header = append(header, byte(len(body)>>8), byte(len(body)))
+		header = append(header, body...)
+
+	default:
+		return fmt.Errorf("%w: %s", InvalidProxyProtocolVersion, version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+//endregion
+
+//region proxyProtocolConn
+// proxyProtocolConn is a connection whose PROXY header is consumed, it report the addresses from the header
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (this *proxyProtocolConn) Read(b []byte) (int, error) { return this.reader.Read(b) }
+func (this *proxyProtocolConn) RemoteAddr() net.Addr {
+	if this.remoteAddr != nil {
+		return this.remoteAddr
+	}
+	return this.Conn.RemoteAddr()
+}
+func (this *proxyProtocolConn) LocalAddr() net.Addr {
+	if this.localAddr != nil {
+		return this.localAddr
+	}
+	return this.Conn.LocalAddr()
+}
+
+// wrap read the PROXY header of a connection
+func (this *proxyProtocolSettings) wrap(conn net.Conn) (net.Conn, error) {
+	trusted := this.isTrusted(conn.RemoteAddr())
+	if this.Require && !trusted {
+		return nil, UntrustedProxyProtocolPeer
+	}
+
+	conn.SetReadDeadline(time.Now().Add(this.Timeout))
+	reader := bufio.NewReader(conn)
+	src, dst, found, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !found && this.Require {
+		return nil, MissingProxyProtocolHeader
+	}
+	if found && !trusted {
+		return nil, UntrustedProxyProtocolPeer
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	return &proxyProtocolConn{Conn: conn, reader: reader, remoteAddr: src, localAddr: dst}, nil
+}
+
+//endregion
+
+// newProxyProtocolListener create a listener that read PROXY header of the connections before they are returned
+// by `Accept`
+func newProxyProtocolListener(
+	listener net.Listener,
+	settings *proxyProtocolSettings,
+	logger helpers.Logger,
+) net.Listener {
+	return newPreparingListener(listener, settings.wrap, logger)
+}
+
+// listenTCP listen on a TCP address, PROXY headers of the connections are parsed if settings is not `nil`
+func listenTCP(address string, proxyProtocol *proxyProtocolSettings, logger helpers.Logger) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol != nil {
+		listener = newProxyProtocolListener(listener, proxyProtocol, logger)
+	}
+	return listener, nil
+}
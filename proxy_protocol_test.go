@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyProtocolV2Header(command, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, command, family, byte(len(body)>>8), byte(len(body)))
+	return append(header, body...)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v4Body := []byte{192, 168, 1, 10, 10, 0, 0, 1, 0xC3, 0x50, 0x07, 0x5B}
+	v6Body := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...),
+		0x04, 0xD2, 0x07, 0x5B)
+
+	tests := []struct {
+		name  string
+		input []byte
+		src   string
+		dst   string
+		found bool
+		err   error
+	}{
+		{name: "v1 TCP4", input: []byte("PROXY TCP4 192.168.1.10 10.0.0.1 50000 1883\r\n"),
+			src: "192.168.1.10:50000", dst: "10.0.0.1:1883", found: true},
+		{name: "v1 TCP6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1234 1883\r\n"),
+			src: "[2001:db8::1]:1234", dst: "[2001:db8::2]:1883", found: true},
+		{name: "v1 UNKNOWN", input: []byte("PROXY UNKNOWN\r\n"), found: true},
+		{name: "v1 UNKNOWN with addresses", input: []byte("PROXY UNKNOWN ::1 ::1 1 2\r\n"), found: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.168.1.10 10.0.0.1"), found: true, err: io.EOF},
+		{name: "v1 without CR", input: []byte("PROXY TCP4 192.168.1.10 10.0.0.1 50000 1883\n"), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v1 too long", input: []byte("PROXY TCP6 " + strings.Repeat("f", 100) + "\r\n"), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v1 longest", input: []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff " +
+			"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"),
+			src:   "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+			dst:   "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+			found: true},
+		{name: "v1 unknown family", input: []byte("PROXY UDP4 192.168.1.10 10.0.0.1 50000 1883\r\n"), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 192.168.1.10 10.0.0.1 50000\r\n"), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v1 invalid address", input: []byte("PROXY TCP4 192.168.1 10.0.0.1 50000 1883\r\n"), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 192.168.1.10 10.0.0.1 50000 70000\r\n"), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v2 TCP4", input: proxyProtocolV2Header(0x21, 0x11, v4Body),
+			src: "192.168.1.10:50000", dst: "10.0.0.1:1883", found: true},
+		{name: "v2 TCP6", input: proxyProtocolV2Header(0x21, 0x21, v6Body),
+			src: "[2001:db8::1]:1234", dst: "[2001:db8::2]:1883", found: true},
+		{name: "v2 TCP4 with TLVs", input: proxyProtocolV2Header(0x21, 0x11, append(v4Body, 0x04, 0x00, 0x01, 0)),
+			src: "192.168.1.10:50000", dst: "10.0.0.1:1883", found: true},
+		{name: "v2 LOCAL", input: proxyProtocolV2Header(0x20, 0x00, nil), found: true},
+		{name: "v2 LOCAL with addresses", input: proxyProtocolV2Header(0x20, 0x11, v4Body), found: true},
+		{name: "v2 unix socket", input: proxyProtocolV2Header(0x21, 0x31, make([]byte, 216)), found: true},
+		{name: "v2 truncated header", input: proxyProtocolV2Header(0x21, 0x11, nil)[:14], found: true,
+			err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated body", input: proxyProtocolV2Header(0x21, 0x11, v4Body)[:20], found: true,
+			err: io.ErrUnexpectedEOF},
+		{name: "v2 short TCP4 body", input: proxyProtocolV2Header(0x21, 0x11, v4Body[:8]), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v2 short TCP6 body", input: proxyProtocolV2Header(0x21, 0x21, v4Body), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v2 invalid version", input: proxyProtocolV2Header(0x11, 0x11, v4Body), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "v2 invalid command", input: proxyProtocolV2Header(0x22, 0x11, v4Body), found: true,
+			err: InvalidProxyProtocolHeader},
+		{name: "MQTT", input: []byte{0x10, 0x0D, 0x00, 0x04, 'M', 'Q', 'T', 'T'}},
+		{name: "HTTP", input: []byte("POST / HTTP/1.1\r\n")},
+		{name: "CR without signature", input: []byte("\r\n\r\n\x00\r\nQUIT\r")},
+		{name: "empty", input: nil, err: io.EOF},
+		{name: "P before end of signature", input: []byte("PROX"), err: io.EOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(append(test.input, "payload"...)))
+			if test.err != nil {
+				// nothing must follow a truncated header
+				reader = bufio.NewReader(bytes.NewReader(test.input))
+			}
+
+			src, dst, found, err := readProxyProtocolHeader(reader)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("Expected error `%v`, got `%v`", test.err, err)
+			}
+			if found != test.found {
+				t.Errorf("Expected found to be %v", test.found)
+			}
+			if addrString(src) != test.src || addrString(dst) != test.dst {
+				t.Errorf("Expected %s -> %s, got %s -> %s", test.src, test.dst, addrString(src), addrString(dst))
+			}
+			if err != nil {
+				return
+			}
+
+			// header must be consumed and nothing else
+			rest, _ := ioutil.ReadAll(reader)
+			expected := "payload"
+			if !found {
+				expected = string(test.input) + expected
+			}
+			if string(rest) != expected {
+				t.Errorf("Expected `%q` after the header, got `%q`", expected, rest)
+			}
+		})
+	}
+}
+
+func TestWriteProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		v1   string
+		// expected addresses of the parsed header
+		parsedSrc string
+		parsedDst string
+	}{
+		{
+			name:      "IPv4",
+			src:       &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000},
+			dst:       &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1883},
+			v1:        "PROXY TCP4 192.168.1.10 10.0.0.1 50000 1883\r\n",
+			parsedSrc: "192.168.1.10:50000",
+			parsedDst: "10.0.0.1:1883",
+		},
+		{
+			name:      "IPv6",
+			src:       &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+			dst:       &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1883},
+			v1:        "PROXY TCP6 2001:db8::1 2001:db8::2 1234 1883\r\n",
+			parsedSrc: "[2001:db8::1]:1234",
+			parsedDst: "[2001:db8::2]:1883",
+		},
+		{
+			name:      "mixed families",
+			src:       &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000},
+			dst:       &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1883},
+			v1:        "PROXY TCP6 ::ffff:192.168.1.10 2001:db8::2 50000 1883\r\n",
+			parsedSrc: "192.168.1.10:50000",
+			parsedDst: "[2001:db8::2]:1883",
+		},
+		{
+			name:      "unix destination",
+			src:       &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000},
+			dst:       &net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"},
+			v1:        "PROXY TCP4 192.168.1.10 0.0.0.0 50000 0\r\n",
+			parsedSrc: "192.168.1.10:50000",
+			parsedDst: "0.0.0.0:0",
+		},
+		{name: "unix source", src: &net.UnixAddr{Name: "@", Net: "unix"}, v1: "PROXY UNKNOWN\r\n"},
+		{name: "no source", v1: "PROXY UNKNOWN\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, version := range []ProxyProtocolVersion{ProxyProtocolV1, ProxyProtocolV2} {
+				buffer := &bytes.Buffer{}
+				if err := writeProxyProtocolHeader(buffer, version, test.src, test.dst); err != nil {
+					t.Fatalf("Failed to write %s header: %v", version, err)
+				}
+				if version == ProxyProtocolV1 && buffer.String() != test.v1 {
+					t.Errorf("Expected `%q`, got `%q`", test.v1, buffer.String())
+				}
+
+				src, dst, found, err := readProxyProtocolHeader(bufio.NewReader(buffer))
+				if err != nil || !found {
+					t.Fatalf("Failed to read %s header: %v", version, err)
+				}
+				if addrString(src) != test.parsedSrc || addrString(dst) != test.parsedDst {
+					t.Errorf("Expected %s -> %s in %s header, got %s -> %s", test.parsedSrc, test.parsedDst,
+						version, addrString(src), addrString(dst))
+				}
+			}
+		})
+	}
+
+	if err := writeProxyProtocolHeader(&bytes.Buffer{}, "v3", nil, nil); !errors.Is(err,
+		InvalidProxyProtocolVersion) {
+		t.Errorf("Expected `%v`, got `%v`", InvalidProxyProtocolVersion, err)
+	}
+}
+
+// wrapTestConn send `data` over a loopback connection and return the accepted connection after it is wrapped
+func wrapTestConn(t *testing.T, settings *proxyProtocolSettings, data []byte) (net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err = client.Write(data); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return settings.wrap(conn)
+}
+
+func TestProxyProtocolWrap(t *testing.T) {
+	header := []byte("PROXY TCP4 192.168.1.10 10.0.0.1 50000 1883\r\n")
+	payload := []byte{0xC0, 0x00}
+
+	tests := []struct {
+		name    string
+		mode    ProxyProtocolMode
+		trusted []string
+		data    []byte
+		// remote expected remote address, empty means address of the peer itself
+		remote string
+		err    error
+	}{
+		{name: "require trusted", mode: ProxyProtocolRequire, trusted: []string{"127.0.0.0/8"},
+			data: header, remote: "192.168.1.10:50000"},
+		{name: "require all trusted", mode: ProxyProtocolRequire, data: header, remote: "192.168.1.10:50000"},
+		{name: "require without header", mode: ProxyProtocolRequire, data: nil, err: MissingProxyProtocolHeader},
+		{name: "require untrusted", mode: ProxyProtocolRequire, trusted: []string{"10.0.0.0/8"},
+			data: header, err: UntrustedProxyProtocolPeer},
+		{name: "require untrusted without header", mode: ProxyProtocolRequire, trusted: []string{"10.0.0.1"},
+			data: nil, err: UntrustedProxyProtocolPeer},
+		{name: "accept trusted", mode: ProxyProtocolAccept, trusted: []string{"127.0.0.1"},
+			data: header, remote: "192.168.1.10:50000"},
+		{name: "accept without header", mode: ProxyProtocolAccept, data: nil},
+		{name: "accept untrusted", mode: ProxyProtocolAccept, trusted: []string{"10.0.0.0/8"},
+			data: header, err: UntrustedProxyProtocolPeer},
+		{name: "accept untrusted without header", mode: ProxyProtocolAccept, trusted: []string{"10.0.0.0/8"},
+			data: nil},
+		{name: "accept invalid header", mode: ProxyProtocolAccept, data: []byte("PROXY TCP4 a b c d\r\n"),
+			err: InvalidProxyProtocolHeader},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := newProxyProtocolSettings(&ProxyProtocolConfig{Mode: test.mode,
+				TrustedNetworks: test.trusted})
+			if err != nil {
+				t.Fatalf("Invalid settings: %v", err)
+			}
+
+			conn, err := wrapTestConn(t, settings, append(append([]byte{}, test.data...), payload...))
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("Expected error `%v`, got `%v`", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if test.remote != "" && conn.RemoteAddr().String() != test.remote {
+				t.Errorf("Expected remote address %s, got %s", test.remote, conn.RemoteAddr())
+			}
+			if test.remote == "" && !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+				t.Errorf("Expected address of the peer, got %s", conn.RemoteAddr())
+			}
+			received := make([]byte, len(payload))
+			if _, err = io.ReadFull(conn, received); err != nil || !bytes.Equal(received, payload) {
+				t.Errorf("Expected payload to be kept, got `%x`: %v", received, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolTimeout(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	settings, err := newProxyProtocolSettings(&ProxyProtocolConfig{Mode: ProxyProtocolRequire, Timeout: &timeout})
+	if err != nil {
+		t.Fatalf("Invalid settings: %v", err)
+	}
+
+	start := time.Now()
+	_, err = wrapTestConn(t, settings, []byte("PROXY TCP4"))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Timeout is not respected, it took %v", elapsed)
+	}
+}
+
+func TestProxyProtocolSettings(t *testing.T) {
+	if _, err := newProxyProtocolSettings(&ProxyProtocolConfig{Mode: "always"}); !errors.Is(err,
+		InvalidProxyProtocolMode) {
+		t.Errorf("Expected `%v`, got `%v`", InvalidProxyProtocolMode, err)
+	}
+	if _, err := newProxyProtocolSettings(&ProxyProtocolConfig{Mode: ProxyProtocolAccept,
+		TrustedNetworks: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("Expected an invalid network to be rejected")
+	}
+	if _, err := newProxyProtocolSettings(&ProxyProtocolConfig{Mode: ProxyProtocolAccept,
+		TrustedNetworks: []string{"localhost"}}); err == nil {
+		t.Errorf("Expected an invalid address to be rejected")
+	}
+
+	settings, err := newProxyProtocolSettings(&ProxyProtocolConfig{Mode: ProxyProtocolAccept,
+		TrustedNetworks: []string{"10.0.0.0/8", " 2001:db8::1 "}})
+	if err != nil {
+		t.Fatalf("Invalid settings: %v", err)
+	}
+	for addr, trusted := range map[string]bool{
+		"10.1.2.3:1883":      true,
+		"11.1.2.3:1883":      false,
+		"[2001:db8::1]:1883": true,
+		"[2001:db8::2]:1883": false,
+	} {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if settings.isTrusted(tcpAddr) != trusted {
+			t.Errorf("Expected trust of %s to be %v", addr, trusted)
+		}
+	}
+	if settings.isTrusted(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}) {
+		t.Errorf("Expected addresses without IP to be untrusted")
+	}
+}
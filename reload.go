@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+// interval of checking modification time of the configuration file
+const configWatchInterval = 5 * time.Second
+
+// ProxyManager run services of the proxy and reload them when configuration file changes or when the process
+// receives SIGHUP
+type ProxyManager struct {
+	Name       string
+	ConfigPath string
+	Logger     helpers.Logger
+
+	guard         sync.Mutex
+	config        *Config
+	configModTime time.Time
+	services      map[string]*MQTTService
+	running       map[string]*managedService
+	stopRequested chan struct{}
+	stopOnce      sync.Once
+}
+
+func NewProxyManager(configPath string, config *Config) (*ProxyManager, error) {
+	result := &ProxyManager{
+		Name:          "proxy-manager",
+		ConfigPath:    configPath,
+		Logger:        CreateLogger("proxy-manager"),
+		config:        config,
+		configModTime: getFileModTime(configPath),
+		running:       make(map[string]*managedService),
+		stopRequested: make(chan struct{}),
+	}
+
+	services, err := result.createServices(config)
+	if err != nil {
+		return nil, err
+	}
+	result.services = services
+	return result, nil
+}
+
+func getFileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// createServices create enabled services of the config, without starting them
+func (this *ProxyManager) createServices(config *Config) (map[string]*MQTTService, error) {
+	services := make(map[string]*MQTTService)
+	for svcName, svcConfig := range config.Services {
+		service, enabled, err := CreateService(svcName, svcConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load service(%v): %w", svcName, err)
+		}
+		if !enabled {
+			this.Logger.Verbosef(1, "Ignoring service(%v) as it is not enabled",
+				helpers.CContent(helpers.Green, svcName))
+			continue
+		}
+
+		services[svcName] = service
+	}
+	if len(services) == 0 {
+		return nil, helpers.StringError("There is no enabled service in the config")
+	}
+	return services, nil
+}
+
+// Reload read the configuration file again and apply its changes. If the new configuration is not valid, it will
+// be ignored and current configuration remain untouched.
+func (this *ProxyManager) Reload() error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	this.configModTime = getFileModTime(this.ConfigPath)
+	config, err := loadConfig(this.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	// create every service first, so an invalid configuration is rejected before anything is changed
+	services, err := this.createServices(config)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(config.Logging, this.config.Logging) || !reflect.DeepEqual(config.Metrics, this.config.Metrics) ||
+		!reflect.DeepEqual(config.Admin, this.config.Admin) {
+		this.Logger.Warnf("Changes of logging, metrics and admin configuration need a restart to take effect")
+	}
+
+	// find changes of every service before anything is changed, so an invalid update is rejected too
+	updates := make(map[string]*serviceUpdate)
+	for name, service := range services {
+		current, ok := this.services[name]
+		if !ok || reflect.DeepEqual(current.config, service.config) {
+			continue
+		}
+		if updates[name], err = current.prepareUpdate(service); err != nil {
+			return fmt.Errorf("Failed to update service `%s`: %w", name, err)
+		}
+	}
+
+	// stop removed services and frontends of every service first, so their addresses are free for new frontends,
+	// even if a frontend is moved from one service to another
+	removed := make([]string, 0)
+	for name := range this.services {
+		if _, ok := services[name]; !ok {
+			this.Logger.Infof("Stopping service `%s`", name)
+			this.stopService(name)
+			removed = append(removed, name)
+		}
+	}
+	for name, update := range updates {
+		this.Logger.Infof("Updating service `%s`", name)
+		this.services[name].stopRemovedFrontends(update)
+	}
+
+	if err = this.startChanges(services, updates); err != nil {
+		// restore the running configuration
+		for name, update := range updates {
+			this.services[name].rollbackUpdate(update)
+		}
+		for i := 0; i < len(removed); i++ {
+			this.restartService(removed[i])
+		}
+		return err
+	}
+
+	for i := 0; i < len(removed); i++ {
+		delete(this.services, removed[i])
+	}
+	for name, update := range updates {
+		this.services[name].commitUpdate(update)
+	}
+	for name, service := range services {
+		if _, ok := this.services[name]; !ok {
+			this.services[name] = service
+		}
+	}
+
+	this.config = config
+	return nil
+}
+
+// GetServices return running services sorted by their name
+func (this *ProxyManager) GetServices() []*MQTTService {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	result := make([]*MQTTService, 0, len(this.services))
+	for _, service := range this.services {
+		result = append(result, service)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+func (this *ProxyManager) GetService(name string) *MQTTService {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	return this.services[name]
+}
+
+// startChanges start new frontends of the updated services and the added services. If a service fails to start,
+// services that are started here are stopped again, frontends of the updated services must be rolled back by the
+// caller
+func (this *ProxyManager) startChanges(services map[string]*MQTTService, updates map[string]*serviceUpdate) error {
+	for name, update := range updates {
+		if err := this.services[name].startAddedFrontends(update); err != nil {
+			return fmt.Errorf("Failed to update service `%s`: %w", name, err)
+		}
+	}
+
+	added := make([]string, 0)
+	for name, service := range services {
+		if _, ok := this.services[name]; ok {
+			continue
+		}
+		this.Logger.Infof("Starting service `%s`", name)
+		if err := this.startService(name, service); err != nil {
+			for i := 0; i < len(added); i++ {
+				this.stopService(added[i])
+			}
+			return fmt.Errorf("Failed to start service `%s`: %w", name, err)
+		}
+		added = append(added, name)
+	}
+	return nil
+}
+
+// restartService start a service that is stopped by a failed reload again, from its running configuration
+func (this *ProxyManager) restartService(name string) {
+	service, _, err := CreateService(name, this.config.Services[name])
+	if err == nil {
+		err = this.startService(name, service)
+	}
+	if err != nil {
+		this.Logger.Errorf("Failed to restore service `%s`: %v", name, err)
+		delete(this.services, name)
+		return
+	}
+	this.services[name] = service
+}
+
+func (this *ProxyManager) startService(name string, service *MQTTService) error {
+	running, err := startManagedService(this.Logger, service)
+	if err != nil {
+		return err
+	}
+	this.running[name] = running
+	return nil
+}
+func (this *ProxyManager) stopService(name string) {
+	if running, ok := this.running[name]; ok {
+		running.Stop()
+		delete(this.running, name)
+	}
+}
+func (this *ProxyManager) reload(reason string) {
+	this.Logger.Infof("Reloading configuration: %s", reason)
+	if err := this.Reload(); err != nil {
+		this.Logger.Errorf("Rejected new configuration, running configuration is not changed: %v",
+			helpers.CContent(helpers.Orange, err))
+	}
+}
+
+func (this *ProxyManager) GetName() string { return this.Name }
+func (this *ProxyManager) Run() error {
+	this.guard.Lock()
+	for name, service := range this.services {
+		if err := this.startService(name, service); err != nil {
+			for name := range this.running {
+				this.stopService(name)
+			}
+			this.guard.Unlock()
+			return fmt.Errorf("Failed to start service `%s`: %w", name, err)
+		}
+	}
+	this.guard.Unlock()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.stopRequested:
+			this.guard.Lock()
+			for name := range this.running {
+				this.stopService(name)
+			}
+			this.guard.Unlock()
+			return helpers.ErrServiceStopped
+
+		case <-hangup:
+			this.reload("SIGHUP received")
+
+		case <-ticker.C:
+			this.guard.Lock()
+			changed := !getFileModTime(this.ConfigPath).Equal(this.configModTime)
+			this.guard.Unlock()
+			if changed {
+				this.reload("configuration file changed")
+			}
+		}
+	}
+}
+func (this *ProxyManager) Shutdown() {
+	this.stopOnce.Do(func() { close(this.stopRequested) })
+}
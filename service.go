@@ -5,6 +5,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/devops-simba/helpers"
 )
@@ -14,107 +15,705 @@ type MQTTService struct {
 	Frontends []*MQTTFrontend
 	Backends  MQTTBackendList
 	ProxyMode ServiceProxyMode
+	Balancing BalancingStrategy
+	// Authenticator validate credentials of the clients, it is `nil` if clients are not authenticated by the proxy
+	Authenticator Authenticator
+	// ACL return current ACL of the service, it is `nil` if topics of the clients are not checked
+	ACL func() *ACL
+	// Topics rewrite topics of the clients, it is `nil` if topics are not rewritten
+	Topics *TopicRewriter
+	// ConnackTimeout maximum time that we wait for a backend to accept the connection and answer CONNECT of the client
+	ConnackTimeout time.Duration
+	// ConnectTimeout maximum time that we wait for CONNECT of a client, before any backend is dialed
+	ConnectTimeout time.Duration
+	// IdleTimeout clients that send nothing for this duration are closed, it is used in raw mode and for clients
+	// without keepalive. 0 means idle clients are never closed
+	IdleTimeout time.Duration
+	// AnswerPings PINGREQ of the clients are answered by the proxy and backends are pinged by the proxy itself
+	AnswerPings bool
 
-	status          int32
-	frontEndService helpers.Service
+	// guard protect the fields above, as they may be replaced by a configuration reload
+	guard          sync.RWMutex
+	config         MQTTServiceConfig
+	balancingMode  BalancingMode
+	hashLoadFactor float64
+	drain          drainSettings
+	limiter        *connectionLimiter
+	status         int32
+	stopRequested  chan struct{}
+	stopOnce       sync.Once
+	logger         helpers.Logger
+	components     map[interface{}]*managedService
 }
 
-func (this *MQTTService) selectBackend(triedBackends MQTTBackendList) *MQTTBackend {
+// getSettings return a consistent snapshot of the settings that are needed to handle a client
+func (this *MQTTService) getSettings() (MQTTBackendList, BalancingStrategy, ServiceProxyMode, time.Duration) {
+	this.guard.RLock()
+	defer this.guard.RUnlock()
+
+	return this.Backends, this.Balancing, this.ProxyMode, this.ConnackTimeout
+}
+func (this *MQTTService) selectBackend(
+	backends MQTTBackendList,
+	balancing BalancingStrategy,
+	triedBackends MQTTBackendList,
+	clientID string,
+) *MQTTBackend {
 	// first try in active backends
-	activeBackends := this.Backends.Filter(func(backend *MQTTBackend) bool {
-		return backend.Weight > 0 && !triedBackends.Contains(backend) && backend.IsAvailable()
+	activeBackends := backends.Filter(func(backend *MQTTBackend) bool {
+		return backend.GetWeight() > 0 && !triedBackends.Contains(backend) && backend.AcceptsNewClients() &&
+			backend.IsAvailable()
 	})
 	if len(activeBackends) != 0 {
-		return activeBackends.RandomSelect(true)
+		return balancing.Select(activeBackends, true, clientID)
 	}
 
 	// now we try passive backends
-	passiveBackends := this.Backends.Filter(func(backend *MQTTBackend) bool {
-		return backend.Weight <= 0 && !triedBackends.Contains(backend) && backend.IsAvailable()
+	passiveBackends := backends.Filter(func(backend *MQTTBackend) bool {
+		return backend.GetWeight() <= 0 && !triedBackends.Contains(backend) && backend.AcceptsNewClients() &&
+			backend.IsAvailable()
 	})
 	if len(passiveBackends) != 0 {
-		return passiveBackends.RandomSelect(false)
+		return balancing.Select(passiveBackends, false, clientID)
 	}
 
 	// now we try with unavailable backends
-	activeBackends = this.Backends.Filter(func(backend *MQTTBackend) bool {
-		return backend.Weight > 0 && !triedBackends.Contains(backend)
+	activeBackends = backends.Filter(func(backend *MQTTBackend) bool {
+		return backend.GetWeight() > 0 && !triedBackends.Contains(backend) && backend.AcceptsNewClients()
 	})
 	if len(activeBackends) != 0 {
-		return activeBackends.RandomSelect(true)
+		return balancing.Select(activeBackends, true, clientID)
 	}
 
-	passiveBackends = this.Backends.Filter(func(backend *MQTTBackend) bool {
-		return backend.Weight <= 0 && !triedBackends.Contains(backend)
+	passiveBackends = backends.Filter(func(backend *MQTTBackend) bool {
+		return backend.GetWeight() <= 0 && !triedBackends.Contains(backend) && backend.AcceptsNewClients()
 	})
 	if len(passiveBackends) != 0 {
-		return passiveBackends.RandomSelect(false)
+		return balancing.Select(passiveBackends, false, clientID)
 	}
 
 	return nil // no backend is available
 }
-func (this *MQTTService) handleClient(frontend *MQTTFrontend, c net.Conn) {
-	OnClientConnect(this.Name, frontend.Name, frontend.Endpoint.GetProtocol())
-	defer OnClientDisconnect(this.Name, frontend.Name, frontend.Endpoint.GetProtocol())
 
+// acquireConnection reserve a connection for a client in the limits of the frontend and the service
+func (this *MQTTService) acquireConnection(frontend *MQTTFrontend, addr net.Addr) (func(), string) {
+	releaseFrontend, reason := frontend.Limiter.acquire(addr)
+	if releaseFrontend == nil {
+		return nil, reason
+	}
+	releaseService, reason := this.limiter.acquire(addr)
+	if releaseService == nil {
+		releaseFrontend()
+		return nil, reason
+	}
+	return func() {
+		releaseService()
+		releaseFrontend()
+	}, ""
+}
+func (this *MQTTService) handleClient(frontend *MQTTFrontend, session *ClientSession) {
+	c := session.Conn
 	logger := CreateLogger(fmt.Sprintf("client/%s{proto: %s, addr: %s}",
 		frontend.Name, frontend.Endpoint.GetProtocol(), c.RemoteAddr()))
 
-	var err error
+	release, reason := this.acquireConnection(frontend, c.RemoteAddr())
+	if release == nil {
+		logger.Warnf("Rejected the client, it exceed the limits: %s", reason)
+		OnConnectionRejected(this.Name, frontend.Name, reason)
+		rejectOverloadedClient(c)
+		return
+	}
+	defer release()
+
+	OnClientConnect(this.Name, frontend.Name, frontend.Endpoint.GetProtocol())
+	defer OnClientDisconnect(this.Name, frontend.Name, frontend.Endpoint.GetProtocol())
+
+	this.guard.RLock()
+	connectTimeout := this.ConnectTimeout
+	this.guard.RUnlock()
+
+	// client must send a complete CONNECT before its deadline, so idle clients never hold a backend connection
+	c.SetReadDeadline(time.Now().Add(connectTimeout))
+	connect, connectPacket, err := readConnectPacket(c)
+	if err != nil {
+		if isTimeout(err) {
+			logger.Warnf("Client did not send CONNECT in %v", connectTimeout)
+			OnConnectionRejected(this.Name, frontend.Name, RejectConnectTimeout)
+		} else if isEOF(err) {
+			logger.Debugf("Client closed the connection before sending CONNECT")
+		} else {
+			logger.Errorf("Failed to read CONNECT of the client: %v", err)
+		}
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	logger.Verbosef(11, "Read CONNECT of the client: %s", connectPacket.String())
+	version := connectPacket.ProtocolVersion
+	session.SetClientID(connectPacket.ClientID)
+	session.SetProtocolVersion(version)
+
+	if !this.authenticate(logger, frontend, session, connectPacket) {
+		return
+	}
+
+	topics, err := this.getClientTopics(frontend, connectPacket)
+	if err != nil {
+		logger.Warnf("Rejected client `%s`(username: `%s`): %v", connectPacket.ClientID, connectPacket.Username, err)
+		c.Write(newConnackPacket(version, ReasonNotAuthorized))
+		c.Close()
+		return
+	}
+	if topics != nil && connectPacket.WillFlag {
+		topics.RewriteConnect(connectPacket)
+		connect = EncodePacket(connectPacket, version)
+	}
+
+	backends, balancing, proxyMode, connackTimeout := this.getSettings()
+
 	var backend *MQTTBackend
 	var backendConn net.Conn
 	var triedBackends MQTTBackendList
+	// clientKeepAlive keepalive that client must respect, it may be changed by CONNACK of the backend
+	// backendKeepAlive keepalive that proxy must respect on the backend connection
+	var clientKeepAlive, backendKeepAlive uint16
+	// pingBackend keepalive of an older client is lowered for the backend, so proxy must ping the backend itself
+	var pingBackend bool
+	connack := newConnackPacket(version, ReasonServerUnavailable)
 	for {
-		backend = this.selectBackend(triedBackends)
+		backend = this.selectBackend(backends, balancing, triedBackends, connectPacket.ClientID)
 		if backend == nil {
 			logger.Errorf("Failed to select a backend a for client")
+			c.Write(connack)
+			c.Close()
 			return
 		}
+		triedBackends = triedBackends.Append(backend)
 
 		logger.Debugf("Trying `%s` as backend for this client", backend.Name)
-		backendConn, err = backend.Endpoint.Connect(this.Name, backend.Name)
-		if err == nil {
+		startTime := time.Now()
+		backendConnect, keepAlive := connect, connectPacket.KeepAlive
+		if backend.ConnectRewrite != nil {
+			rewritten := backend.ConnectRewrite.Rewrite(connectPacket, this.Name, frontend.Name)
+			if version < MQTT5 && proxyMode != PacketProxy {
+				// older clients can not be informed of a new keepalive and without `packets` mode proxy can not
+				// ping the backend for them, so their own keepalive is kept
+				rewritten.KeepAlive = connectPacket.KeepAlive
+			}
+			logger.Verbosef(11, "CONNECT is rewritten for backend `%s`: %s", backend.Name, rewritten.String())
+			backendConnect, keepAlive = EncodePacket(rewritten, version), rewritten.KeepAlive
+		}
+		backend.OnConnectionStarted()
+		conn, raw, connackPacket, err := backendHandshake(this.Name, backend, c.RemoteAddr(), c.LocalAddr(),
+			backendConnect, version, connackTimeout)
+		backend.OnConnectionFinished()
+		if err != nil {
+			logger.Warnf("Failed to connect to backend `%s`: %v", backend.Name, err)
+			backend.OnConnectionFailed()
+			continue
+		}
+
+		connack = raw
+		if connackPacket.ReasonCode == ReasonSuccess || isClientRefusal(version, connackPacket.ReasonCode) {
+			// other refusals are recorded as failed connections, so each attempt is a single latency sample
+			backend.RecordLatency(time.Since(startTime))
+		}
+		if connackPacket.ReasonCode == ReasonSuccess {
 			logger.Debugf("`%s` selected as backend", backend.Name)
 			backend.OnConnectionSucceeded()
+			backendConn = conn
+			backendKeepAlive = keepAlive
+			if version >= MQTT5 {
+				if serverKeepAlive, ok := connackPacket.Properties.GetInt(PropServerKeepAlive); ok {
+					backendKeepAlive = uint16(serverKeepAlive)
+				}
+			}
+			if version >= MQTT5 && keepAlive != connectPacket.KeepAlive {
+				// keepalive of the client is changed, so client must know it
+				if current, ok := connackPacket.Properties.GetInt(PropServerKeepAlive); !ok || current > uint32(keepAlive) {
+					connackPacket.Properties.Set(Property{ID: PropServerKeepAlive, Int: uint32(keepAlive)})
+					connack = EncodePacket(connackPacket, version)
+				}
+			}
+			pingBackend = version < MQTT5 && keepAlive != connectPacket.KeepAlive
+			clientKeepAlive = connectPacket.KeepAlive
+			if version >= MQTT5 {
+				if serverKeepAlive, ok := connackPacket.Properties.GetInt(PropServerKeepAlive); ok {
+					clientKeepAlive = uint16(serverKeepAlive)
+				}
+			}
 			break
-		} else {
-			logger.Warnf("Failed to connect to backend `%s`: %v", backend.Name, err)
-			backend.OnConnectionFailed()
 		}
+
+		conn.Close()
+		if isClientRefusal(version, connackPacket.ReasonCode) {
+			// backend is healthy, it just does not accept this client
+			logger.Debugf("Backend `%s` refused the client: %s",
+				backend.Name, connackReasonString(version, connackPacket.ReasonCode))
+			backend.OnConnectionSucceeded()
+			c.Write(connack)
+			c.Close()
+			return
+		}
+
+		logger.Warnf("Backend `%s` refused the connection: %s",
+			backend.Name, connackReasonString(version, connackPacket.ReasonCode))
+		backend.OnConnectionFailed()
+	}
+
+	if _, err = c.Write(connack); err != nil {
+		logger.Errorf("Failed to send CONNACK to the client: %v", err)
+		c.Close()
+		backendConn.Close()
+		return
+	}
+
+	session.SetBackend(backend)
+	backend.OnClientAttached()
+	defer backend.OnClientDetached()
+
+	this.guard.RLock()
+	state := newProxyState(this.Name, connectPacket, this.ACL, topics)
+	state.IdleTimeout = this.IdleTimeout
+	state.AnswerPings = (this.AnswerPings || pingBackend) && proxyMode == PacketProxy
+	this.guard.RUnlock()
+	if proxyMode == PacketProxy && clientKeepAlive != 0 {
+		// MQTT allow one and a half keepalive between packets of the client
+		state.IdleTimeout = time.Duration(clientKeepAlive) * 1500 * time.Millisecond
+	}
+	if state.AnswerPings {
+		state.Pinger = newBackendPinger(logger, backendConn, version, backendKeepAlive)
+		defer state.Pinger.stop()
 	}
 
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	go func() {
-		this.ProxyMode.Proxy(logger, FrontendToBackend, c, backendConn)
+		proxyMode.Proxy(logger, FrontendToBackend, c, backendConn, state)
 		wg.Done()
 	}()
 	go func() {
-		this.ProxyMode.Proxy(logger, BackendToFrontend, backendConn, c)
+		proxyMode.Proxy(logger, BackendToFrontend, backendConn, c, state)
 		wg.Done()
 	}()
 	wg.Wait()
 }
-func (this *MQTTService) startFrontends() helpers.Service {
-	listeners := make([]helpers.Service, len(this.Frontends))
+
+// authenticate validate credentials of the client, if client is rejected, proxy itself answer it and close the
+// connection without dialing any backend
+func (this *MQTTService) authenticate(
+	logger helpers.Logger,
+	frontend *MQTTFrontend,
+	session *ClientSession,
+	connect *ConnectPacket,
+) bool {
+	this.guard.RLock()
+	authenticator := this.Authenticator
+	this.guard.RUnlock()
+	if authenticator == nil {
+		return true
+	}
+
+	request := &AuthRequest{
+		ServiceName:       this.Name,
+		Frontend:          frontend.Name,
+		RemoteAddr:        session.RemoteAddr(),
+		Connect:           connect,
+		ClientCertificate: session.ClientCertificate(),
+	}
+	result, err := authenticator.Authenticate(request)
+	reason, label := result.ReasonCode(), result.String()
+	if err != nil {
+		logger.Errorf("Failed to authenticate the client: %v", err)
+		reason, label = ReasonServerUnavailable, "error"
+	}
+	OnAuthResult(this.Name, label)
+
+	if reason == ReasonSuccess {
+		session.SetUsername(connect.Username)
+		session.SetClaims(request.Claims)
+		return true
+	}
+
+	logger.Warnf("Rejected client `%s`(username: `%s`): %v", connect.ClientID, connect.Username, reason)
+	session.Conn.Write(newConnackPacket(connect.ProtocolVersion, reason))
+	session.Conn.Close()
+	return false
+}
+
+// getClientTopics return topic rewriter of a client, or `nil` if its topics are not rewritten
+func (this *MQTTService) getClientTopics(frontend *MQTTFrontend, connect *ConnectPacket) (*clientTopics, error) {
+	this.guard.RLock()
+	rewriter := this.Topics
+	this.guard.RUnlock()
+	if frontend.Topics != nil {
+		rewriter = frontend.Topics
+	}
+	if rewriter == nil {
+		return nil, nil
+	}
+	return rewriter.ForClient(connect.Username, connect.ClientID)
+}
+
+// startComponent run a frontend listener or a health checker of a backend in the background
+func (this *MQTTService) startComponent(key interface{}, service helpers.Service) error {
+	if service == nil {
+		return nil
+	}
+	component, err := startManagedService(this.logger, service)
+	if err != nil {
+		return err
+	}
+	this.components[key] = component
+	return nil
+}
+func (this *MQTTService) stopComponent(key interface{}) {
+	if component, ok := this.components[key]; ok {
+		component.Stop()
+		delete(this.components, key)
+	}
+}
+func (this *MQTTService) startFrontend(frontend *MQTTFrontend) error {
+	err := this.startComponent(frontend, frontend.CreateListenService(this.Name, func(c *ClientSession) {
+		this.handleClient(frontend, c)
+	}))
+	if err != nil {
+		return fmt.Errorf("Failed to start frontend `%s`: %w", frontend.Name, err)
+	}
+	return nil
+}
+func (this *MQTTService) startHealthChecker(backend *MQTTBackend) {
+	// health check configuration is already validated when we created the backend
+	checker, _ := backend.CreateHealthChecker(this.Name)
+	if checker != nil {
+		if err := this.startComponent(backend, checker); err != nil {
+			this.logger.Errorf("Failed to start health checker of backend `%s`: %v", backend.Name, err)
+		}
+	}
+}
+
+// serviceUpdate changes that a configuration reload make in a service, it is computed before anything is changed
+type serviceUpdate struct {
+	other            *MQTTService
+	backends         MQTTBackendList
+	balancing        BalancingStrategy
+	frontends        []*MQTTFrontend
+	removedFrontends []*MQTTFrontend
+	addedFrontends   []*MQTTFrontend
+}
+
+// prepareUpdate validate configuration of another(not started) service and find the changes that it make in this
+// service, this service is not changed
+func (this *MQTTService) prepareUpdate(other *MQTTService) (*serviceUpdate, error) {
+	this.guard.RLock()
+	defer this.guard.RUnlock()
+
+	update := &serviceUpdate{other: other}
+	update.backends = make(MQTTBackendList, 0, len(other.Backends))
+	for i := 0; i < len(other.Backends); i++ {
+		backend := other.Backends[i]
+		for j := 0; j < len(this.Backends); j++ {
+			if this.Backends[j].IsSameBackend(backend) {
+				backend = this.Backends[j]
+				break
+			}
+		}
+		update.backends = append(update.backends, backend)
+	}
+
+	var err error
+	update.balancing, err = NewBalancingStrategy(other.balancingMode, update.backends, other.hashLoadFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	update.frontends = make([]*MQTTFrontend, 0, len(other.Frontends))
+	for i := 0; i < len(other.Frontends); i++ {
+		frontend := other.Frontends[i]
+		for j := 0; j < len(this.Frontends); j++ {
+			if this.Frontends[j].IsSameFrontend(frontend) {
+				frontend = this.Frontends[j]
+				break
+			}
+		}
+		update.frontends = append(update.frontends, frontend)
+	}
 	for i := 0; i < len(this.Frontends); i++ {
-		frontend := this.Frontends[i]
-		listeners[i] = this.Frontends[i].CreateListenService(this.Name, func(c net.Conn) { this.handleClient(frontend, c) })
+		if !containsFrontend(update.frontends, this.Frontends[i]) {
+			update.removedFrontends = append(update.removedFrontends, this.Frontends[i])
+		}
 	}
-	return helpers.MergeServices(fmt.Sprintf("%s/frontend_listener", this.Name), listeners...)
+	for i := 0; i < len(update.frontends); i++ {
+		if !containsFrontend(this.Frontends, update.frontends[i]) {
+			update.addedFrontends = append(update.addedFrontends, update.frontends[i])
+		}
+	}
+	return update, nil
+}
+
+func (this *MQTTService) isRunning() bool { return atomic.LoadInt32(&this.status) == 1 }
+
+// stopRemovedFrontends stop frontends that are removed by an update, so their addresses are free for the new ones
+func (this *MQTTService) stopRemovedFrontends(update *serviceUpdate) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	if !this.isRunning() {
+		return
+	}
+	for i := 0; i < len(update.removedFrontends); i++ {
+		this.logger.Infof("Stopping frontend `%s`", update.removedFrontends[i].Name)
+		this.stopComponent(update.removedFrontends[i])
+	}
+}
+
+// startAddedFrontends start frontends that are added by an update. If a frontend fails to start, frontends that
+// are started here are stopped again
+func (this *MQTTService) startAddedFrontends(update *serviceUpdate) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	if !this.isRunning() {
+		return nil
+	}
+	for i := 0; i < len(update.addedFrontends); i++ {
+		this.logger.Infof("Starting frontend `%s`", update.addedFrontends[i].Name)
+		if err := this.startFrontend(update.addedFrontends[i]); err != nil {
+			for j := 0; j < i; j++ {
+				this.stopComponent(update.addedFrontends[j])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackUpdate stop frontends that are added by an update and start the removed ones again, it is used when an
+// update fails after its frontends are changed
+func (this *MQTTService) rollbackUpdate(update *serviceUpdate) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	if !this.isRunning() {
+		return
+	}
+	for i := 0; i < len(update.addedFrontends); i++ {
+		this.stopComponent(update.addedFrontends[i])
+	}
+	for i := 0; i < len(update.removedFrontends); i++ {
+		if _, ok := this.components[update.removedFrontends[i]]; ok {
+			continue
+		}
+		if err := this.startFrontend(update.removedFrontends[i]); err != nil {
+			this.logger.Errorf("Failed to restore frontend `%s`: %v", update.removedFrontends[i].Name, err)
+		}
+	}
+}
+
+// commitUpdate apply the remaining changes of an update, after its frontends are started
+func (this *MQTTService) commitUpdate(update *serviceUpdate) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	other := update.other
+	for i := 0; i < len(other.Backends); i++ {
+		for j := 0; j < len(this.Backends); j++ {
+			if this.Backends[j].IsSameBackend(other.Backends[i]) {
+				this.Backends[j].SetWeight(other.Backends[i].GetWeight())
+				break
+			}
+		}
+	}
+	// strategies may copy weights of the backends, so the strategy that is validated by `prepareUpdate` is
+	// built again with the new weights
+	if balancing, err := NewBalancingStrategy(other.balancingMode, update.backends, other.hashLoadFactor); err == nil {
+		update.balancing = balancing
+	}
+	if this.isRunning() {
+		for i := 0; i < len(this.Backends); i++ {
+			if !update.backends.Contains(this.Backends[i]) {
+				this.logger.Infof("Removing backend `%s`", this.Backends[i].Name)
+				this.stopComponent(this.Backends[i])
+			}
+		}
+		for i := 0; i < len(update.backends); i++ {
+			if !this.Backends.Contains(update.backends[i]) {
+				this.logger.Infof("Adding backend `%s`", update.backends[i].Name)
+				this.startHealthChecker(update.backends[i])
+			}
+		}
+	}
+
+	this.Backends = update.backends
+	this.Balancing = update.balancing
+	this.Frontends = update.frontends
+	this.ProxyMode = other.ProxyMode
+	this.Authenticator = other.Authenticator
+	this.ACL = other.ACL
+	this.AnswerPings = other.AnswerPings
+	this.Topics = other.Topics
+	this.ConnackTimeout = other.ConnackTimeout
+	this.ConnectTimeout = other.ConnectTimeout
+	this.IdleTimeout = other.IdleTimeout
+	this.balancingMode = other.balancingMode
+	this.hashLoadFactor = other.hashLoadFactor
+	this.drain = other.drain
+	this.limiter.update(other.limiter.getLimits())
+	this.config = other.config
+}
+
+// Update apply configuration of another(not started) service to this service. Backends and frontends that did not
+// change are kept along with their state and their clients. If a new frontend fails to start, service is not
+// changed
+func (this *MQTTService) Update(other *MQTTService) error {
+	update, err := this.prepareUpdate(other)
+	if err != nil {
+		return err
+	}
+	this.stopRemovedFrontends(update)
+	if err = this.startAddedFrontends(update); err != nil {
+		this.rollbackUpdate(update)
+		return err
+	}
+	this.commitUpdate(update)
+	return nil
+}
+
+// GetBackend find a backend of this service by its name
+func (this *MQTTService) GetBackend(name string) *MQTTBackend {
+	backends, _, _, _ := this.getSettings()
+	for i := 0; i < len(backends); i++ {
+		if backends[i].Name == name {
+			return backends[i]
+		}
+	}
+	return nil
+}
+
+// GetFrontends return current frontends of this service
+func (this *MQTTService) GetFrontends() []*MQTTFrontend {
+	this.guard.RLock()
+	defer this.guard.RUnlock()
+
+	return this.Frontends
+}
+
+// GetConnectedClients return clients that are connected to any frontend of this service
+func (this *MQTTService) GetConnectedClients() []*ClientSession {
+	this.guard.RLock()
+	defer this.guard.RUnlock()
+
+	var result []*ClientSession
+	for i := 0; i < len(this.Frontends); i++ {
+		result = append(result, this.Frontends[i].GetConnectedClients()...)
+	}
+	return result
+}
+
+// SetBackendWeight change weight of a backend until next configuration reload
+func (this *MQTTService) SetBackendWeight(backend *MQTTBackend, weight int) error {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	backend.SetWeight(weight)
+
+	// weights are part of the state of some strategies, so we need a new one
+	balancing, err := NewBalancingStrategy(this.balancingMode, this.Backends, this.hashLoadFactor)
+	if err != nil {
+		return err
+	}
+	this.Balancing = balancing
+	return nil
+}
+
+// DrainBackend stop sending new clients to the backend and gradually disconnect its current clients
+func (this *MQTTService) DrainBackend(backend *MQTTBackend) {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	backend.SetAdminState(BackendDraining)
+
+	key := drainKey{backend}
+	if drainer, ok := this.components[key]; ok {
+		select {
+		case <-drainer.done:
+			delete(this.components, key)
+		default:
+			return // backend is already draining
+		}
+	}
+	if atomic.LoadInt32(&this.status) == 1 {
+		this.startComponent(key, newBackendDrainer(this.Name, backend, this.drain, this.GetConnectedClients))
+	}
+}
+
+// DisconnectBackendClients disconnect every client of this service that is proxied to the backend
+func (this *MQTTService) DisconnectBackendClients(backend *MQTTBackend) int {
+	clients := this.GetConnectedClients()
+	disconnected := 0
+	for i := 0; i < len(clients); i++ {
+		if clients[i].Backend() == backend {
+			clients[i].Disconnect()
+			disconnected++
+		}
+	}
+	return disconnected
 }
 
 func (this *MQTTService) GetName() string { return this.Name }
-func (this *MQTTService) Run() error {
+
+// Listen start health checkers and frontends of the service, it fails if a frontend can not listen on its address
+func (this *MQTTService) Listen() error {
 	if !atomic.CompareAndSwapInt32(&this.status, 0, 1) {
 		return helpers.StringError("Function must only called when service is stopped")
 	}
 
-	this.frontEndService = this.startFrontends()
-	return this.frontEndService.Run()
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	for i := 0; i < len(this.Backends); i++ {
+		this.startHealthChecker(this.Backends[i])
+	}
+	for i := 0; i < len(this.Frontends); i++ {
+		if err := this.startFrontend(this.Frontends[i]); err != nil {
+			for key := range this.components {
+				this.stopComponent(key)
+			}
+			atomic.StoreInt32(&this.status, 2)
+			return err
+		}
+	}
+	return nil
+}
+func (this *MQTTService) Run() error {
+	if atomic.LoadInt32(&this.status) == 0 {
+		if err := this.Listen(); err != nil {
+			return err
+		}
+	}
+
+	<-this.stopRequested
+
+	this.guard.Lock()
+	for key := range this.components {
+		this.stopComponent(key)
+	}
+	atomic.StoreInt32(&this.status, 2)
+	this.guard.Unlock()
+
+	return helpers.ErrServiceStopped
 }
 func (this *MQTTService) Shutdown() {
-	this.frontEndService.Shutdown()
+	this.stopOnce.Do(func() { close(this.stopRequested) })
+}
+
+func containsFrontend(frontends []*MQTTFrontend, frontend *MQTTFrontend) bool {
+	for i := 0; i < len(frontends); i++ {
+		if frontends[i] == frontend {
+			return true
+		}
+	}
+	return false
 }
 
 type MQTTServiceConfig struct {
@@ -123,6 +722,33 @@ type MQTTServiceConfig struct {
 	Backends  []MQTTBackendConfig  `yaml:"backends"`
 	Enabled   *bool                `yaml:"enabled,omitempty"`
 	ProxyMode *ServiceProxyMode    `yaml:"proxyMode,omitempty"`
+	// Balancing strategy that select a backend for each client, default is `random`
+	Balancing *BalancingMode `yaml:"balancing,omitempty"`
+	// HashLoadFactor each backend may handle at most this factor of its fair share of clients when balancing
+	// is `clientId`, clients of an overloaded backend will move to the next backend in the ring
+	HashLoadFactor *float64 `yaml:"hashLoadFactor,omitempty"`
+	// ConnackTimeout maximum time that we wait for a backend to accept the connection and answer CONNECT of the client
+	ConnackTimeout *time.Duration `yaml:"connackTimeout,omitempty"`
+	// ConnectTimeout maximum time that a client may take to send a complete CONNECT, default is 10s
+	ConnectTimeout *time.Duration `yaml:"connectTimeout,omitempty"`
+	// IdleTimeout close clients that send nothing for this duration in raw mode or when their keepalive is 0, in
+	// packets mode clients with keepalive are closed after 1.5 times of their keepalive
+	IdleTimeout *time.Duration `yaml:"idleTimeout,omitempty"`
+	// HealthPolicy default health policy of the backends of this service
+	HealthPolicy *HealthPolicyConfig `yaml:"healthPolicy,omitempty"`
+	// Drain control how clients of a draining backend are disconnected
+	Drain *DrainConfig `yaml:"drain,omitempty"`
+	// Auth authenticate clients in the proxy, if it is missing clients are authenticated only by the backends
+	Auth *AuthConfig `yaml:"auth,omitempty"`
+	// ACL check topics of PUBLISH and SUBSCRIBE packets of the clients, it needs `packets` proxy mode
+	ACL *ACLConfig `yaml:"acl,omitempty"`
+	// AnswerPings answer PINGREQ of the clients in the proxy and only ping the backend when it has no other traffic
+	// in a keepalive interval, it needs `packets` proxy mode
+	AnswerPings *bool `yaml:"answerPings,omitempty"`
+	// Topics rewrite topics of the clients, it needs `packets` proxy mode. Frontends may have their own `topics`
+	Topics *TopicsConfig `yaml:"topics,omitempty"`
+	// Limits limit connections of all frontends of the service, frontends may also have their own `limits`
+	Limits *ConnectionLimitsConfig `yaml:"limits,omitempty"`
 }
 
 func CreateService(name string, config MQTTServiceConfig) (*MQTTService, bool, error) {
@@ -144,7 +770,7 @@ func CreateService(name string, config MQTTServiceConfig) (*MQTTService, bool, e
 
 	backends := make([]*MQTTBackend, 0, len(config.Backends))
 	for i := 0; i < len(config.Backends); i++ {
-		backend, enabled, err := CreateBackend(config.Backends[i])
+		backend, enabled, err := CreateBackend(config.Backends[i], config.HealthPolicy)
 		if err != nil {
 			return nil, false, err
 		}
@@ -158,9 +784,90 @@ func CreateService(name string, config MQTTServiceConfig) (*MQTTService, bool, e
 		return nil, false, fmt.Errorf("Service `%s` have no enabled backend", name)
 	}
 
-	service := &MQTTService{Name: name, Frontends: frontends, Backends: backends, ProxyMode: Raw}
+	service := &MQTTService{
+		Name:           name,
+		Frontends:      frontends,
+		Backends:       backends,
+		ProxyMode:      Raw,
+		ConnackTimeout: defaultConnackTimeout,
+		ConnectTimeout: defaultConnectTimeout,
+		config:         config,
+		stopRequested:  make(chan struct{}),
+		logger:         CreateLogger("service/" + name),
+		components:     make(map[interface{}]*managedService),
+	}
 	if config.ProxyMode != nil {
 		service.ProxyMode = *config.ProxyMode
 	}
+	balancing := RandomBalancing
+	if config.Balancing != nil {
+		balancing = *config.Balancing
+	}
+	loadFactor := defaultHashLoadFactor
+	if config.HashLoadFactor != nil {
+		if *config.HashLoadFactor < 1 {
+			return nil, false, fmt.Errorf("Service `%s` has an invalid hash load factor, it must be at least 1", name)
+		}
+		loadFactor = *config.HashLoadFactor
+	}
+	strategy, err := NewBalancingStrategy(balancing, backends, loadFactor)
+	if err != nil {
+		return nil, false, fmt.Errorf("Service `%s` has an invalid balancing: %w", name, err)
+	}
+	service.Balancing = strategy
+	service.balancingMode = balancing
+	service.hashLoadFactor = loadFactor
+	if config.ConnackTimeout != nil {
+		service.ConnackTimeout = *config.ConnackTimeout
+	}
+	if config.ConnectTimeout != nil {
+		if *config.ConnectTimeout <= 0 {
+			return nil, false, fmt.Errorf("Service `%s` has an invalid connect timeout, it must be positive", name)
+		}
+		service.ConnectTimeout = *config.ConnectTimeout
+	}
+	if config.IdleTimeout != nil {
+		if *config.IdleTimeout < 0 {
+			return nil, false, fmt.Errorf("Service `%s` has an invalid idle timeout, it must not be negative", name)
+		}
+		service.IdleTimeout = *config.IdleTimeout
+	}
+	service.drain, err = newDrainSettings(config.Drain)
+	if err != nil {
+		return nil, false, fmt.Errorf("Service `%s` has an invalid drain configuration: %w", name, err)
+	}
+	service.Authenticator, err = CreateAuthenticator(config.Auth)
+	if err != nil {
+		return nil, false, fmt.Errorf("Service `%s` has an invalid auth configuration: %w", name, err)
+	}
+	if config.ACL != nil && service.ProxyMode != PacketProxy {
+		return nil, false, fmt.Errorf("Service `%s` has an invalid ACL configuration: %w", name, ACLNeedsPacketsMode)
+	}
+	if GetOptionalBool(config.AnswerPings, false) {
+		if service.ProxyMode != PacketProxy {
+			return nil, false, fmt.Errorf("Service `%s` has an invalid configuration: %w", name, AnswerPingsNeedsPacketsMode)
+		}
+		service.AnswerPings = true
+	}
+	service.ACL, err = CreateACL(config.ACL)
+	if err != nil {
+		return nil, false, fmt.Errorf("Service `%s` has an invalid ACL configuration: %w", name, err)
+	}
+	rewritesTopics := config.Topics != nil
+	for i := 0; i < len(frontends); i++ {
+		rewritesTopics = rewritesTopics || frontends[i].Topics != nil
+	}
+	if rewritesTopics && service.ProxyMode != PacketProxy {
+		return nil, false, fmt.Errorf("Service `%s` has invalid topics: %w", name, TopicsNeedPacketsMode)
+	}
+	service.Topics, err = CreateTopicRewriter(config.Topics)
+	if err != nil {
+		return nil, false, fmt.Errorf("Service `%s` has invalid topics: %w", name, err)
+	}
+	limits, err := newConnectionLimits(config.Limits)
+	if err != nil {
+		return nil, false, fmt.Errorf("Service `%s` has invalid limits: %w", name, err)
+	}
+	service.limiter = newConnectionLimiter(limits)
 	return service, GetOptionalBool(config.Enabled, true), nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func intPtr(value int) *int { return &value }
+
+func newBalancedServiceConfig(weightA, weightB int) MQTTServiceConfig {
+	balancing := ClientIdBalancing
+	return MQTTServiceConfig{
+		Frontends: []MQTTFrontendConfig{
+			{MQTTServerEndpointConfig: MQTTServerEndpointConfig{Address: "mqtt://127.0.0.1:1883"}},
+		},
+		Backends: []MQTTBackendConfig{
+			{
+				MQTTClientEndpointConfig: MQTTClientEndpointConfig{Address: "mqtt://127.0.0.1:1884"},
+				Name:                     "a",
+				Weight:                   intPtr(weightA),
+			},
+			{
+				MQTTClientEndpointConfig: MQTTClientEndpointConfig{Address: "mqtt://127.0.0.1:1885"},
+				Name:                     "b",
+				Weight:                   intPtr(weightB),
+			},
+		},
+		Balancing: &balancing,
+	}
+}
+
+// countSelections select a backend for `n` clients and count clients of each backend
+func countSelections(service *MQTTService, n int) map[string]int {
+	backends, balancing, _, _ := service.getSettings()
+	result := make(map[string]int)
+	for i := 0; i < n; i++ {
+		backend := balancing.Select(backends, true, "client-"+strconv.Itoa(i))
+		result[backend.Name]++
+	}
+	return result
+}
+
+func TestServiceUpdateAppliesWeights(t *testing.T) {
+	const clients = 4000
+	service, _, err := CreateService("service", newBalancedServiceConfig(1, 1))
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	counts := countSelections(service, clients)
+	if counts["b"] < clients*4/10 || counts["b"] > clients*6/10 {
+		t.Fatalf("Backend `b` got %d of %d clients with equal weights", counts["b"], clients)
+	}
+
+	backendB := service.GetBackend("b")
+	other, _, err := CreateService("service", newBalancedServiceConfig(1, 3))
+	if err != nil {
+		t.Fatalf("Failed to create updated service: %v", err)
+	}
+	if err = service.Update(other); err != nil {
+		t.Fatalf("Failed to update service: %v", err)
+	}
+	if service.GetBackend("b") != backendB {
+		t.Fatal("Backend `b` was replaced by a weight change")
+	}
+	if backendB.GetWeight() != 3 {
+		t.Fatalf("Weight of backend `b` is %d, expected 3", backendB.GetWeight())
+	}
+
+	counts = countSelections(service, clients)
+	if counts["b"] < clients*65/100 || counts["b"] > clients*85/100 {
+		t.Fatalf("Backend `b` got %d of %d clients with weight 3:1", counts["b"], clients)
+	}
+}
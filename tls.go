@@ -49,7 +49,7 @@ func (this *TlsServerConfiguration) LoadAsTlsConfig() (*tls.Config, error) {
 				if err != nil {
 					return nil, err
 				}
-				if result.ClientCAs.AppendCertsFromPEM(pem) {
+				if !result.ClientCAs.AppendCertsFromPEM(pem) {
 					return nil, fmt.Errorf("Failed to parse CA file: %v", caFile)
 				}
 			}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/devops-simba/helpers"
+)
+
+const (
+	TopicsNeedPacketsMode = helpers.StringError("Topic rewriting is only supported in `packets` proxy mode")
+	InvalidClientTopics   = helpers.StringError("Username or client ID of the client can not be used in its topics")
+)
+
+const sharedSubscriptionPrefix = "$share/"
+
+// substituteClientInfo replace `%u` and `%c` of a template with username and client ID of a client. It return false
+// if the template needs a value that is empty or contains `+`, `#` or `/`, because such a value could widen the
+// template to topics of the other clients
+func substituteClientInfo(template, username, clientID string) (string, bool) {
+	if strings.Contains(template, "%u") {
+		if username == "" || strings.ContainsAny(username, "+#/") {
+			return "", false
+		}
+		template = strings.ReplaceAll(template, "%u", username)
+	}
+	if strings.Contains(template, "%c") {
+		if clientID == "" || strings.ContainsAny(clientID, "+#/") {
+			return "", false
+		}
+		template = strings.ReplaceAll(template, "%c", clientID)
+	}
+	return template, true
+}
+
+type TopicRewriteRuleConfig struct {
+	// Match regular expression that is matched against the topic
+	Match string `yaml:"match"`
+	// Replace replacement of a matched topic, it may contain `$1` for groups of `Match` and `%u` and `%c`
+	Replace string `yaml:"replace"`
+}
+
+type TopicsConfig struct {
+	// MountPoint prefix of the topics of the clients in the backend, it may contain `%u` and `%c`
+	MountPoint string `yaml:"mountPoint,omitempty"`
+	// Rewrite rules of the topics that are sent to the backend, first matching rule is used
+	Rewrite []TopicRewriteRuleConfig `yaml:"rewrite,omitempty"`
+	// ReverseRewrite rules of the topics that are sent to the client, first matching rule is used
+	ReverseRewrite []TopicRewriteRuleConfig `yaml:"reverseRewrite,omitempty"`
+}
+
+type topicRewriteRule struct {
+	Match   *regexp.Regexp
+	Replace string
+}
+
+func compileTopicRewriteRules(configs []TopicRewriteRuleConfig) ([]topicRewriteRule, error) {
+	rules := make([]topicRewriteRule, 0, len(configs))
+	for i := 0; i < len(configs); i++ {
+		match, err := regexp.Compile(configs[i].Match)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid topic rewrite rule `%s`: %w", configs[i].Match, err)
+		}
+		rules = append(rules, topicRewriteRule{Match: match, Replace: configs[i].Replace})
+	}
+	return rules, nil
+}
+
+func applyTopicRewriteRules(rules []topicRewriteRule, topic string) string {
+	for i := 0; i < len(rules); i++ {
+		if rules[i].Match.MatchString(topic) {
+			return rules[i].Match.ReplaceAllString(topic, rules[i].Replace)
+		}
+	}
+	return topic
+}
+
+// TopicRewriter rewrite topics of the clients of a frontend or a service
+type TopicRewriter struct {
+	MountPoint     string
+	Rewrite        []topicRewriteRule
+	ReverseRewrite []topicRewriteRule
+}
+
+// CreateTopicRewriter compile the config, or return `nil` if config is `nil`
+func CreateTopicRewriter(config *TopicsConfig) (*TopicRewriter, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	rewrite, err := compileTopicRewriteRules(config.Rewrite)
+	if err != nil {
+		return nil, err
+	}
+	reverseRewrite, err := compileTopicRewriteRules(config.ReverseRewrite)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicRewriter{MountPoint: config.MountPoint, Rewrite: rewrite, ReverseRewrite: reverseRewrite}, nil
+}
+
+// ForClient substitute `%u` and `%c` of the rules with username and client ID of a client
+func (this *TopicRewriter) ForClient(username, clientID string) (*clientTopics, error) {
+	mountPoint, ok := substituteClientInfo(this.MountPoint, username, clientID)
+	if !ok {
+		return nil, InvalidClientTopics
+	}
+
+	// `$` of the values must not be expanded by the regular expressions
+	escapedUsername := strings.ReplaceAll(username, "$", "$$")
+	escapedClientID := strings.ReplaceAll(clientID, "$", "$$")
+	forClient := func(rules []topicRewriteRule) ([]topicRewriteRule, error) {
+		result := make([]topicRewriteRule, len(rules))
+		for i := 0; i < len(rules); i++ {
+			replace, ok := substituteClientInfo(rules[i].Replace, escapedUsername, escapedClientID)
+			if !ok {
+				return nil, InvalidClientTopics
+			}
+			result[i] = topicRewriteRule{Match: rules[i].Match, Replace: replace}
+		}
+		return result, nil
+	}
+
+	result := &clientTopics{MountPoint: mountPoint}
+	var err error
+	if result.Rewrite, err = forClient(this.Rewrite); err != nil {
+		return nil, err
+	}
+	if result.ReverseRewrite, err = forClient(this.ReverseRewrite); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// clientTopics rewrite topics of one client
+type clientTopics struct {
+	MountPoint     string
+	Rewrite        []topicRewriteRule
+	ReverseRewrite []topicRewriteRule
+}
+
+// ToBackend rewrite a topic or a topic filter of the client, group of the shared subscriptions is kept
+func (this *clientTopics) ToBackend(topic string) string {
+	share := ""
+	if strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		if i := strings.IndexByte(topic[len(sharedSubscriptionPrefix):], '/'); i != -1 {
+			n := len(sharedSubscriptionPrefix) + i + 1
+			share, topic = topic[:n], topic[n:]
+		}
+	}
+	return share + this.MountPoint + applyTopicRewriteRules(this.Rewrite, topic)
+}
+
+// ToClient rewrite a topic that backend send to the client, topics outside of the mount point are not changed
+func (this *clientTopics) ToClient(topic string) string {
+	if this.MountPoint != "" {
+		if !strings.HasPrefix(topic, this.MountPoint) {
+			return topic
+		}
+		topic = topic[len(this.MountPoint):]
+	}
+	return applyTopicRewriteRules(this.ReverseRewrite, topic)
+}
+
+// rewriteResponseTopic rewrite `ResponseTopic` property of MQTT 5 packets
+func rewriteResponseTopic(props *Properties, rewrite func(string) string) {
+	if prop := props.Get(PropResponseTopic); prop != nil {
+		prop.Data = []byte(rewrite(string(prop.Data)))
+	}
+}
+
+// RewriteConnect rewrite will topic of the client
+func (this *clientTopics) RewriteConnect(pkt *ConnectPacket) {
+	if !pkt.WillFlag {
+		return
+	}
+	pkt.WillTopic = this.ToBackend(pkt.WillTopic)
+	rewriteResponseTopic(&pkt.WillProperties, this.ToBackend)
+}
+
+// RewriteToBackend rewrite topics of a packet that client send to the backend
+func (this *clientTopics) RewriteToBackend(packet MQTTPacket) {
+	switch pkt := packet.(type) {
+	case *PublishPacket:
+		// an empty topic means that the client used a topic alias
+		if pkt.TopicName != "" {
+			pkt.TopicName = this.ToBackend(pkt.TopicName)
+		}
+		rewriteResponseTopic(&pkt.Properties, this.ToBackend)
+	case *SubscribePacket:
+		for i := 0; i < len(pkt.Subscriptions); i++ {
+			pkt.Subscriptions[i].TopicFilter = this.ToBackend(pkt.Subscriptions[i].TopicFilter)
+		}
+	case *UnsubscribePacket:
+		for i := 0; i < len(pkt.TopicFilters); i++ {
+			pkt.TopicFilters[i] = this.ToBackend(pkt.TopicFilters[i])
+		}
+	}
+}
+
+// RewriteToClient rewrite topics of a packet that backend send to the client
+func (this *clientTopics) RewriteToClient(packet MQTTPacket) {
+	if pkt, ok := packet.(*PublishPacket); ok {
+		if pkt.TopicName != "" {
+			pkt.TopicName = this.ToClient(pkt.TopicName)
+		}
+		rewriteResponseTopic(&pkt.Properties, this.ToClient)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func mustClientTopics(t *testing.T, config TopicsConfig, username, clientID string) *clientTopics {
+	rewriter, err := CreateTopicRewriter(&config)
+	if err != nil {
+		t.Fatalf("Failed to create topic rewriter: %v", err)
+	}
+	topics, err := rewriter.ForClient(username, clientID)
+	if err != nil {
+		t.Fatalf("Failed to create topics of the client: %v", err)
+	}
+	return topics
+}
+
+func TestTopicsMountPoint(t *testing.T) {
+	topics := mustClientTopics(t, TopicsConfig{MountPoint: "tenants/%u/"}, "alice", "c1")
+	tests := []struct {
+		name    string
+		client  string
+		backend string
+	}{
+		{name: "topic", client: "a/b", backend: "tenants/alice/a/b"},
+		{name: "filter", client: "a/+/#", backend: "tenants/alice/a/+/#"},
+		{name: "shared subscription", client: "$share/group/a/#", backend: "$share/group/tenants/alice/a/#"},
+		{name: "shared subscription of everything", client: "$share/group/#", backend: "$share/group/tenants/alice/#"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if backend := topics.ToBackend(test.client); backend != test.backend {
+				t.Errorf("Expected `%s` in the backend, got `%s`", test.backend, backend)
+			}
+		})
+	}
+
+	if client := topics.ToClient("tenants/alice/a/b"); client != "a/b" {
+		t.Errorf("Expected mount point to be removed, got `%s`", client)
+	}
+	if client := topics.ToClient("tenants/bob/a/b"); client != "tenants/bob/a/b" {
+		t.Errorf("Expected topics outside of the mount point to be kept, got `%s`", client)
+	}
+
+	subscribe := &SubscribePacket{Subscriptions: []Subscription{{TopicFilter: "$share/g/a"}, {TopicFilter: "b/#"}}}
+	topics.RewriteToBackend(subscribe)
+	if subscribe.Subscriptions[0].TopicFilter != "$share/g/tenants/alice/a" ||
+		subscribe.Subscriptions[1].TopicFilter != "tenants/alice/b/#" {
+		t.Errorf("Unexpected filters of SUBSCRIBE: %+v", subscribe.Subscriptions)
+	}
+	unsubscribe := &UnsubscribePacket{TopicFilters: []string{"$share/g/a", "b/#"}}
+	topics.RewriteToBackend(unsubscribe)
+	if unsubscribe.TopicFilters[0] != "$share/g/tenants/alice/a" || unsubscribe.TopicFilters[1] != "tenants/alice/b/#" {
+		t.Errorf("Unexpected filters of UNSUBSCRIBE: %v", unsubscribe.TopicFilters)
+	}
+
+	publish := &PublishPacket{TopicName: "a/b"}
+	publish.Properties.Set(Property{ID: PropResponseTopic, Data: []byte("replies/c1")})
+	topics.RewriteToBackend(publish)
+	if response, _ := publish.Properties.GetString(PropResponseTopic); publish.TopicName != "tenants/alice/a/b" ||
+		response != "tenants/alice/replies/c1" {
+		t.Errorf("Unexpected PUBLISH to the backend: %s, response topic: %s", publish.TopicName, response)
+	}
+	topics.RewriteToClient(publish)
+	if response, _ := publish.Properties.GetString(PropResponseTopic); publish.TopicName != "a/b" ||
+		response != "replies/c1" {
+		t.Errorf("Unexpected PUBLISH to the client: %s, response topic: %s", publish.TopicName, response)
+	}
+
+	connect := &ConnectPacket{WillFlag: true, WillTopic: "status"}
+	topics.RewriteConnect(connect)
+	if connect.WillTopic != "tenants/alice/status" {
+		t.Errorf("Expected will topic to be rewritten, got `%s`", connect.WillTopic)
+	}
+}
+
+func TestTopicsRewriteRules(t *testing.T) {
+	config := TopicsConfig{
+		Rewrite: []TopicRewriteRuleConfig{
+			{Match: "^devices/([^/]+)/up$", Replace: "telemetry/%c/$1"},
+			{Match: "^devices/", Replace: "legacy/"},
+		},
+		ReverseRewrite: []TopicRewriteRuleConfig{
+			{Match: "^commands/[^/]+/(.+)$", Replace: "cmd/$1"},
+		},
+	}
+	// `$1` of the client ID must not be expanded
+	topics := mustClientTopics(t, config, "alice", "c$1")
+
+	tests := []struct {
+		name     string
+		toClient bool
+		topic    string
+		expected string
+	}{
+		{name: "first matching rule", topic: "devices/d1/up", expected: "telemetry/c$1/d1"},
+		{name: "second rule", topic: "devices/d1/down", expected: "legacy/d1/down"},
+		{name: "no matching rule", topic: "other/topic", expected: "other/topic"},
+		{name: "reverse rule", toClient: true, topic: "commands/c1/reboot", expected: "cmd/reboot"},
+		{name: "no matching reverse rule", toClient: true, topic: "events/x", expected: "events/x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := topics.ToBackend(test.topic)
+			if test.toClient {
+				result = topics.ToClient(test.topic)
+			}
+			if result != test.expected {
+				t.Errorf("Expected `%s`, got `%s`", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestTopicsForClient(t *testing.T) {
+	if _, err := CreateTopicRewriter(&TopicsConfig{Rewrite: []TopicRewriteRuleConfig{{Match: "("}}}); err == nil {
+		t.Error("Expected invalid regular expression to be rejected")
+	}
+
+	rewriter, _ := CreateTopicRewriter(&TopicsConfig{MountPoint: "%u/",
+		Rewrite: []TopicRewriteRuleConfig{{Match: "^x$", Replace: "%c"}}})
+	tests := []struct {
+		name     string
+		username string
+		clientID string
+	}{
+		{name: "missing username", clientID: "c1"},
+		{name: "wildcard username", username: "+", clientID: "c1"},
+		{name: "username with level", username: "a/b", clientID: "c1"},
+		{name: "missing client ID", username: "alice"},
+		{name: "wildcard client ID", username: "alice", clientID: "#"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := rewriter.ForClient(test.username, test.clientID); !errors.Is(err, InvalidClientTopics) {
+				t.Errorf("Expected `%v`, got `%v`", InvalidClientTopics, err)
+			}
+		})
+	}
+}
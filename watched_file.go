@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/devops-simba/helpers"
+)
+
+// default interval of checking modification time of a watched file
+const defaultFileCheckInterval = time.Second
+
+// watchedFile keep parsed content of a file and parse it again when its modification time changes. Checks are
+// lazy, so a file that is not used is never checked
+type watchedFile struct {
+	Path          string
+	CheckInterval time.Duration
+	Parse         func(content []byte) (interface{}, error)
+	Logger        helpers.Logger
+
+	guard     sync.Mutex
+	value     interface{}
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newWatchedFile read and parse the file, an error is returned if the file could not be read or parsed
+func newWatchedFile(
+	path string,
+	logger helpers.Logger,
+	parse func(content []byte) (interface{}, error),
+) (*watchedFile, error) {
+	result := &watchedFile{
+		Path:          path,
+		CheckInterval: defaultFileCheckInterval,
+		Parse:         parse,
+		Logger:        logger,
+	}
+	if err := result.load(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *watchedFile) load() error {
+	info, err := os.Stat(this.Path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(this.Path)
+	if err != nil {
+		return err
+	}
+	value, err := this.Parse(content)
+	if err != nil {
+		return err
+	}
+
+	this.value = value
+	this.modTime = info.ModTime()
+	this.lastCheck = time.Now()
+	return nil
+}
+
+// Get return parsed content of the file. If the file changed and new content is not valid, the error is logged
+// and old content is returned
+func (this *watchedFile) Get() interface{} {
+	this.guard.Lock()
+	defer this.guard.Unlock()
+
+	if time.Since(this.lastCheck) < this.CheckInterval {
+		return this.value
+	}
+	this.lastCheck = time.Now()
+
+	modTime := getFileModTime(this.Path)
+	if modTime.Equal(this.modTime) {
+		return this.value
+	}
+	if err := this.load(); err != nil {
+		// do not try again until the file changes again
+		this.modTime = modTime
+		this.Logger.Errorf("Failed to reload `%s`, keeping its previous content: %v", this.Path, err)
+	} else {
+		this.Logger.Infof("`%s` reloaded", this.Path)
+	}
+	return this.value
+}